@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+type GDPRRequest struct {
+	Email string `json:"email"`
+	// Format of an export, json (default) or csv
+	Format string `json:"format"`
+	// Anonymize keeps the non-identifying fields of an erased signup for statistics
+	Anonymize bool `json:"anonymize"`
+}
+
+// requireAdmin only lets requests with the ADMIN_TOKEN as bearer token or a session cookie through.
+// Without a token configured the admin API does not exist, rather than being open.
+func requireAdmin(token string, sessions *AdminSessions) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if token == "" {
+			context.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		given := context.GetHeader("Authorization")
+		if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) == 1 {
+			context.Next()
+			return
+		}
+		if session, err := context.Cookie(adminSessionCookie); err == nil && given == "" && sessions.valid(session) {
+			context.Set(adminCookieKey, session)
+			context.Next()
+			return
+		}
+		context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Errors": []string{"admin token required"}})
+	}
+}
+
+func bindGDPRRequest(context *gin.Context) (GDPRRequest, bool) {
+	var req GDPRRequest
+	if !bindJSON(context, &req) {
+		return req, false
+	}
+	if err := validateEmail(req.Email); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"Errors": []string{err.Error()}})
+		return req, false
+	}
+	return req, true
+}
+
+func auditRequest(context *gin.Context, action, email string, records int, details string) {
+	err := AUDIT_LOG.Record(AuditEntry{
+		Action:    action,
+		Subject:   AUDIT_LOG.Subject(email),
+		Actor:     "admin-api",
+		ClientIP:  clientIP(context),
+		RequestID: context.Writer.Header().Get(requestIDHeader),
+		Records:   records,
+		Details:   details,
+	})
+	if err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not write audit log", "action", action, "error", err)
+	}
+}
+
+// handleGDPRExport returns everything stored about an email address as JSON or CSV
+func handleGDPRExport(context *gin.Context) {
+	req, ok := bindGDPRRequest(context)
+	if !ok {
+		return
+	}
+
+	export, err := exportMemberData(req.Email)
+	if err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not read signups for export", "error", err)
+		context.JSON(http.StatusInternalServerError, gin.H{"Errors": []string{"could not read the stored signups"}})
+		return
+	}
+	auditRequest(context, auditExport, req.Email, len(export.Signups), req.Format)
+
+	if req.Format == "csv" {
+		context.Header("Content-Disposition", `attachment; filename="export.csv"`)
+		context.Header("Content-Type", "text/csv; charset=utf-8")
+		context.Status(http.StatusOK)
+		if err := writeExportCSV(context.Writer, export); err != nil {
+			slog.ErrorContext(context.Request.Context(), "Could not write CSV export", "error", err)
+		}
+		return
+	}
+	context.JSON(http.StatusOK, export)
+}
+
+// handleGDPRErase deletes or anonymizes everything stored about an email address
+func handleGDPRErase(context *gin.Context) {
+	req, ok := bindGDPRRequest(context)
+	if !ok {
+		return
+	}
+
+	result, err := eraseMemberData(req.Email, req.Anonymize)
+	action := auditErase
+	if req.Anonymize {
+		action = auditAnonymize
+	}
+	details := ""
+	if err != nil {
+		details = "failed: " + err.Error()
+	}
+	auditRequest(context, action, req.Email, result.Signups, details)
+
+	if err != nil {
+		slog.ErrorContext(context.Request.Context(), "Erasure request failed", "error", err)
+		context.JSON(http.StatusInternalServerError, gin.H{"Errors": []string{"erasure failed halfway, see the logs and try again"}, "Result": result})
+		return
+	}
+	context.JSON(http.StatusOK, result)
+}
+
+type StatusRequest struct {
+	Status SignupStatus `json:"status"`
+}
+
+func handleListSignups(context *gin.Context) {
+	signups, err := SIGNUP_STORE.All()
+	if err == nil {
+		signups, err = SIGNUP_STORE.Reveal(signups...)
+	}
+	if err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not read signups", "error", err)
+		context.JSON(http.StatusInternalServerError, gin.H{"Errors": []string{"could not read the stored signups"}})
+		return
+	}
+	listed := make([]ListedSignup, len(signups))
+	for i, signup := range signups {
+		listed[i] = ListedSignup{StoredSignup: signup, PossibleDuplicates: findDuplicates(signup.Member, slices.Concat(signups[:i], signups[i+1:]))}
+	}
+	context.JSON(http.StatusOK, gin.H{"Signups": listed})
+}
+
+// ListedSignup is a signup in the admin list, with the other signups that look like the same person
+type ListedSignup struct {
+	StoredSignup
+	PossibleDuplicates []DuplicateMatch `json:"possible_duplicates,omitempty"`
+}
+
+// handleSignupStatus lets the secretary mark a signup as processed, rejected or abandoned,
+// which starts the retention period of that status
+func handleSignupStatus(context *gin.Context) {
+	var req StatusRequest
+	if !bindJSON(context, &req) {
+		return
+	}
+	if !validSignupStatus(req.Status) {
+		context.JSON(http.StatusBadRequest, gin.H{"Errors": []string{"status must be received, processed, rejected or abandoned"}})
+		return
+	}
+
+	signup, err := SIGNUP_STORE.Update(context.Param("id"), func(signup *StoredSignup) {
+		signup.Status = req.Status
+	})
+	if err == nil {
+		var revealed []StoredSignup
+		revealed, err = SIGNUP_STORE.Reveal(signup)
+		if err == nil {
+			signup = revealed[0]
+		}
+	}
+	if errors.Is(err, ErrSignupNotFound) {
+		context.JSON(http.StatusNotFound, gin.H{"Errors": []string{err.Error()}})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not update signup status", "error", err)
+		context.JSON(http.StatusInternalServerError, gin.H{"Errors": []string{"could not update the signup"}})
+		return
+	}
+	context.JSON(http.StatusOK, signup)
+}
+
+// handlePurge runs the retention purge now, ?dry_run=true only reports what it would remove
+func handlePurge(context *gin.Context) {
+	dryRun := context.Query("dry_run") == "true"
+
+	report, err := purgeExpiredSignups(retentionPolicyFromConfig(CONFIG), dryRun, "admin-api")
+	if err != nil {
+		slog.ErrorContext(context.Request.Context(), "Purge failed", "error", err)
+		context.JSON(http.StatusInternalServerError, gin.H{"Errors": []string{"purge failed, see the logs"}, "Report": report})
+		return
+	}
+	context.JSON(http.StatusOK, report)
+}
+
+func handleAuditLog(context *gin.Context) {
+	entries, err := AUDIT_LOG.Entries()
+	if err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not read audit log", "error", err)
+		context.JSON(http.StatusInternalServerError, gin.H{"Errors": []string{"could not read audit log"}})
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	context.JSON(http.StatusOK, gin.H{"Entries": entries})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// attachment encryption modes
+const (
+	attachmentPlain   = "none"
+	attachmentOpenPGP = "openpgp"
+	attachmentZip     = "zip"
+)
+
+// AttachmentSealer encrypts the CSV that is mailed to the secretary, either with OpenPGP to the public keys of
+// the recipients or as an AES-256 encrypted ZIP file that 7-Zip, WinZip and macOS Archive Utility can open.
+type AttachmentSealer struct {
+	mode       string
+	recipients openpgp.EntityList
+	password   string
+}
+
+// ATTACHMENT_SEALER is set by main from the config, nil sends the attachment as it is
+var ATTACHMENT_SEALER *AttachmentSealer
+
+// loadAttachmentSealer reads the keys or the password for ATTACHMENT_ENCRYPTION from their files
+func loadAttachmentSealer(config Config) (*AttachmentSealer, error) {
+	switch config.AttachmentEncryption {
+	case attachmentPlain:
+		return nil, nil
+	case attachmentOpenPGP:
+		if len(config.AttachmentPGPKeys) == 0 {
+			return nil, errors.New("ATTACHMENT_ENCRYPTION=openpgp needs ATTACHMENT_PGP_KEYS")
+		}
+		sealer := &AttachmentSealer{mode: attachmentOpenPGP}
+		for _, path := range config.AttachmentPGPKeys {
+			file, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			keys, err := openpgp.ReadArmoredKeyRing(file)
+			file.Close()
+			if err != nil {
+				return nil, fmt.Errorf("reading public key %s: %w", path, err)
+			}
+			sealer.recipients = append(sealer.recipients, keys...)
+		}
+		return sealer, nil
+	case attachmentZip:
+		if config.AttachmentPasswordFile == "" {
+			return nil, errors.New("ATTACHMENT_ENCRYPTION=zip needs ATTACHMENT_PASSWORD_FILE")
+		}
+		password, err := os.ReadFile(config.AttachmentPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		sealer := &AttachmentSealer{mode: attachmentZip, password: strings.TrimSpace(string(password))}
+		if sealer.password == "" {
+			return nil, errors.New("ATTACHMENT_PASSWORD_FILE is empty")
+		}
+		return sealer, nil
+	}
+	return nil, fmt.Errorf("unknown ATTACHMENT_ENCRYPTION %q", config.AttachmentEncryption)
+}
+
+// seal returns the file name and contents to attach in place of the given file
+func (sealer *AttachmentSealer) seal(name string, contents []byte) (string, []byte, error) {
+	if sealer == nil {
+		return name, contents, nil
+	}
+	if sealer.mode == attachmentOpenPGP {
+		sealed, err := sealer.encryptOpenPGP(name, contents)
+		return name + ".asc", sealed, err
+	}
+	sealed, err := sealer.encryptZip(name, contents)
+	return strings.TrimSuffix(name, ".csv") + ".zip", sealed, err
+}
+
+func (sealer *AttachmentSealer) encryptOpenPGP(name string, contents []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	armored, err := armor.Encode(&buffer, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openpgp.Encrypt(armored, sealer.recipients, nil, &openpgp.FileHints{IsBinary: true, FileName: name}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := plaintext.Write(contents); err != nil {
+		return nil, err
+	}
+	if err := plaintext.Close(); err != nil {
+		return nil, err
+	}
+	if err := armored.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// WinZip AES encryption (AE-2), https://www.winzip.com/en/support/aes-encryption/
+const (
+	winzipAESMethod     = 99
+	winzipAESSaltSize   = 16
+	winzipAESKeySize    = 32
+	winzipAESIterations = 1000
+	winzipAESMACSize    = 10
+)
+
+// encryptZip writes a ZIP file holding one deflated file encrypted with AES-256
+func (sealer *AttachmentSealer) encryptZip(name string, contents []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	deflater, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+	deflater.Write(contents)
+	if err := deflater.Close(); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, winzipAESSaltSize)
+	rand.Read(salt)
+	encryptionKey, macKey, verifier := winzipAESKeys(sealer.password, salt)
+
+	encrypted := compressed.Bytes()
+	if err := winzipAESCrypt(encryptionKey, encrypted); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(encrypted)
+
+	var data bytes.Buffer
+	data.Write(salt)
+	data.Write(verifier)
+	data.Write(encrypted)
+	data.Write(mac.Sum(nil)[:winzipAESMACSize])
+
+	// AE-2 leaves the CRC out, the authentication code takes its place
+	extra := binary.LittleEndian.AppendUint16(nil, 0x9901)
+	extra = binary.LittleEndian.AppendUint16(extra, 7)
+	extra = binary.LittleEndian.AppendUint16(extra, 2)
+	extra = append(extra, 'A', 'E', 3)
+	extra = binary.LittleEndian.AppendUint16(extra, zip.Deflate)
+
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	file, err := writer.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             winzipAESMethod,
+		Flags:              0x1,
+		Extra:              extra,
+		CompressedSize64:   uint64(data.Len()),
+		UncompressedSize64: uint64(len(contents)),
+		// 5.1 is the version of the spec that added AES
+		ReaderVersion: 51,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(data.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return archive.Bytes(), nil
+}
+
+// winzipAESKeys derives the AES key, the HMAC key and the password verifier from the password
+func winzipAESKeys(password string, salt []byte) (encryptionKey, macKey, verifier []byte) {
+	derived := pbkdf2.Key([]byte(password), salt, winzipAESIterations, 2*winzipAESKeySize+2, sha1.New)
+	return derived[:winzipAESKeySize], derived[winzipAESKeySize : 2*winzipAESKeySize], derived[2*winzipAESKeySize:]
+}
+
+// winzipAESCrypt en- or decrypts data in place with AES in CTR mode. WinZip counts in little endian starting
+// at 1, where cipher.NewCTR counts in big endian, so the key stream is made here.
+func winzipAESCrypt(key, data []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	counter := make([]byte, aes.BlockSize)
+	stream := make([]byte, aes.BlockSize)
+	for offset := 0; offset < len(data); offset += aes.BlockSize {
+		binary.LittleEndian.PutUint64(counter, uint64(offset/aes.BlockSize+1))
+		block.Encrypt(stream, counter)
+		for i := offset; i < len(data) && i < offset+aes.BlockSize; i++ {
+			data[i] ^= stream[i-offset]
+		}
+	}
+	return nil
+}
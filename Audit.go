@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// audit actions
+const (
+	auditExport    = "export"
+	auditErase     = "erase"
+	auditAnonymize = "anonymize"
+	auditPurge     = "purge"
+)
+
+// AuditEntry records one request about the data of a member. The member is only identified by an HMAC of
+// their email address: the trail has to outlive the erasure it proves, so it can not hold the address itself,
+// and a plain hash of it could be reversed by hashing a list of addresses.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Subject   string    `json:"subject,omitempty"`
+	Actor     string    `json:"actor"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Records   int       `json:"records"`
+	Details   string    `json:"details,omitempty"`
+}
+
+// AuditLog is an append-only JSON lines file, or a slice in memory when it has no path
+type AuditLog struct {
+	mutex   sync.Mutex
+	path    string
+	entries []AuditEntry
+	// subjectKey keys the HMAC of Subject, the in-memory log of the tests has none
+	subjectKey []byte
+}
+
+// AUDIT_LOG is replaced by main with the log at AUDIT_LOG_PATH, tests use this in-memory one
+var AUDIT_LOG = &AuditLog{}
+
+// openAuditLog opens the trail at path, identifying members with subjectKey or a random key when it is empty
+func openAuditLog(path, subjectKey string) (*AuditLog, error) {
+	key := []byte(subjectKey)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, subjectKey: key}, file.Close()
+}
+
+func (audit *AuditLog) Record(entry AuditEntry) error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	if audit.path == "" {
+		audit.entries = append(audit.entries, entry)
+		return nil
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(audit.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (audit *AuditLog) Entries() ([]AuditEntry, error) {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	if audit.path == "" {
+		return slices.Clone(audit.entries), nil
+	}
+
+	file, err := os.Open(audit.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, errors.Join(errors.New("corrupt audit log line"), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Subject identifies an email address the same way for every entry, so the trail of one member can be found
+// with `backend gdpr subject <email>`, but only by who has the key
+func (audit *AuditLog) Subject(email string) string {
+	signer := hmac.New(sha256.New, audit.subjectKey)
+	signer.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(signer.Sum(nil))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrFormTokenMissing = errors.New("form token is missing")
+	ErrFormTokenInvalid = errors.New("form token is not ours")
+	ErrFormTokenExpired = errors.New("form token has expired")
+	ErrFormTooFast      = errors.New("form was submitted faster than a person can fill it in")
+)
+
+// BotTrap holds the fields of the signup form that are only there to catch bots. They are decoded next to
+// PISignUp, so they never end up in the store or the mail.
+type BotTrap struct {
+	// Honeypot is a field hidden from people, only bots fill it in
+	Honeypot string `json:"website"`
+	// FormToken is handed out by /api/form-token when the form is shown
+	FormToken string `json:"form_token"`
+}
+
+// FormTimer signs the moment a form was shown, so a submission can prove how long it took to fill in
+type FormTimer struct {
+	key      []byte
+	minFill  time.Duration
+	maxAge   time.Duration
+	required bool
+	now      func() time.Time
+}
+
+// FORM_TIMER is replaced by main with one using the configured key, tests use this one with a random key
+var FORM_TIMER = newFormTimer(defaultConfig())
+
+func newFormTimer(config Config) *FormTimer {
+	key := []byte(config.FormTokenKey)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &FormTimer{
+		key:      key,
+		minFill:  config.FormMinFillTime,
+		maxAge:   config.FormTokenMaxAge,
+		required: config.FormTokenRequired,
+		now:      time.Now,
+	}
+}
+
+func (timer *FormTimer) sign(issued string) string {
+	signer := hmac.New(sha256.New, timer.key)
+	signer.Write([]byte("form:" + issued))
+	return hex.EncodeToString(signer.Sum(nil))
+}
+
+// Issue returns a token like 1767225600123.<hmac> holding the current time in milliseconds
+func (timer *FormTimer) Issue() string {
+	issued := strconv.FormatInt(timer.now().UnixMilli(), 10)
+	return issued + "." + timer.sign(issued)
+}
+
+// Check tells whether the form of the token was filled in at a human pace
+func (timer *FormTimer) Check(token string) error {
+	if token == "" {
+		if timer.required {
+			return ErrFormTokenMissing
+		}
+		return nil
+	}
+
+	issued, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(timer.sign(issued)), []byte(signature)) {
+		return ErrFormTokenInvalid
+	}
+	milliseconds, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil {
+		return ErrFormTokenInvalid
+	}
+
+	elapsed := timer.now().Sub(time.UnixMilli(milliseconds))
+	if elapsed < timer.minFill {
+		return ErrFormTooFast
+	}
+	if elapsed > timer.maxAge {
+		return ErrFormTokenExpired
+	}
+	return nil
+}
+
+func handleFormToken(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{"token": FORM_TIMER.Issue()})
+}
+
+// botGuard stops submissions that fill the honeypot, come in too fast or whose form token does not hold up.
+// Bots get the same answer as a successful signup, so they have no reason to try something else. A token that
+// is not ours may as well be from before a restart or from another instance, so that one, like an expired or
+// missing token, asks for a reload. It returns false when the request was answered.
+func botGuard(context *gin.Context, trap BotTrap) bool {
+	err := FORM_TIMER.Check(trap.FormToken)
+	if trap.Honeypot != "" {
+		err = errors.New("honeypot field was filled in")
+	}
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrFormTokenExpired), errors.Is(err, ErrFormTokenMissing), errors.Is(err, ErrFormTokenInvalid):
+		// a person who left the tab open, an outdated page or a token signed with another key
+		slog.WarnContext(context.Request.Context(), "Refused signup", "reason", err)
+		context.JSON(http.StatusBadRequest, gin.H{"Errors": []string{"het formulier is verlopen. Herlaad de pagina (je formuliervelden blijven bestaan)"}})
+	default:
+		SIGNUPS.WithLabelValues(signupBotDetected).Inc()
+		slog.WarnContext(context.Request.Context(), "Discarded signup from a bot", "reason", err)
+		context.JSON(http.StatusOK, gin.H{"Success": "Registration successful."})
+	}
+	return false
+}
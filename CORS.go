@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// CORSPolicy tells browsers which other sites may call the API
+type CORSPolicy struct {
+	// Origins are like https://svpromptusimperii.nl, https://*.svpromptusimperii.nl for every subdomain,
+	// or * for any site
+	Origins     []string
+	Methods     []string
+	Headers     []string
+	Credentials bool
+	// MaxAge is how long a browser may remember the answer to a preflight request
+	MaxAge time.Duration
+}
+
+func (policy CORSPolicy) validate(prefix string) []error {
+	var errs []error
+	for _, origin := range policy.Origins {
+		if origin == "*" {
+			if policy.Credentials {
+				errs = append(errs, fmt.Errorf("%sCORS_ORIGINS can not be * when %sCORS_CREDENTIALS is on", prefix, prefix))
+			}
+			continue
+		}
+		if _, _, err := parseOrigin(strings.Replace(origin, "://*.", "://", 1)); err != nil {
+			errs = append(errs, fmt.Errorf("%sCORS_ORIGINS: %w", prefix, err))
+		}
+	}
+	if policy.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("%sCORS_MAX_AGE must not be negative", prefix))
+	}
+	return errs
+}
+
+// parseOrigin splits an origin like https://example.org:8443 into its scheme and host
+func parseOrigin(origin string) (scheme, host string, err error) {
+	parsed, err := url.Parse(origin)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+		parsed.User != nil || (parsed.Path != "" && parsed.Path != "/") || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", "", fmt.Errorf("%q is not an origin like https://example.org", origin)
+	}
+	return parsed.Scheme, strings.ToLower(parsed.Host), nil
+}
+
+// allows tells whether a page on origin may call the API. A wildcard only stands for subdomains, so
+// https://*.example.org allows https://beta.example.org but not https://example.org or https://evil-example.org.
+func (policy CORSPolicy) allows(origin string) bool {
+	scheme, host, err := parseOrigin(origin)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range policy.Origins {
+		allowedScheme, allowedHost, err := parseOrigin(strings.Replace(allowed, "://*.", "://", 1))
+		if err != nil || allowedScheme != scheme {
+			continue
+		}
+		if !strings.Contains(allowed, "://*.") && host == allowedHost {
+			return true
+		}
+		if strings.Contains(allowed, "://*.") && strings.HasSuffix(host, "."+allowedHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler answers preflight requests and adds the CORS headers to the others. Requests from origins that are
+// not allowed are refused with 403.
+func (policy CORSPolicy) handler() gin.HandlerFunc {
+	config := cors.Config{
+		AllowMethods:     policy.Methods,
+		AllowHeaders:     policy.Headers,
+		AllowCredentials: policy.Credentials,
+		MaxAge:           policy.MaxAge,
+	}
+	if slices.Contains(policy.Origins, "*") {
+		config.AllowAllOrigins = true
+	} else {
+		config.AllowOriginFunc = policy.allows
+	}
+	return cors.New(config)
+}
+
+// corsByRoute applies the policy of the longest matching path prefix in groups, and fallback to every other
+// request. The route groups can not do this themselves: preflight requests have no route of their own, so
+// only middleware on the router sees them.
+func corsByRoute(fallback CORSPolicy, groups map[string]CORSPolicy) gin.HandlerFunc {
+	prefixes := make([]string, 0, len(groups))
+	handlers := map[string]gin.HandlerFunc{}
+	for prefix, policy := range groups {
+		prefixes = append(prefixes, prefix)
+		handlers[prefix] = policy.handler()
+	}
+	// longest first, so /api/admin/gdpr can have a policy of its own within /api/admin
+	slices.SortFunc(prefixes, func(a, b string) int { return len(b) - len(a) })
+	fallbackHandler := fallback.handler()
+
+	return func(context *gin.Context) {
+		path := context.Request.URL.Path
+		for _, prefix := range prefixes {
+			if path == prefix || strings.HasPrefix(path, prefix+"/") {
+				handlers[prefix](context)
+				return
+			}
+		}
+		fallbackHandler(context)
+	}
+}
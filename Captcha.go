@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k42-software/go-altcha"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrCaptchaMalformed = errors.New("captcha payload is malformed")
+	ErrCaptchaExpired   = errors.New("captcha challenge has expired")
+	ErrCaptchaInvalid   = errors.New("captcha solution or signature is invalid")
+	ErrCaptchaReplayed  = errors.New("captcha challenge was already used")
+	ErrCaptchaTooEarly  = errors.New("captcha solution is not valid yet")
+)
+
+// CaptchaVerifier hands out the challenges for the captcha widget and checks the solutions sent with a
+// signup or email request. The router gets one from main, tests can hand it one they control.
+type CaptchaVerifier interface {
+	// NewChallenge makes a challenge for the client at ip
+	NewChallenge(ip string) AltchaChallenge
+	// DelayedSolution returns a solved challenge that only verifies after delay, for browsers without JavaScript
+	DelayedSolution(delay time.Duration) string
+	// Verify returns nil when the payload solves a challenge of ours, which can not be used again after that
+	Verify(payload string) error
+}
+
+// AltchaChallenge is what the Altcha widget fetches from /api/captcha-challenge
+type AltchaChallenge struct {
+	Algorithm string `json:"algorithm"`
+	Challenge string `json:"challenge"`
+	MaxNumber int    `json:"maxnumber,omitempty"`
+	Salt      string `json:"salt"`
+	Signature string `json:"signature"`
+}
+
+// Altcha issues and checks proof-of-work challenges. The library keeps its signing secrets in memory and
+// rotates them every five minutes, so we sign with our own key instead: the key is shared between instances
+// and the expiry is ours to choose. The expiry travels in the salt
+// (salt?expires=<unix time>) like the Altcha widget expects, which binds it to the signed challenge.
+// Spent challenges are kept in Redis when RATE_LIMIT_REDIS_URL is set. Otherwise they are kept in memory and
+// lost on a restart, so challenges handed out before the start are rejected rather than accepted a second time.
+type Altcha struct {
+	key        []byte
+	algorithm  string
+	maxNumber  int
+	saltLength int
+	ttl        time.Duration
+	spent      ChallengeLedger
+	// startedAt is set when spent is in memory, it only knows the challenges handed out after it
+	startedAt time.Time
+	adaptive  AdaptiveDifficulty
+	volume    *challengeVolume
+	now       func() time.Time
+}
+
+// AdaptiveDifficulty doubles the work of a challenge for every PerIP challenges a client fetched within Window,
+// and for every Global challenges handed out in total, up to MaxNumber. Solving takes a visitor a second,
+// a script asking for thousands of challenges soon spends minutes on each. A zero threshold is not adaptive.
+type AdaptiveDifficulty struct {
+	Window    time.Duration
+	PerIP     int
+	Global    int
+	MaxNumber int
+}
+
+func newAltcha(config Config) *Altcha {
+	key := []byte(config.AltchaHMACKey)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	captcha := &Altcha{
+		key:        key,
+		algorithm:  config.AltchaAlgorithm,
+		maxNumber:  config.AltchaMaxNumber,
+		saltLength: config.AltchaSaltLength,
+		ttl:        config.AltchaChallengeTTL,
+		spent:      newSpentChallenges(),
+		startedAt:  time.Now(),
+		adaptive:   config.AltchaAdaptive,
+		volume:     newChallengeVolume(),
+		now:        time.Now,
+	}
+	// a URL that does not parse stops the rate limiter from starting, so it is not reported here
+	if options, err := redis.ParseURL(config.RateLimitRedisURL); config.RateLimitRedisURL != "" && err == nil {
+		captcha.spent = &redisChallengeLedger{client: redis.NewClient(options), fallback: newSpentChallenges()}
+		captcha.startedAt = time.Time{}
+	}
+	return captcha
+}
+
+func altchaHash(algorithm string) (func() hash.Hash, bool) {
+	switch algorithm {
+	case altcha.SHA256.String():
+		return sha256.New, true
+	case altcha.SHA384.String():
+		return sha512.New384, true
+	case altcha.SHA512.String():
+		return sha512.New, true
+	}
+	return nil, false
+}
+
+// hashSolution is the challenge a number solves: hex(hash(salt + number))
+func hashSolution(newHash func() hash.Hash, salt string, number int) string {
+	hasher := newHash()
+	hasher.Write([]byte(salt + strconv.Itoa(number)))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func (captcha *Altcha) sign(newHash func() hash.Hash, challenge string) string {
+	signer := hmac.New(newHash, captcha.key)
+	signer.Write([]byte(challenge))
+	return hex.EncodeToString(signer.Sum(nil))
+}
+
+// NewChallenge makes a challenge for the client at ip, harder when it or everyone asks for a lot of them
+func (captcha *Altcha) NewChallenge(ip string) AltchaChallenge {
+	newHash, _ := altchaHash(captcha.algorithm)
+	salt := randomHex(captcha.saltLength) + "?expires=" + strconv.FormatInt(captcha.now().Add(captcha.ttl).Unix(), 10)
+	maxNumber := captcha.difficulty(ip)
+	number, _ := rand.Int(rand.Reader, big.NewInt(int64(maxNumber)+1))
+	challenge := hashSolution(newHash, salt, int(number.Int64()))
+
+	return AltchaChallenge{
+		Algorithm: captcha.algorithm,
+		Challenge: challenge,
+		MaxNumber: maxNumber,
+		Salt:      salt,
+		Signature: captcha.sign(newHash, challenge),
+	}
+}
+
+// DelayedSolution solves a challenge for a visitor without JavaScript, who can not do the work. The solution
+// only verifies after delay, the notbefore in its salt, so the visitor proves patience instead: a script pays
+// in waiting what the widget pays in work. The ttl starts once the solution is valid. It skips the work and the
+// adaptive difficulty altogether, so the signup page only hands out a few per client.
+func (captcha *Altcha) DelayedSolution(delay time.Duration) string {
+	newHash, _ := altchaHash(captcha.algorithm)
+	notBefore := captcha.now().Add(delay)
+	salt := randomHex(captcha.saltLength) + "?expires=" + strconv.FormatInt(notBefore.Add(captcha.ttl).Unix(), 10) +
+		"&notbefore=" + strconv.FormatInt(notBefore.Unix(), 10)
+	number, _ := rand.Int(rand.Reader, big.NewInt(int64(captcha.maxNumber)+1))
+	challenge := hashSolution(newHash, salt, int(number.Int64()))
+	CAPTCHA_CHALLENGES.WithLabelValues("delayed").Inc()
+
+	return altcha.Message{
+		Algorithm: captcha.algorithm,
+		Salt:      salt,
+		Number:    int(number.Int64()),
+		Challenge: challenge,
+		Signature: captcha.sign(newHash, challenge),
+	}.EncodeWithBase64()
+}
+
+// difficulty counts the challenge and returns the maximum number for it
+func (captcha *Altcha) difficulty(ip string) int {
+	adaptive := captcha.adaptive
+	if adaptive.Window <= 0 || adaptive.MaxNumber <= captcha.maxNumber {
+		CAPTCHA_CHALLENGES.WithLabelValues("base").Inc()
+		CAPTCHA_DIFFICULTY.Observe(float64(captcha.maxNumber))
+		return captcha.maxNumber
+	}
+
+	perIP, global := captcha.volume.count(ip, adaptive.Window, captcha.now())
+	doublings, reason := 0, "base"
+	if adaptive.PerIP > 0 && (perIP-1)/adaptive.PerIP > doublings {
+		doublings, reason = (perIP-1)/adaptive.PerIP, "ip"
+	}
+	if adaptive.Global > 0 && (global-1)/adaptive.Global > doublings {
+		doublings, reason = (global-1)/adaptive.Global, "global"
+	}
+
+	maxNumber := captcha.maxNumber
+	for ; doublings > 0 && maxNumber < adaptive.MaxNumber; doublings-- {
+		maxNumber *= 2
+	}
+	maxNumber = min(maxNumber, adaptive.MaxNumber)
+	CAPTCHA_CHALLENGES.WithLabelValues(reason).Inc()
+	CAPTCHA_DIFFICULTY.Observe(float64(maxNumber))
+	return maxNumber
+}
+
+// challengeVolume counts the challenges handed out per client and in total, in fixed windows
+type challengeVolume struct {
+	mutex   sync.Mutex
+	clients map[string]int
+	total   int
+	ends    time.Time
+}
+
+func newChallengeVolume() *challengeVolume {
+	return &challengeVolume{clients: map[string]int{}}
+}
+
+func (volume *challengeVolume) count(ip string, window time.Duration, now time.Time) (perIP, total int) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+
+	if !now.Before(volume.ends) {
+		volume.clients, volume.total, volume.ends = map[string]int{}, 0, now.Add(window)
+	}
+	volume.clients[ip]++
+	volume.total++
+	return volume.clients[ip], volume.total
+}
+
+// Verify checks a solved challenge from the widget (base64 encoded JSON) and spends it, so it can not be
+// submitted a second time
+func (captcha *Altcha) Verify(payload string) error {
+	response, err := altcha.DecodeResponse(payload)
+	if err != nil {
+		return ErrCaptchaMalformed
+	}
+	newHash, supported := altchaHash(response.Algorithm)
+	if !supported {
+		return ErrCaptchaMalformed
+	}
+
+	expires, notBefore, err := saltValidity(response.Salt)
+	if err != nil {
+		return err
+	}
+	if !captcha.now().Before(expires) {
+		return ErrCaptchaExpired
+	}
+	if captcha.now().Before(notBefore) {
+		return ErrCaptchaTooEarly
+	}
+	// a challenge is used at the earliest when it is handed out, or when its delay ends
+	issued := expires.Add(-captcha.ttl)
+	if notBefore.After(issued) {
+		issued = notBefore
+	}
+	if issued.Before(captcha.startedAt.Truncate(time.Second)) {
+		return ErrCaptchaExpired
+	}
+
+	if hashSolution(newHash, response.Salt, response.Number) != response.Challenge {
+		return ErrCaptchaInvalid
+	}
+	if !hmac.Equal([]byte(captcha.sign(newHash, response.Challenge)), []byte(response.Signature)) {
+		return ErrCaptchaInvalid
+	}
+
+	if first, _ := captcha.spent.Spend(context.Background(), response.Challenge, expires, captcha.now()); !first {
+		return ErrCaptchaReplayed
+	}
+	return nil
+}
+
+// saltValidity reads the expires and the optional notbefore parameter from a salt like
+// 9b1d…?expires=1767225600&notbefore=1767223800
+func saltValidity(salt string) (expires, notBefore time.Time, err error) {
+	_, query, found := strings.Cut(salt, "?")
+	if !found {
+		return time.Time{}, time.Time{}, fmt.Errorf("%w: salt without expiry", ErrCaptchaMalformed)
+	}
+	parameters, err := url.ParseQuery(query)
+	if err != nil {
+		return time.Time{}, time.Time{}, ErrCaptchaMalformed
+	}
+	expiresUnix, err := strconv.ParseInt(parameters.Get("expires"), 10, 64)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("%w: salt without expiry", ErrCaptchaMalformed)
+	}
+	if parameters.Has("notbefore") {
+		notBeforeUnix, err := strconv.ParseInt(parameters.Get("notbefore"), 10, 64)
+		if err != nil {
+			return time.Time{}, time.Time{}, ErrCaptchaMalformed
+		}
+		notBefore = time.Unix(notBeforeUnix, 0)
+	}
+	return time.Unix(expiresUnix, 0), notBefore, nil
+}
+
+// ChallengeLedger remembers used challenges until they expire, after that the expiry check rejects them anyway
+type ChallengeLedger interface {
+	// Spend marks the challenge as used and tells whether this was the first time
+	Spend(ctx context.Context, challenge string, expires time.Time, now time.Time) (bool, error)
+}
+
+// SpentChallenges is the ledger of a single instance, kept in memory
+type SpentChallenges struct {
+	mutex      sync.Mutex
+	challenges map[string]time.Time
+	swept      time.Time
+}
+
+func newSpentChallenges() *SpentChallenges {
+	return &SpentChallenges{challenges: map[string]time.Time{}}
+}
+
+func (spent *SpentChallenges) Spend(ctx context.Context, challenge string, expires time.Time, now time.Time) (bool, error) {
+	spent.mutex.Lock()
+	defer spent.mutex.Unlock()
+
+	if now.Sub(spent.swept) > time.Minute {
+		spent.swept = now
+		for key, until := range spent.challenges {
+			if !now.Before(until) {
+				delete(spent.challenges, key)
+			}
+		}
+	}
+
+	if until, used := spent.challenges[challenge]; used && now.Before(until) {
+		return false, nil
+	}
+	spent.challenges[challenge] = expires
+	return true, nil
+}
+
+const redisChallengePrefix = "backend:altcha:"
+
+// redisChallengeLedger shares the spent challenges between instances and keeps them over a restart. When
+// Redis can not be reached it falls back to memory: a broken Redis must not take the signup form down, and
+// this instance still refuses the challenges it saw itself.
+type redisChallengeLedger struct {
+	client   *redis.Client
+	fallback *SpentChallenges
+}
+
+func (ledger *redisChallengeLedger) Spend(ctx context.Context, challenge string, expires time.Time, now time.Time) (bool, error) {
+	first, err := ledger.client.SetNX(ctx, redisChallengePrefix+challenge, 1, expires.Sub(now)).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "Captcha ledger unavailable, only checking this instance", "error", err)
+		return ledger.fallback.Spend(ctx, challenge, expires, now)
+	}
+	// remembered here too, for when Redis goes away before the challenge expires
+	local, _ := ledger.fallback.Spend(ctx, challenge, expires, now)
+	return first && local, nil
+}
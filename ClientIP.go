@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the headers proxies use to pass on the address of the client
+const (
+	headerForwarded     = "Forwarded"
+	headerXForwardedFor = "X-Forwarded-For"
+	headerXRealIP       = "X-Real-IP"
+)
+
+// trustUnixSocket in TRUSTED_PROXIES trusts the proxy on the other end of the Unix socket we listen on
+const trustUnixSocket = "unix"
+
+// ProxyTrust finds the address of the client behind the reverse proxies we trust. Their header is only
+// believed as far as the chain of proxies is trusted: anyone can send an X-Forwarded-For header, so the
+// client is the first address from the right that is not one of our proxies.
+type ProxyTrust struct {
+	proxies    []netip.Prefix
+	unixSocket bool
+	// header is the one header our proxy sets or appends to. Any other one is passed on as the client sent
+	// it, so it is never read: with Traefik a client could otherwise pick its address with Forwarded.
+	header string
+}
+
+const clientIPKey = "client_ip"
+
+// newProxyTrust parses the addresses and CIDR ranges of the trusted proxies and the header they pass the client in
+func newProxyTrust(proxies []string, header string) (*ProxyTrust, error) {
+	trust := &ProxyTrust{}
+	for _, proxy := range proxies {
+		if proxy == trustUnixSocket {
+			trust.unixSocket = true
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			address, addressErr := netip.ParseAddr(proxy)
+			if addressErr != nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not an address, a CIDR range or unix", proxy)
+			}
+			prefix = netip.PrefixFrom(address.Unmap(), address.Unmap().BitLen())
+		}
+		trust.proxies = append(trust.proxies, prefix.Masked())
+	}
+	switch http.CanonicalHeaderKey(strings.TrimSpace(header)) {
+	case headerForwarded, headerXForwardedFor, http.CanonicalHeaderKey(headerXRealIP):
+		trust.header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+	default:
+		return nil, fmt.Errorf("CLIENT_IP_HEADER: %q is not one of Forwarded, X-Forwarded-For or X-Real-IP", header)
+	}
+	return trust, nil
+}
+
+func (trust *ProxyTrust) trusts(address netip.Addr) bool {
+	for _, prefix := range trust.proxies {
+		if prefix.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the address of the client that made the request, or of the first proxy that can not be trusted
+func (trust *ProxyTrust) resolve(request *http.Request) string {
+	peer, ok := parseAddress(request.RemoteAddr)
+	if !ok {
+		// not an IP address, so a connection on our Unix socket
+		if !trust.unixSocket {
+			return ""
+		}
+	} else if !trust.trusts(peer) {
+		return peer.String()
+	}
+
+	if chain := forwardedChain(request.Header, trust.header); len(chain) > 0 {
+		client := peer
+		for i := len(chain) - 1; i >= 0; i-- {
+			address, ok := parseAddress(chain[i])
+			if !ok {
+				// an obfuscated or unknown hop, the proxy after it is the best we know
+				break
+			}
+			client = address
+			if !trust.trusts(address) {
+				break
+			}
+		}
+		if !client.IsValid() {
+			return ""
+		}
+		return client.String()
+	}
+	if !peer.IsValid() {
+		return ""
+	}
+	return peer.String()
+}
+
+// forwardedChain returns the addresses in the header, from the client to the proxy closest to us
+func forwardedChain(header http.Header, name string) []string {
+	var chain []string
+	for _, value := range header.Values(name) {
+		for _, element := range strings.Split(value, ",") {
+			element = strings.TrimSpace(element)
+			if name == headerForwarded {
+				element = forwardedFor(element)
+			}
+			if element != "" || name == headerForwarded {
+				chain = append(chain, element)
+			}
+		}
+	}
+	if name == http.CanonicalHeaderKey(headerXRealIP) && len(chain) > 1 {
+		// X-Real-IP holds a single address, a proxy that appends to it is not one we know
+		return chain[len(chain)-1:]
+	}
+	return chain
+}
+
+// forwardedFor returns the for parameter of an element of an RFC 7239 Forwarded header, like
+// for="[2001:db8::1]:4711";proto=https
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if found && strings.EqualFold(key, "for") {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// parseAddress reads an IP address that may come with a port, like 192.0.2.1:4711 or [2001:db8::1]:4711
+func parseAddress(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	address, err := netip.ParseAddr(strings.Trim(value, "[]"))
+	if err != nil || address.Zone() != "" {
+		return netip.Addr{}, false
+	}
+	return address.Unmap(), true
+}
+
+// resolveClientIP stores the address of the client for clientIP. Gin's own ClientIP keeps returning the
+// address of the connection, we do not let gin trust any proxy.
+func (trust *ProxyTrust) resolveClientIP(context *gin.Context) {
+	context.Set(clientIPKey, trust.resolve(context.Request))
+	context.Next()
+}
+
+// clientIP is the address of the client, as far as the trusted proxies in front of us tell
+func clientIP(context *gin.Context) string {
+	if ip, exists := context.Get(clientIPKey); exists {
+		return ip.(string)
+	}
+	return context.ClientIP()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+const commandUsage = `usage:
+  backend                                    run the server
+  backend gdpr export [-format csv] <email>  print everything stored about an email address
+  backend gdpr erase [-anonymize] <email>    delete (or anonymize) everything stored about an email address
+  backend gdpr subject <email>               print how the audit trail identifies an email address
+  backend purge [-dry-run]                   remove the signups past their retention period
+  backend generate-key                       print a new key for ENCRYPTION_KEYS
+  backend rotate-keys                        re-encrypt every signup with the ENCRYPTION_KEY_ID key`
+
+// runCommand runs the admin command in args and writes its output to out
+func runCommand(args []string, out io.Writer) error {
+	if len(args) >= 1 {
+		switch args[0] {
+		case "purge":
+			return runPurge(args[1:], out)
+		case "generate-key":
+			_, err := fmt.Fprintln(out, generateKey())
+			return err
+		case "rotate-keys":
+			rotated, err := SIGNUP_STORE.RotateKeys()
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(out, "re-encrypted %d signup(s) with key %s\n", rotated, CONFIG.EncryptionKeyID)
+			return err
+		}
+	}
+	if len(args) >= 2 && args[0] == "gdpr" {
+		switch args[1] {
+		case "export":
+			return runGDPRExport(args[2:], out)
+		case "erase":
+			return runGDPRErase(args[2:], out)
+		case "subject":
+			flags := flag.NewFlagSet("gdpr subject", flag.ContinueOnError)
+			if err := flags.Parse(args[2:]); err != nil {
+				return err
+			}
+			email, err := emailArgument(flags)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(out, AUDIT_LOG.Subject(email))
+			return err
+		}
+	}
+	return errors.New(commandUsage)
+}
+
+func runGDPRExport(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("gdpr export", flag.ContinueOnError)
+	format := flags.String("format", "json", "json or csv")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	email, err := emailArgument(flags)
+	if err != nil {
+		return err
+	}
+
+	export, err := exportMemberData(email)
+	if err != nil {
+		return err
+	}
+	err = AUDIT_LOG.Record(AuditEntry{Action: auditExport, Subject: AUDIT_LOG.Subject(email), Actor: "cli", Records: len(export.Signups), Details: *format})
+	if err != nil {
+		return err
+	}
+
+	if *format == "csv" {
+		return writeExportCSV(out, export)
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+func runGDPRErase(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("gdpr erase", flag.ContinueOnError)
+	anonymize := flags.Bool("anonymize", false, "keep the non-identifying fields for statistics")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	email, err := emailArgument(flags)
+	if err != nil {
+		return err
+	}
+
+	// setupLogging only runs for the server, the command opens the logfile itself to scrub it
+	if LOGFILE == nil && CONFIG.LogFile != "off" {
+		file, err := openRotatingFile(CONFIG.LogFile, 0, 0, 0, 0)
+		if err != nil {
+			return fmt.Errorf("could not open %s to scrub it: %w", CONFIG.LogFile, err)
+		}
+		defer file.Close()
+		LOGFILE = file
+		defer func() { LOGFILE = nil }()
+	}
+
+	result, eraseErr := eraseMemberData(email, *anonymize)
+	action := auditErase
+	if *anonymize {
+		action = auditAnonymize
+	}
+	details := ""
+	if eraseErr != nil {
+		details = "failed: " + eraseErr.Error()
+	}
+	err = AUDIT_LOG.Record(AuditEntry{Action: action, Subject: AUDIT_LOG.Subject(email), Actor: "cli", Records: result.Signups, Details: details})
+	if err := errors.Join(eraseErr, err); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "erased %d signup(s), scrubbed %d logfile(s)\n", result.Signups, result.LogFiles)
+	return err
+}
+
+func runPurge(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be removed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := purgeExpiredSignups(retentionPolicyFromConfig(CONFIG), *dryRun, "cli")
+	if err != nil {
+		return err
+	}
+
+	verb := "purged"
+	if report.DryRun {
+		verb = "would purge"
+	}
+	for _, signup := range report.Signups {
+		fmt.Fprintf(out, "%s %s (%s since %s, %s)\n", verb, signup.ID, signup.Status, signup.UpdatedAt.Format("2006-01-02"), report.Mode)
+	}
+	_, err = fmt.Fprintf(out, "%s %d signup(s)\n", verb, len(report.Signups))
+	return err
+}
+
+func emailArgument(flags *flag.FlagSet) (string, error) {
+	if flags.NArg() != 1 {
+		return "", errors.New(commandUsage)
+	}
+	email := flags.Arg(0)
+	return email, validateEmail(email)
+}
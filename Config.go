@@ -0,0 +1,561 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings that can be tuned through environment variables (or the .env file).
+// Every setting has a default, so the server and the tests run without any of them set.
+type Config struct {
+	// ListenAddress is either a TCP address (":3000") or a Unix socket ("unix:/run/backend.sock")
+	ListenAddress     string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+	MaxHeaderBytes    int
+	MaxBodyBytes      int64
+	SMTPHost          string
+	SMTPPort          int
+	// ReadinessTimeout bounds every dependency check done by /readyz
+	ReadinessTimeout time.Duration
+	// MetricsToken protects /metrics with a bearer token when it is set
+	MetricsToken string
+	LogLevel     string
+	LogFormat    string
+	// LogFile is "off" to only log to stdout
+	LogFile           string
+	LogRotateSize     int64
+	LogRotateInterval time.Duration
+	LogKeepFiles      int
+	LogKeepFor        time.Duration
+	// LogRedaction is mask, full or off, see Redact.go
+	LogRedaction string
+	// LogRedactKeys are extra attribute keys whose values never end up in the logs
+	LogRedactKeys []string
+	StorePath     string
+	AuditLogPath  string
+	// AuditSubjectKey keys the HMAC that identifies members in the audit trail, a random key is used while it is empty
+	AuditSubjectKey string
+	// AdminToken enables the admin API under /api/admin, it stays disabled while this is empty
+	AdminToken string
+	// how long a signup is kept after its last status change, 0 keeps it forever
+	RetainReceived  time.Duration
+	RetainProcessed time.Duration
+	RetainRejected  time.Duration
+	RetainAbandoned time.Duration
+	// PurgeMode is delete or anonymize
+	PurgeMode     string
+	PurgeInterval time.Duration
+	// PurgeDryRun makes the scheduled purge only log what it would remove
+	PurgeDryRun bool
+	// EncryptionKeys are id:base64 pairs, EncryptionKeyID names the one new data is encrypted with
+	EncryptionKeys  []string
+	EncryptionKeyID string
+	// AttachmentEncryption is none, openpgp or zip, for the CSV mailed to the secretary
+	AttachmentEncryption string
+	// AttachmentPGPKeys are files with the armored public keys of the recipients
+	AttachmentPGPKeys []string
+	// AttachmentPasswordFile holds the password of the ZIP file
+	AttachmentPasswordFile string
+	// DKIM signing, with the private key of the TXT record <selector>._domainkey.<domain>
+	DKIMDomain   string
+	DKIMSelector string
+	DKIMKeyFile  string
+	// DKIMMessages and SMIMEMessages are the message types that get signed, member_info and/or confirmation
+	DKIMMessages []string
+	// S/MIME signing with a certificate and key in PEM files
+	SMIMECertFile string
+	SMIMEKeyFile  string
+	SMIMEMessages []string
+	// RateLimitPerIP and RateLimitGlobal guard the public endpoints, written as 30/1m in the environment
+	RateLimitPerIP  Limit
+	RateLimitGlobal Limit
+	// ValidateRateLimitPerIP guards /api/validate, which the form calls while the fields are filled in
+	ValidateRateLimitPerIP Limit
+	// a client that fails the captcha or validation BanAfterFailures times within BanWindow is banned for BanDuration
+	BanAfterFailures int
+	BanWindow        time.Duration
+	BanDuration      time.Duration
+	// RateLimitRedisURL shares the limits and spent captcha challenges between instances, they are kept in memory while it is empty
+	RateLimitRedisURL string
+	// AltchaHMACKey signs the captcha challenges, a random key is used while it is empty
+	AltchaHMACKey string
+	// AltchaChallengeTTL is how long a challenge can be solved and submitted
+	AltchaChallengeTTL time.Duration
+	// AltchaAlgorithm is SHA-256, SHA-384 or SHA-512
+	AltchaAlgorithm string
+	// AltchaMaxNumber is the largest solution of a challenge, the work a client does at most
+	AltchaMaxNumber int
+	// AltchaSaltLength is the number of random bytes in the salt
+	AltchaSaltLength int
+	AltchaAdaptive   AdaptiveDifficulty
+	// FormTokenKey signs the form tokens of /api/form-token, a random key is used while it is empty
+	FormTokenKey string
+	// signups that come in sooner than FormMinFillTime after the form was shown are taken for bots
+	FormMinFillTime time.Duration
+	FormTokenMaxAge time.Duration
+	// FormTokenRequired rejects signups without a form token, otherwise a bot skips the timing check by leaving
+	// it out. It is off until the frontend that sends one is deployed, the current one would get every signup refused.
+	FormTokenRequired bool
+	// CORS is the policy for the public endpoints, AdminCORS the one for /api/admin
+	CORS      CORSPolicy
+	AdminCORS CORSPolicy
+	// TrustedProxies are the addresses or CIDR ranges of the reverse proxies in front of us, unix for the one
+	// on our Unix socket. ClientIPHeader is the one header they pass the client address in, and that they
+	// overwrite or append to: a header the proxy passes on unchanged lets clients pick their own address.
+	TrustedProxies  []string
+	ClientIPHeader  string
+	SecurityHeaders SecurityHeaders
+	// AdminSessionTTL is how long the cookie of an admin that logged in lasts
+	AdminSessionTTL time.Duration
+	// TLSCertFile and TLSKeyFile make the server speak HTTPS, the files are reloaded when they change
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSMinVersion is 1.2 or 1.3
+	TLSMinVersion string
+	// TLSCipherSuites are Go names of the TLS 1.2 suites to offer, empty for Go's defaults
+	TLSCipherSuites []string
+	// HTTPRedirectAddress is where plain HTTP requests are redirected to HTTPS, empty for no redirect listener
+	HTTPRedirectAddress string
+	// AdminClientCAFile makes the admin API require a client certificate signed by one of its CAs
+	AdminClientCAFile string
+	// IdempotencyWindow is how long the response to a processed signup is replayed for repeated submissions
+	IdempotencyWindow time.Duration
+	// SignupSuccessURL and SignupErrorURL are where plain HTML forms are sent after a signup
+	SignupSuccessURL string
+	SignupErrorURL   string
+	// AltchaWidgetURL is the script of the captcha widget on the signup page at /aanmelden, and
+	// AltchaWidgetIntegrity its subresource integrity hash, which a widget from another host must have
+	AltchaWidgetURL       string
+	AltchaWidgetIntegrity string
+	// CaptchaFallbackDelay is how long browsers without JavaScript wait for a valid captcha, 0 leaves them out
+	CaptchaFallbackDelay time.Duration
+	// CaptchaFallbackPerIP is how many of those captchas one client gets
+	CaptchaFallbackPerIP Limit
+}
+
+const day = 24 * time.Hour
+
+// CONFIG is replaced by main with the values from the environment, tests use the defaults
+var CONFIG = defaultConfig()
+
+func defaultConfig() Config {
+	cors := CORSPolicy{
+		Origins: []string{"https://beta.svpromptusimperii.nl", "https://svpromptusimperii.nl"},
+		Methods: []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete},
+		Headers: []string{"Content-Type", "Authorization", requestIDHeader, csrfHeader, idempotencyKeyHeader},
+		MaxAge:  12 * time.Hour,
+	}
+	return Config{
+		ListenAddress:     ":3000",
+		ReadTimeout:       15 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		// signups wait for openiban and two mails, so leave them some room
+		WriteTimeout: 60 * time.Second,
+		IdleTimeout:  120 * time.Second,
+		// as long as WriteTimeout, so a signup that is still running at shutdown can finish
+		ShutdownTimeout: 60 * time.Second,
+		MaxHeaderBytes:  16 << 10,
+		MaxBodyBytes:    64 << 10,
+		SMTPHost:        "smtp.office365.com",
+		SMTPPort:        587,
+		// stays below the default probe timeout of Coolify and most monitors
+		ReadinessTimeout:  3 * time.Second,
+		LogLevel:          "info",
+		LogFormat:         "json",
+		LogFile:           "logfile",
+		LogRotateSize:     10 << 20,
+		LogRotateInterval: 24 * time.Hour,
+		LogKeepFiles:      14,
+		LogKeepFor:        30 * 24 * time.Hour,
+		LogRedaction:      redactMask,
+		StorePath:         "signups.json",
+		AuditLogPath:      "audit.jsonl",
+		// a signup nobody looked at for half a year was forgotten
+		RetainReceived:  180 * day,
+		RetainProcessed: 90 * day,
+		RetainRejected:  30 * day,
+		RetainAbandoned: 30 * day,
+		// received signups were never handled, keeping what is needed for the statistics is the safer default
+		PurgeMode:            purgeAnonymize,
+		PurgeInterval:        24 * time.Hour,
+		AttachmentEncryption: attachmentPlain,
+		DKIMMessages:         []string{emailMemberInfo, emailConfirmation},
+		// the confirmation is the mail members receive, the secretary does not need to check our signature
+		SMIMEMessages: []string{emailConfirmation},
+		// a signup takes a challenge and a submit, and people retry when validation fails
+		RateLimitPerIP:  Limit{Burst: 30, Per: time.Minute},
+		RateLimitGlobal: Limit{Burst: 600, Per: time.Minute},
+		// a check every time a field loses focus, and some fields are corrected a few times
+		ValidateRateLimitPerIP: Limit{Burst: 120, Per: time.Minute},
+		BanAfterFailures:       20,
+		BanWindow:              10 * time.Minute,
+		BanDuration:            time.Hour,
+		// the widget solves the challenge when the form is opened, filling it in takes a while
+		AltchaChallengeTTL: 30 * time.Minute,
+		AltchaAlgorithm:    "SHA-256",
+		AltchaMaxNumber:    100000,
+		AltchaSaltLength:   12,
+		// a visitor fetches a handful of challenges, an office behind one address a few dozen
+		AltchaAdaptive: AdaptiveDifficulty{Window: 10 * time.Minute, PerIP: 10, Global: 300, MaxNumber: 5000000},
+		// nobody types a name, address, IBAN and emergency contact in three seconds, autofill included
+		FormMinFillTime: 3 * time.Second,
+		FormTokenMaxAge: 24 * time.Hour,
+		CORS:            cors,
+		AdminCORS:       cors,
+		ClientIPHeader:  headerXForwardedFor,
+		SecurityHeaders: SecurityHeaders{
+			HSTSMaxAge:            365 * day,
+			HSTSIncludeSubdomains: true,
+			// the API only answers with JSON, nothing in it should load or run
+			ContentSecurityPolicy: "default-src 'none'; frame-ancestors 'none'",
+			ReferrerPolicy:        "no-referrer",
+			PermissionsPolicy:     "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+		},
+		AdminSessionTTL: 8 * time.Hour,
+		TLSMinVersion:   "1.2",
+		// long enough for a retry the next morning, after the laptop was closed mid-submit
+		IdempotencyWindow: 24 * time.Hour,
+		SignupSuccessURL:  "https://svpromptusimperii.nl/aanmelden/bedankt",
+		SignupErrorURL:    "https://svpromptusimperii.nl/aanmelden/mislukt",
+		AltchaWidgetURL:   bundledAltchaWidget,
+		// off: the fallback skips the proof of work, a script only has to wait for it
+		CaptchaFallbackDelay: 0,
+		// opening the page and correcting a few mistakes
+		CaptchaFallbackPerIP: Limit{Burst: 5, Per: time.Hour},
+	}
+}
+
+// loadConfig starts from the defaults and overrides every setting that is present in the environment.
+// All malformed values are reported at once, so a broken .env file can be fixed in one go.
+func loadConfig() (Config, error) {
+	config := defaultConfig()
+	env := envReader{}
+
+	config.ListenAddress = env.string("LISTEN_ADDRESS", config.ListenAddress)
+	config.ReadTimeout = env.duration("HTTP_READ_TIMEOUT", config.ReadTimeout)
+	config.ReadHeaderTimeout = env.duration("HTTP_READ_HEADER_TIMEOUT", config.ReadHeaderTimeout)
+	config.WriteTimeout = env.duration("HTTP_WRITE_TIMEOUT", config.WriteTimeout)
+	config.IdleTimeout = env.duration("HTTP_IDLE_TIMEOUT", config.IdleTimeout)
+	config.ShutdownTimeout = env.duration("SHUTDOWN_TIMEOUT", config.ShutdownTimeout)
+	config.MaxHeaderBytes = env.int("HTTP_MAX_HEADER_BYTES", config.MaxHeaderBytes)
+	config.MaxBodyBytes = int64(env.int("HTTP_MAX_BODY_BYTES", int(config.MaxBodyBytes)))
+	config.SMTPHost = env.string("SMTP_HOST", config.SMTPHost)
+	config.SMTPPort = env.int("SMTP_PORT", config.SMTPPort)
+	config.ReadinessTimeout = env.duration("READINESS_TIMEOUT", config.ReadinessTimeout)
+	config.MetricsToken = env.string("METRICS_TOKEN", config.MetricsToken)
+	config.LogLevel = env.string("LOG_LEVEL", config.LogLevel)
+	config.LogFormat = env.string("LOG_FORMAT", config.LogFormat)
+	config.LogFile = env.string("LOG_FILE", config.LogFile)
+	config.LogRotateSize = int64(env.int("LOG_ROTATE_SIZE", int(config.LogRotateSize)))
+	config.LogRotateInterval = env.duration("LOG_ROTATE_INTERVAL", config.LogRotateInterval)
+	config.LogKeepFiles = env.int("LOG_KEEP_FILES", config.LogKeepFiles)
+	config.LogKeepFor = env.duration("LOG_KEEP_FOR", config.LogKeepFor)
+	config.LogRedaction = env.string("LOG_REDACTION", config.LogRedaction)
+	config.LogRedactKeys = env.list("LOG_REDACT_KEYS", config.LogRedactKeys)
+	config.StorePath = env.string("STORE_PATH", config.StorePath)
+	config.AuditLogPath = env.string("AUDIT_LOG_PATH", config.AuditLogPath)
+	config.AuditSubjectKey = env.string("AUDIT_SUBJECT_KEY", config.AuditSubjectKey)
+	config.AdminToken = env.string("ADMIN_TOKEN", config.AdminToken)
+	config.RetainReceived = env.duration("RETAIN_RECEIVED", config.RetainReceived)
+	config.RetainProcessed = env.duration("RETAIN_PROCESSED", config.RetainProcessed)
+	config.RetainRejected = env.duration("RETAIN_REJECTED", config.RetainRejected)
+	config.RetainAbandoned = env.duration("RETAIN_ABANDONED", config.RetainAbandoned)
+	config.PurgeMode = env.string("PURGE_MODE", config.PurgeMode)
+	config.PurgeInterval = env.duration("PURGE_INTERVAL", config.PurgeInterval)
+	config.PurgeDryRun = env.bool("PURGE_DRY_RUN", config.PurgeDryRun)
+	config.EncryptionKeys = env.list("ENCRYPTION_KEYS", config.EncryptionKeys)
+	config.EncryptionKeyID = env.string("ENCRYPTION_KEY_ID", config.EncryptionKeyID)
+	config.AttachmentEncryption = env.string("ATTACHMENT_ENCRYPTION", config.AttachmentEncryption)
+	config.AttachmentPGPKeys = env.list("ATTACHMENT_PGP_KEYS", config.AttachmentPGPKeys)
+	config.AttachmentPasswordFile = env.string("ATTACHMENT_PASSWORD_FILE", config.AttachmentPasswordFile)
+	config.DKIMDomain = env.string("DKIM_DOMAIN", config.DKIMDomain)
+	config.DKIMSelector = env.string("DKIM_SELECTOR", config.DKIMSelector)
+	config.DKIMKeyFile = env.string("DKIM_KEY_FILE", config.DKIMKeyFile)
+	config.DKIMMessages = env.list("DKIM_MESSAGES", config.DKIMMessages)
+	config.SMIMECertFile = env.string("SMIME_CERT_FILE", config.SMIMECertFile)
+	config.SMIMEKeyFile = env.string("SMIME_KEY_FILE", config.SMIMEKeyFile)
+	config.SMIMEMessages = env.list("SMIME_MESSAGES", config.SMIMEMessages)
+	config.RateLimitPerIP = env.limit("RATE_LIMIT_PER_IP", config.RateLimitPerIP)
+	config.RateLimitGlobal = env.limit("RATE_LIMIT_GLOBAL", config.RateLimitGlobal)
+	config.ValidateRateLimitPerIP = env.limit("VALIDATE_RATE_LIMIT_PER_IP", config.ValidateRateLimitPerIP)
+	config.BanAfterFailures = env.int("BAN_AFTER_FAILURES", config.BanAfterFailures)
+	config.BanWindow = env.duration("BAN_WINDOW", config.BanWindow)
+	config.BanDuration = env.duration("BAN_DURATION", config.BanDuration)
+	config.RateLimitRedisURL = env.string("RATE_LIMIT_REDIS_URL", config.RateLimitRedisURL)
+	config.AltchaHMACKey = env.string("ALTCHA_HMAC_KEY", config.AltchaHMACKey)
+	config.AltchaChallengeTTL = env.duration("ALTCHA_CHALLENGE_TTL", config.AltchaChallengeTTL)
+	config.AltchaAlgorithm = env.string("ALTCHA_ALGORITHM", config.AltchaAlgorithm)
+	config.AltchaMaxNumber = env.int("ALTCHA_MAX_NUMBER", config.AltchaMaxNumber)
+	config.AltchaSaltLength = env.int("ALTCHA_SALT_LENGTH", config.AltchaSaltLength)
+	config.AltchaAdaptive.Window = env.duration("ALTCHA_ADAPTIVE_WINDOW", config.AltchaAdaptive.Window)
+	config.AltchaAdaptive.PerIP = env.int("ALTCHA_ADAPTIVE_PER_IP", config.AltchaAdaptive.PerIP)
+	config.AltchaAdaptive.Global = env.int("ALTCHA_ADAPTIVE_GLOBAL", config.AltchaAdaptive.Global)
+	config.AltchaAdaptive.MaxNumber = env.int("ALTCHA_ADAPTIVE_MAX_NUMBER", config.AltchaAdaptive.MaxNumber)
+	config.FormTokenKey = env.string("FORM_TOKEN_KEY", config.FormTokenKey)
+	config.FormMinFillTime = env.duration("FORM_MIN_FILL_TIME", config.FormMinFillTime)
+	config.FormTokenMaxAge = env.duration("FORM_TOKEN_MAX_AGE", config.FormTokenMaxAge)
+	config.FormTokenRequired = env.bool("FORM_TOKEN_REQUIRED", config.FormTokenRequired)
+	config.CORS = env.cors("", config.CORS)
+	// the admin API follows the public policy, except for what is set for it
+	config.AdminCORS = env.cors("ADMIN_", config.CORS)
+	config.TrustedProxies = env.list("TRUSTED_PROXIES", config.TrustedProxies)
+	config.ClientIPHeader = env.string("CLIENT_IP_HEADER", config.ClientIPHeader)
+	config.SecurityHeaders.HSTSMaxAge = env.duration("HSTS_MAX_AGE", config.SecurityHeaders.HSTSMaxAge)
+	config.SecurityHeaders.HSTSIncludeSubdomains = env.bool("HSTS_INCLUDE_SUBDOMAINS", config.SecurityHeaders.HSTSIncludeSubdomains)
+	config.SecurityHeaders.HSTSPreload = env.bool("HSTS_PRELOAD", config.SecurityHeaders.HSTSPreload)
+	config.SecurityHeaders.ContentSecurityPolicy = env.string("CONTENT_SECURITY_POLICY", config.SecurityHeaders.ContentSecurityPolicy)
+	config.SecurityHeaders.ReferrerPolicy = env.string("REFERRER_POLICY", config.SecurityHeaders.ReferrerPolicy)
+	config.SecurityHeaders.PermissionsPolicy = env.string("PERMISSIONS_POLICY", config.SecurityHeaders.PermissionsPolicy)
+	config.AdminSessionTTL = env.duration("ADMIN_SESSION_TTL", config.AdminSessionTTL)
+	config.TLSCertFile = env.string("TLS_CERT_FILE", config.TLSCertFile)
+	config.TLSKeyFile = env.string("TLS_KEY_FILE", config.TLSKeyFile)
+	config.TLSMinVersion = env.string("TLS_MIN_VERSION", config.TLSMinVersion)
+	config.TLSCipherSuites = env.list("TLS_CIPHER_SUITES", config.TLSCipherSuites)
+	config.HTTPRedirectAddress = env.string("HTTP_REDIRECT_ADDRESS", config.HTTPRedirectAddress)
+	config.AdminClientCAFile = env.string("ADMIN_CLIENT_CA_FILE", config.AdminClientCAFile)
+	config.IdempotencyWindow = env.duration("IDEMPOTENCY_WINDOW", config.IdempotencyWindow)
+	config.SignupSuccessURL = env.string("SIGNUP_SUCCESS_URL", config.SignupSuccessURL)
+	config.SignupErrorURL = env.string("SIGNUP_ERROR_URL", config.SignupErrorURL)
+	config.AltchaWidgetURL = env.string("ALTCHA_WIDGET_URL", config.AltchaWidgetURL)
+	config.AltchaWidgetIntegrity = env.string("ALTCHA_WIDGET_INTEGRITY", config.AltchaWidgetIntegrity)
+	config.CaptchaFallbackDelay = env.duration("CAPTCHA_FALLBACK_DELAY", config.CaptchaFallbackDelay)
+	config.CaptchaFallbackPerIP = env.limit("CAPTCHA_FALLBACK_PER_IP", config.CaptchaFallbackPerIP)
+
+	if err := errors.Join(env.errs...); err != nil {
+		return config, err
+	}
+	return config, config.validate()
+}
+
+func (config Config) validate() error {
+	var errs []error
+	if config.ListenAddress == "" {
+		errs = append(errs, errors.New("LISTEN_ADDRESS must not be empty"))
+	}
+	// zero turns a server timeout off, a negative one would fail every request
+	timeouts := []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"HTTP_READ_TIMEOUT", config.ReadTimeout},
+		{"HTTP_READ_HEADER_TIMEOUT", config.ReadHeaderTimeout},
+		{"HTTP_WRITE_TIMEOUT", config.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", config.IdleTimeout},
+	}
+	for _, setting := range timeouts {
+		if setting.timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", setting.name))
+		}
+	}
+	if config.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("SHUTDOWN_TIMEOUT must be positive"))
+	}
+	if config.MaxHeaderBytes <= 0 {
+		errs = append(errs, errors.New("HTTP_MAX_HEADER_BYTES must be positive"))
+	}
+	if config.MaxBodyBytes <= 0 {
+		errs = append(errs, errors.New("HTTP_MAX_BODY_BYTES must be positive"))
+	}
+	if config.SMTPHost == "" {
+		errs = append(errs, errors.New("SMTP_HOST must not be empty"))
+	}
+	if config.SMTPPort <= 0 || config.SMTPPort > 65535 {
+		errs = append(errs, errors.New("SMTP_PORT must be a valid port number"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		errs = append(errs, errors.New("LOG_LEVEL must be debug, info, warn or error"))
+	}
+	if config.LogFormat != "json" && config.LogFormat != "text" {
+		errs = append(errs, errors.New("LOG_FORMAT must be json or text"))
+	}
+	if config.PurgeMode != purgeDelete && config.PurgeMode != purgeAnonymize {
+		errs = append(errs, errors.New("PURGE_MODE must be delete or anonymize"))
+	}
+	if config.LogRedaction != redactMask && config.LogRedaction != redactFull && config.LogRedaction != redactOff {
+		errs = append(errs, errors.New("LOG_REDACTION must be mask, full or off"))
+	}
+	if config.AttachmentEncryption != attachmentPlain && config.AttachmentEncryption != attachmentOpenPGP && config.AttachmentEncryption != attachmentZip {
+		errs = append(errs, errors.New("ATTACHMENT_ENCRYPTION must be none, openpgp or zip"))
+	}
+	if config.AuditSubjectKey != "" && len(config.AuditSubjectKey) < 32 {
+		errs = append(errs, errors.New("AUDIT_SUBJECT_KEY must be at least 32 characters"))
+	}
+	if config.AltchaHMACKey != "" && len(config.AltchaHMACKey) < 32 {
+		errs = append(errs, errors.New("ALTCHA_HMAC_KEY must be at least 32 characters"))
+	}
+	if config.AltchaChallengeTTL <= 0 {
+		errs = append(errs, errors.New("ALTCHA_CHALLENGE_TTL must be positive"))
+	}
+	if _, supported := altchaHash(config.AltchaAlgorithm); !supported {
+		errs = append(errs, errors.New("ALTCHA_ALGORITHM must be SHA-256, SHA-384 or SHA-512"))
+	}
+	if config.AltchaMaxNumber < 1000 {
+		errs = append(errs, errors.New("ALTCHA_MAX_NUMBER must be at least 1000"))
+	}
+	if config.AltchaSaltLength < 8 {
+		errs = append(errs, errors.New("ALTCHA_SALT_LENGTH must be at least 8 bytes"))
+	}
+	errs = append(errs, config.CORS.validate("")...)
+	errs = append(errs, config.AdminCORS.validate("ADMIN_")...)
+	// the requirements of https://hstspreload.org
+	if config.SecurityHeaders.HSTSPreload && (config.SecurityHeaders.HSTSMaxAge < 365*day || !config.SecurityHeaders.HSTSIncludeSubdomains) {
+		errs = append(errs, errors.New("HSTS_PRELOAD needs HSTS_MAX_AGE of at least 365d and HSTS_INCLUDE_SUBDOMAINS"))
+	}
+	if config.AdminSessionTTL <= 0 {
+		errs = append(errs, errors.New("ADMIN_SESSION_TTL must be positive"))
+	}
+	errs = append(errs, config.validateTLS()...)
+	if !urlOrPath(config.SignupSuccessURL) || !urlOrPath(config.SignupErrorURL) {
+		errs = append(errs, errors.New("SIGNUP_SUCCESS_URL and SIGNUP_ERROR_URL must be URLs or absolute paths"))
+	}
+	if !urlOrPath(config.AltchaWidgetURL) {
+		errs = append(errs, errors.New("ALTCHA_WIDGET_URL must be a URL or an absolute path"))
+	}
+	if widget, err := url.Parse(config.AltchaWidgetURL); err == nil && widget.Host != "" && config.AltchaWidgetIntegrity == "" {
+		errs = append(errs, errors.New("ALTCHA_WIDGET_INTEGRITY is required for a widget from another host"))
+	}
+	if config.AltchaWidgetIntegrity != "" && !validIntegrity(config.AltchaWidgetIntegrity) {
+		errs = append(errs, errors.New("ALTCHA_WIDGET_INTEGRITY must be like sha384-<base64 of the hash>"))
+	}
+	if config.CaptchaFallbackDelay < 0 {
+		errs = append(errs, errors.New("CAPTCHA_FALLBACK_DELAY must not be negative"))
+	}
+	if strings.Contains(config.ClientIPHeader, ",") {
+		errs = append(errs, errors.New("CLIENT_IP_HEADER must be a single header, the one the proxy overwrites"))
+	} else if _, err := newProxyTrust(config.TrustedProxies, config.ClientIPHeader); err != nil {
+		errs = append(errs, err)
+	}
+	for _, messageType := range append(slices.Clone(config.DKIMMessages), config.SMIMEMessages...) {
+		if messageType != emailMemberInfo && messageType != emailConfirmation {
+			errs = append(errs, fmt.Errorf("unknown message type %q in DKIM_MESSAGES or SMIME_MESSAGES, use member_info or confirmation", messageType))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// urlOrPath accepts the addresses a browser can follow from our pages: absolute URLs and paths on this host
+func urlOrPath(address string) bool {
+	parsed, err := url.Parse(address)
+	return err == nil && (parsed.Host != "" || strings.HasPrefix(parsed.Path, "/"))
+}
+
+// validIntegrity accepts a subresource integrity hash of one of the algorithms browsers check
+func validIntegrity(integrity string) bool {
+	algorithm, hash, found := strings.Cut(integrity, "-")
+	decoded, err := base64.StdEncoding.DecodeString(hash)
+	sizes := map[string]int{"sha256": sha256.Size, "sha384": sha512.Size384, "sha512": sha512.Size}
+	return found && err == nil && sizes[algorithm] > 0 && len(decoded) == sizes[algorithm]
+}
+
+// envReader reads typed environment variables and collects the ones that could not be parsed
+type envReader struct {
+	errs []error
+}
+
+func (env *envReader) string(key, fallback string) string {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	return value
+}
+
+// list reads a comma separated value, surrounding spaces and empty entries are dropped
+func (env *envReader) list(key string, fallback []string) []string {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+func (env *envReader) int(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		env.errs = append(env.errs, fmt.Errorf("%s: %q is not a whole number", key, value))
+		return fallback
+	}
+	return parsed
+}
+
+func (env *envReader) bool(key string, fallback bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		env.errs = append(env.errs, fmt.Errorf("%s: %q is not true or false", key, value))
+		return fallback
+	}
+	return parsed
+}
+
+func (env *envReader) limit(key string, fallback Limit) Limit {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	parsed, err := parseLimit(value)
+	if err != nil {
+		env.errs = append(env.errs, fmt.Errorf("%s: %w", key, err))
+		return fallback
+	}
+	return parsed
+}
+
+// cors reads the <prefix>CORS_* settings
+func (env *envReader) cors(prefix string, fallback CORSPolicy) CORSPolicy {
+	return CORSPolicy{
+		Origins:     env.list(prefix+"CORS_ORIGINS", fallback.Origins),
+		Methods:     env.list(prefix+"CORS_METHODS", fallback.Methods),
+		Headers:     env.list(prefix+"CORS_HEADERS", fallback.Headers),
+		Credentials: env.bool(prefix+"CORS_CREDENTIALS", fallback.Credentials),
+		MaxAge:      env.duration(prefix+"CORS_MAX_AGE", fallback.MaxAge),
+	}
+}
+
+// duration also accepts a number of days like 90d, which Go durations do not have
+func (env *envReader) duration(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	if days, isDays := strings.CutSuffix(value, "d"); isDays {
+		if parsed, err := strconv.Atoi(days); err == nil {
+			return time.Duration(parsed) * day
+		}
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		env.errs = append(env.errs, fmt.Errorf("%s: %q is not a duration like 30s, 5m or 90d", key, value))
+		return fallback
+	}
+	return parsed
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const encryptedFieldPrefix = "enc:v1:"
+
+// Envelope holds the data key of one signup, encrypted with the key encryption key KeyID
+type Envelope struct {
+	KeyID      string `json:"key_id"`
+	WrappedKey string `json:"wrapped_key"`
+}
+
+// FieldCipher encrypts the sensitive fields of signups with envelope encryption: every signup gets its own
+// random data key, which is stored next to it encrypted with the active key encryption key from the config.
+// Rotating the key encryption key only requires re-encrypting those small data keys, and old keys can be
+// kept around to read signups that have not been rotated yet.
+type FieldCipher struct {
+	keys     map[string][]byte
+	activeID string
+}
+
+// newFieldCipher parses keys in the form id:base64 (32 bytes, e.g. from `backend generate-key`).
+// Without keys it returns nil and signups are stored as they are.
+func newFieldCipher(keys []string, activeID string) (*FieldCipher, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	fieldCipher := &FieldCipher{keys: map[string][]byte{}, activeID: activeID}
+	for _, entry := range keys {
+		id, encoded, found := strings.Cut(entry, ":")
+		if !found || id == "" {
+			return nil, errors.New("ENCRYPTION_KEYS entries must look like id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS: key %s must be 32 bytes, base64 encoded", id)
+		}
+		fieldCipher.keys[id] = key
+	}
+	if _, exists := fieldCipher.keys[activeID]; !exists {
+		return nil, fmt.Errorf("ENCRYPTION_KEY_ID %q is not one of ENCRYPTION_KEYS", activeID)
+	}
+	return fieldCipher, nil
+}
+
+func generateKey() string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// sensitiveFields are the fields of a signup that are encrypted at rest, by json name
+func sensitiveFields(member *PISignUp) map[string]*string {
+	return map[string]*string{
+		"iban":                           &member.IBAN,
+		"date_of_birth":                  &member.DateOfBirth,
+		"phone":                          &member.Phone,
+		"emergency_contact_first_name":   &member.EmergencyContactFirstName,
+		"emergency_contact_infix":        &member.EmergencyContactInfix,
+		"emergency_contact_surname":      &member.EmergencyContactSurname,
+		"emergency_contact_phone_number": &member.EmergencyContactPhoneNumber,
+	}
+}
+
+// seal encrypts the sensitive fields of a signup with a fresh data key under the active key,
+// the fields have to be in plain text
+func (fieldCipher *FieldCipher) seal(signup *StoredSignup) error {
+	dataKey := make([]byte, 32)
+	rand.Read(dataKey)
+
+	wrapped, err := encrypt(fieldCipher.keys[fieldCipher.activeID], dataKey, []byte(signup.ID))
+	if err != nil {
+		return err
+	}
+
+	for name, field := range sensitiveFields(&signup.Member) {
+		if *field == "" {
+			continue
+		}
+		ciphertext, err := encrypt(dataKey, []byte(*field), fieldAAD(signup.ID, name))
+		if err != nil {
+			return err
+		}
+		*field = encryptedFieldPrefix + base64.StdEncoding.EncodeToString(ciphertext)
+	}
+	signup.Envelope = &Envelope{KeyID: fieldCipher.activeID, WrappedKey: base64.StdEncoding.EncodeToString(wrapped)}
+	return nil
+}
+
+// open decrypts the sensitive fields of a signup, fields that were stored before encryption pass unchanged
+func (fieldCipher *FieldCipher) open(signup *StoredSignup) error {
+	if signup.Envelope == nil {
+		return nil
+	}
+	if fieldCipher == nil {
+		return errors.New("signup is encrypted, but no ENCRYPTION_KEYS are configured")
+	}
+	key, exists := fieldCipher.keys[signup.Envelope.KeyID]
+	if !exists {
+		return fmt.Errorf("signup %s is encrypted with unknown key %q", signup.ID, signup.Envelope.KeyID)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(signup.Envelope.WrappedKey)
+	if err != nil {
+		return err
+	}
+	dataKey, err := decrypt(key, wrapped, []byte(signup.ID))
+	if err != nil {
+		return fmt.Errorf("signup %s: data key: %w", signup.ID, err)
+	}
+
+	for name, field := range sensitiveFields(&signup.Member) {
+		encoded, isEncrypted := strings.CutPrefix(*field, encryptedFieldPrefix)
+		if !isEncrypted {
+			continue
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		plaintext, err := decrypt(dataKey, ciphertext, fieldAAD(signup.ID, name))
+		if err != nil {
+			return fmt.Errorf("signup %s: %s: %w", signup.ID, name, err)
+		}
+		*field = string(plaintext)
+	}
+	signup.Envelope = nil
+	return nil
+}
+
+// needsRotation tells whether a signup is stored in plain text or under a key that is no longer active
+func (fieldCipher *FieldCipher) needsRotation(signup StoredSignup) bool {
+	return signup.Envelope == nil || signup.Envelope.KeyID != fieldCipher.activeID
+}
+
+// fieldAAD binds a ciphertext to its signup and field, so it can not be copied into another one
+func fieldAAD(id, field string) []byte {
+	return []byte(id + "/" + field)
+}
+
+// encrypt seals plaintext with AES-256-GCM, the random nonce is put in front of the ciphertext
+func encrypt(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func decrypt(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/unicode/norm"
+)
+
+// DecodeError tells the client what is wrong with the body of its request, and where
+type DecodeError struct {
+	Status int `json:"-"`
+	// Code is unsupported_media_type, too_large, empty, syntax, type, unknown_field or trailing_data
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+	// Offset is the position in the body where decoding failed
+	Offset int64 `json:"offset,omitempty"`
+}
+
+func (err *DecodeError) Error() string {
+	if err.Field != "" {
+		return fmt.Sprintf("%s: %s (%s)", err.Code, err.Message, err.Field)
+	}
+	return err.Code + ": " + err.Message
+}
+
+// decodeJSON reads the JSON body of the request into target, see decodeStrict. Bodies that are not
+// application/json are refused, and so are bodies over HTTP_MAX_BODY_BYTES.
+func decodeJSON(context *gin.Context, target any) *DecodeError {
+	mediaType, _, err := mime.ParseMediaType(context.GetHeader("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return &DecodeError{Status: http.StatusUnsupportedMediaType, Code: "unsupported_media_type", Message: "stuur de aanvraag als application/json"}
+	}
+	return decodeStrict(http.MaxBytesReader(context.Writer, context.Request.Body, CONFIG.MaxBodyBytes), target)
+}
+
+// decodeStrict decodes a single JSON value into target. Fields target does not have are refused rather than
+// ignored, so a renamed field in the frontend shows up at once instead of as an empty value. Every string
+// is trimmed and normalized to NFC, so the same name typed on two keyboards is stored the same.
+func decodeStrict(reader io.Reader, target any) *DecodeError {
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(target)
+	if err == nil && decoder.Decode(&struct{}{}) != io.EOF {
+		return &DecodeError{Status: http.StatusBadRequest, Code: "trailing_data", Message: "na de JSON staat nog meer", Offset: decoder.InputOffset()}
+	}
+	if err != nil {
+		return decodeFailure(err, decoder.InputOffset())
+	}
+	normalizeStrings(reflect.ValueOf(target))
+	return nil
+}
+
+func decodeFailure(err error, offset int64) *DecodeError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return &DecodeError{Status: http.StatusRequestEntityTooLarge, Code: "too_large", Message: fmt.Sprintf("de aanvraag is groter dan %d bytes", tooLarge.Limit)}
+	case errors.Is(err, io.EOF):
+		return &DecodeError{Status: http.StatusBadRequest, Code: "empty", Message: "de aanvraag is leeg"}
+	case errors.As(err, &syntaxErr):
+		return &DecodeError{Status: http.StatusBadRequest, Code: "syntax", Message: "de JSON is ongeldig: " + syntaxErr.Error(), Offset: syntaxErr.Offset}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &DecodeError{Status: http.StatusBadRequest, Code: "syntax", Message: "de JSON houdt halverwege op", Offset: offset}
+	case errors.As(err, &typeErr):
+		return &DecodeError{Status: http.StatusBadRequest, Code: "type", Message: fmt.Sprintf("verwacht een %s, kreeg een %s", typeErr.Type, typeErr.Value), Field: typeErr.Field, Offset: typeErr.Offset}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no type for this error
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return &DecodeError{Status: http.StatusBadRequest, Code: "unknown_field", Message: fmt.Sprintf("onbekend veld %q", field), Field: field, Offset: offset}
+	default:
+		return &DecodeError{Status: http.StatusBadRequest, Code: "syntax", Message: err.Error(), Offset: offset}
+	}
+}
+
+// normalizeStrings trims and NFC normalizes every string in the structs value points to
+func normalizeStrings(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !value.IsNil() {
+			normalizeStrings(value.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if value.Type().Field(i).IsExported() {
+				normalizeStrings(value.Field(i))
+			}
+		}
+	case reflect.String:
+		if value.CanSet() {
+			value.SetString(norm.NFC.String(strings.TrimSpace(value.String())))
+		}
+	}
+}
+
+// bindJSON decodes the body into target, or answers with what is wrong with it and returns false
+func bindJSON(context *gin.Context, target any) bool {
+	return respondToDecodeError(context, decodeJSON(context, target))
+}
+
+// bindJSONOrForm is bindJSON for endpoints that also take the form-encoded and multipart bodies of HTML forms
+func bindJSONOrForm(context *gin.Context, target any) bool {
+	if isForm(context.Request) {
+		return respondToDecodeError(context, decodeForm(context, target))
+	}
+	return respondToDecodeError(context, decodeJSON(context, target))
+}
+
+func respondToDecodeError(context *gin.Context, err *DecodeError) bool {
+	if err != nil {
+		slog.WarnContext(context.Request.Context(), "Malformed request body", "path", context.FullPath(), "error", err)
+		context.JSON(err.Status, gin.H{"Errors": []string{err.Message}, "error": err})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// the reasons two signups are taken for the same person
+const (
+	duplicateEmail = "email"
+	duplicatePhone = "phone"
+	duplicateIBAN  = "iban"
+	// duplicateNameAndBirth is a name spelled about the same together with the same date of birth
+	duplicateNameAndBirth = "name_and_date_of_birth"
+)
+
+// nameDistance is how many letters two names may differ and still be taken for the same,
+// enough for a typo or a forgotten letter but not for another person with the same birthday
+const nameDistance = 2
+
+// DuplicateMatch is an earlier signup that looks like the same person
+type DuplicateMatch struct {
+	ID        string       `json:"id"`
+	Status    SignupStatus `json:"status"`
+	CreatedAt string       `json:"created_at"`
+	Reasons   []string     `json:"reasons"`
+}
+
+// findDuplicates compares member with the signups, which must be revealed. Anonymized signups are left out,
+// they no longer hold anything to compare with.
+func findDuplicates(member PISignUp, signups []StoredSignup) []DuplicateMatch {
+	var matches []DuplicateMatch
+	for _, signup := range signups {
+		if signup.Anonymized {
+			continue
+		}
+		if reasons := duplicateReasons(member, signup.Member); len(reasons) > 0 {
+			matches = append(matches, DuplicateMatch{
+				ID:        signup.ID,
+				Status:    signup.Status,
+				CreatedAt: signup.CreatedAt.Format("2006-01-02"),
+				Reasons:   reasons,
+			})
+		}
+	}
+	return matches
+}
+
+func duplicateReasons(a, b PISignUp) []string {
+	var reasons []string
+	if email := normalizeEmail(a.Email); email != "" && email == normalizeEmail(b.Email) {
+		reasons = append(reasons, duplicateEmail)
+	}
+	if phone := normalizePhone(a.Phone, a.Country); phone != "" && phone == normalizePhone(b.Phone, b.Country) {
+		reasons = append(reasons, duplicatePhone)
+	}
+	if iban := normalizeIBAN(a.IBAN); iban != "" && iban == normalizeIBAN(b.IBAN) {
+		reasons = append(reasons, duplicateIBAN)
+	}
+	if birth := strings.TrimSpace(a.DateOfBirth); birth != "" && birth == strings.TrimSpace(b.DateOfBirth) && similarNames(a, b) {
+		reasons = append(reasons, duplicateNameAndBirth)
+	}
+	return reasons
+}
+
+// normalizeEmail lowercases the address and drops a +tag, and the dots Gmail ignores
+func normalizeEmail(email string) string {
+	local, domain, found := strings.Cut(strings.ToLower(strings.TrimSpace(email)), "@")
+	if !found {
+		return ""
+	}
+	local, _, _ = strings.Cut(local, "+")
+	if domain == "googlemail.com" {
+		domain = "gmail.com"
+	}
+	if domain == "gmail.com" {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	return local + "@" + domain
+}
+
+// country calling codes of the countries members come from, for numbers written without one
+var callingCodes = map[string]string{"NL": "31", "BE": "32"}
+
+// normalizePhone writes a number in E.164, like +31612345678. Numbers without a country code, like
+// 06 12345678, get the one of the country of the member.
+func normalizePhone(phone, country string) string {
+	var digits strings.Builder
+	for i, r := range strings.TrimSpace(phone) {
+		if r >= '0' && r <= '9' || (r == '+' && i == 0) {
+			digits.WriteRune(r)
+		}
+	}
+	number := digits.String()
+	switch {
+	case strings.HasPrefix(number, "+"):
+	case strings.HasPrefix(number, "00"):
+		number = "+" + number[2:]
+	case strings.HasPrefix(number, "0") && callingCodes[country] != "":
+		number = "+" + callingCodes[country] + number[1:]
+	default:
+		return ""
+	}
+	if len(number) < 8 {
+		return ""
+	}
+	return number
+}
+
+func normalizeIBAN(iban string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(iban), ""))
+}
+
+// normalizeName lowercases a name and drops accents, spaces and punctuation, so "Dé Vries-Jansen" is "devriesjansen"
+func normalizeName(name string) string {
+	var normalized strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(name)) {
+		if unicode.IsLetter(r) {
+			normalized.WriteRune(r)
+		}
+	}
+	return normalized.String()
+}
+
+// similarNames compares the surname with infix, and the first legal first name or the nickname
+func similarNames(a, b PISignUp) bool {
+	surnameA, surnameB := normalizeName(a.Infix+a.Surname), normalizeName(b.Infix+b.Surname)
+	if surnameA == "" || surnameB == "" {
+		return false
+	}
+	for _, firstA := range firstNames(a) {
+		for _, firstB := range firstNames(b) {
+			if levenshtein(firstA+" "+surnameA, firstB+" "+surnameB) <= nameDistance {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func firstNames(member PISignUp) []string {
+	var names []string
+	if fields := strings.Fields(member.LegalFirstNames); len(fields) > 0 {
+		names = append(names, normalizeName(fields[0]))
+	}
+	if nickname := normalizeName(member.Nickname); nickname != "" {
+		names = append(names, nickname)
+	}
+	return names
+}
+
+// levenshtein is the number of letters to insert, delete or replace to turn a into b
+func levenshtein(a, b string) int {
+	first, second := []rune(a), []rune(b)
+	previous := make([]int, len(second)+1)
+	current := make([]int, len(second)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(first); i++ {
+		current[0] = i
+		for j := 1; j <= len(second); j++ {
+			cost := 1
+			if first[i-1] == second[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(second)]
+}
+
+// describeDuplicates is the warning in the mail to the secretary. It only names the signups by ID,
+// so it holds no personal data when the attachment is encrypted.
+func describeDuplicates(matches []DuplicateMatch) string {
+	var description strings.Builder
+	description.WriteString("Let op: deze aanmelding lijkt op een eerdere aanmelding. Controleer of het om dezelfde persoon gaat.\n")
+	for _, match := range matches {
+		reasons := make([]string, len(match.Reasons))
+		for i, reason := range match.Reasons {
+			reasons[i] = duplicateReasonNames[reason]
+		}
+		fmt.Fprintf(&description, "- aanmelding %s van %s (%s): zelfde %s\n", match.ID, match.CreatedAt, match.Status, strings.Join(reasons, ", "))
+	}
+	return description.String()
+}
+
+var duplicateReasonNames = map[string]string{
+	duplicateEmail:        "e-mailadres",
+	duplicatePhone:        "telefoonnummer",
+	duplicateIBAN:         "IBAN",
+	duplicateNameAndBirth: "naam en geboortedatum",
+}
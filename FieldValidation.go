@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FieldResult is the outcome of validating one field, with its normalized value when it is valid
+type FieldResult struct {
+	Valid bool   `json:"valid"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleValidate checks fields while the form is filled in, so mistakes show up before it is submitted. It takes
+// part of a signup, like {"postal_code": "4793ab", "iban": "NL18 RABO 0123 4598 76"}, or a single field as
+// {"field": "postal_code", "value": "4793ab"}, and runs the checks of handleSignUp on the fields that are
+// present. Every field sent gets a result with its normalized value, also those that have no check. Nothing is stored, no captcha is needed and the IBAN is only checked with its checksum: openiban is
+// asked when the signup is submitted. The form calls it on every blur, so failures do not count towards a ban:
+// only the validate limit keeps it from being a free checker for lists of IBANs and postal codes.
+func handleValidate(context *gin.Context) {
+	var body map[string]json.RawMessage
+	if !bindJSON(context, &body) {
+		return
+	}
+	if name, single := body["field"]; single {
+		var field string
+		if err := json.Unmarshal(name, &field); err != nil || field == "" {
+			context.JSON(http.StatusBadRequest, gin.H{
+				"Errors": []string{"field moet de naam van een veld zijn"},
+				"error":  &DecodeError{Code: "type", Message: "field moet de naam van een veld zijn", Field: "field"},
+			})
+			return
+		}
+		body = map[string]json.RawMessage{field: body["value"]}
+	}
+	var member PISignUp
+	encoded, _ := json.Marshal(body)
+	if err := decodeStrict(bytes.NewReader(encoded), &member); err != nil {
+		slog.WarnContext(context.Request.Context(), "Malformed validation request", "error", err)
+		// the offset is in the request as we rebuilt it, not as the client sent it
+		err.Offset = 0
+		context.JSON(err.Status, gin.H{"Errors": []string{err.Message}, "error": err})
+		return
+	}
+
+	fields := []string{}
+	for _, check := range signupChecks {
+		if _, present := body[check.field]; present {
+			fields = append(fields, check.field)
+		}
+	}
+	failures := validateSignup(&member, fields, validateIBANChecksum)
+
+	// the normalized values, by their JSON names
+	var normalized map[string]string
+	encoded, _ = json.Marshal(member)
+	json.Unmarshal(encoded, &normalized)
+
+	// fields without a check are valid, they come back trimmed and normalized like they would be stored
+	results := make(map[string]FieldResult, len(body))
+	for field := range body {
+		results[field] = FieldResult{Valid: true, Value: normalized[field]}
+	}
+	for _, failed := range failures {
+		results[failed.Field] = FieldResult{Error: failed.Err.Error()}
+	}
+	context.JSON(http.StatusOK, gin.H{"valid": len(failures) == 0, "fields": results})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	formURLEncoded = "application/x-www-form-urlencoded"
+	formMultipart  = "multipart/form-data"
+)
+
+// isForm tells whether the body is a submitted HTML form, rather than JSON
+func isForm(request *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return mediaType == formURLEncoded || mediaType == formMultipart
+}
+
+// decodeForm reads a form-encoded or multipart body into target, by the JSON names of its fields, with the same
+// checks as decodeStrict. Checkboxes that are not ticked are not sent, they end up empty.
+func decodeForm(context *gin.Context, target any) *DecodeError {
+	request := context.Request
+	request.Body = http.MaxBytesReader(context.Writer, request.Body, CONFIG.MaxBodyBytes)
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type")); mediaType == formMultipart {
+		err = request.ParseMultipartForm(CONFIG.MaxBodyBytes)
+	} else {
+		err = request.ParseForm()
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return decodeFailure(err, 0)
+		}
+		return &DecodeError{Status: http.StatusBadRequest, Code: "syntax", Message: "het formulier is ongeldig: " + err.Error()}
+	}
+
+	fields := map[string]string{}
+	for name, values := range request.PostForm {
+		if len(values) > 1 {
+			return &DecodeError{Status: http.StatusBadRequest, Code: "type", Message: "het veld is meer dan eens ingevuld", Field: name}
+		}
+		fields[name] = values[0]
+	}
+	encoded, _ := json.Marshal(fields)
+	decodeErr := decodeStrict(bytes.NewReader(encoded), target)
+	if decodeErr != nil {
+		// the offset is in the JSON we made of the form
+		decodeErr.Offset = 0
+	}
+	return decodeErr
+}
+
+// wantsRedirect tells whether the request comes from a browser submitting a plain HTML form, which should be
+// sent on to a page instead of being shown our JSON. Scripts posting a FormData do not ask for HTML.
+func wantsRedirect(request *http.Request) bool {
+	return isForm(request) && strings.Contains(request.Header.Get("Accept"), "text/html")
+}
+
+// redirectHTMLForms answers the signups of plain HTML forms with a redirect to SIGNUP_SUCCESS_URL, or to
+// SIGNUP_ERROR_URL with the status of the failure, like ?status=400. The messages are left out of the
+// address, they can hold personal data and would end up in access logs and the history of the browser.
+func redirectHTMLForms(successURL, errorURL string) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if !wantsRedirect(context.Request) {
+			context.Next()
+			return
+		}
+		writer := &bufferingWriter{ResponseWriter: context.Writer, status: http.StatusOK}
+		context.Writer = writer
+		context.Next()
+		context.Writer = writer.ResponseWriter
+
+		target := successURL
+		if writer.status >= http.StatusBadRequest {
+			target = withQuery(errorURL, "status", strconv.Itoa(writer.status))
+		}
+		context.Writer.Header().Del("Content-Type")
+		context.Redirect(http.StatusSeeOther, target)
+	}
+}
+
+func withQuery(address, key, value string) string {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return address
+	}
+	query := parsed.Query()
+	query.Set(key, value)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// bufferingWriter holds back the response of the handlers, for redirectHTMLForms to replace it
+type bufferingWriter struct {
+	gin.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (writer *bufferingWriter) WriteHeader(status int) {
+	writer.status = status
+}
+
+func (writer *bufferingWriter) WriteHeaderNow() {}
+
+func (writer *bufferingWriter) Write(data []byte) (int, error) {
+	return writer.body.Write(data)
+}
+
+func (writer *bufferingWriter) WriteString(data string) (int, error) {
+	return writer.body.WriteString(data)
+}
+
+func (writer *bufferingWriter) Status() int {
+	return writer.status
+}
+
+func (writer *bufferingWriter) Size() int {
+	return writer.body.Len()
+}
+
+func (writer *bufferingWriter) Written() bool {
+	return writer.body.Len() > 0
+}
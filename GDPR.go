@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// fields that stay behind when a signup is anonymized, none of them identify a member on their own
+// and they keep the yearly signup statistics intact
+var anonymizationKeeps = []string{"education", "cohort_year", "country", "accept_contribution", "accept_terms_and_conditions"}
+
+// MemberExport is everything we hold about one email address, for a right of access or portability request
+type MemberExport struct {
+	Email      string         `json:"email"`
+	ExportedAt time.Time      `json:"exported_at"`
+	Signups    []StoredSignup `json:"signups"`
+}
+
+// ErasureResult tells what an erasure request touched
+type ErasureResult struct {
+	Signups    int  `json:"signups"`
+	LogFiles   int  `json:"log_files"`
+	Anonymized bool `json:"anonymized"`
+}
+
+func exportMemberData(email string) (MemberExport, error) {
+	export := MemberExport{Email: email, ExportedAt: time.Now().UTC()}
+
+	signups, err := SIGNUP_STORE.FindByEmail(email)
+	if err != nil {
+		return export, err
+	}
+	export.Signups, err = SIGNUP_STORE.Reveal(signups...)
+	return export, err
+}
+
+// writeExportCSV writes one row per signup with a column for every field of PISignUp,
+// named after its json field so the columns match the JSON export
+func writeExportCSV(w io.Writer, export MemberExport) error {
+	writer := csv.NewWriter(w)
+
+	header := append([]string{"id", "status", "created_at", "updated_at"}, jsonFieldNames(PISignUp{})...)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, signup := range export.Signups {
+		row := []string{signup.ID, string(signup.Status), signup.CreatedAt.Format(time.RFC3339), signup.UpdatedAt.Format(time.RFC3339)}
+		row = append(row, stringFieldValues(signup.Member)...)
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// stringFieldValues returns the values of every json tagged field, in the order of jsonFieldNames
+func stringFieldValues(member PISignUp) []string {
+	var values []string
+	fields := reflect.ValueOf(member)
+	for i := 0; i < fields.NumField(); i++ {
+		if name := fields.Type().Field(i).Tag.Get("json"); name != "" && name != "-" {
+			values = append(values, fields.Field(i).String())
+		}
+	}
+	return values
+}
+
+// anonymizeMember empties every field except the few in anonymizationKeeps
+func anonymizeMember(member PISignUp) PISignUp {
+	fields := reflect.ValueOf(&member).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Type().Field(i).Tag.Get("json")
+		if !slices.Contains(anonymizationKeeps, name) {
+			fields.Field(i).SetString("")
+		}
+	}
+	return member
+}
+
+// eraseMemberData deletes (or anonymizes) every signup of the email address and scrubs the identifying
+// values of those signups from the logfiles. Mail is sent synchronously, so there is no outbox to clear.
+func eraseMemberData(email string, anonymize bool) (ErasureResult, error) {
+	result := ErasureResult{Anonymized: anonymize}
+	signups, err := SIGNUP_STORE.FindByEmail(email)
+	if err == nil {
+		// the logs hold plain text, so that is what we search for
+		signups, err = SIGNUP_STORE.Reveal(signups...)
+	}
+	if err != nil {
+		return result, err
+	}
+	result.Signups = len(signups)
+
+	// collect the values before they are gone
+	values := []string{email}
+	for _, signup := range signups {
+		values = append(values, identifyingValues(signup.Member)...)
+	}
+
+	ids := make([]string, len(signups))
+	for i, signup := range signups {
+		ids[i] = signup.ID
+	}
+
+	if anonymize {
+		for _, id := range ids {
+			_, err := SIGNUP_STORE.Update(id, func(signup *StoredSignup) {
+				signup.anonymize()
+			})
+			if err != nil {
+				return result, err
+			}
+		}
+	} else if err := SIGNUP_STORE.Delete(ids...); err != nil {
+		return result, err
+	}
+
+	if LOGFILE != nil {
+		scrubbed, err := LOGFILE.scrub(values)
+		result.LogFiles = scrubbed
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// identifyingValues are the values of a signup to scrub from the logs. Names are only scrubbed whole, a
+// first name or nickname on its own would erase every log line that happens to contain it. The postal code
+// and birth date are left out: others share them, and they look like the numbers and dates of any log line.
+func identifyingValues(member PISignUp) []string {
+	fullName := func(first, infix, surname string) string {
+		return strings.Join(strings.Fields(first+" "+infix+" "+surname), " ")
+	}
+	return []string{
+		member.Email, member.Phone, member.EmergencyContactPhoneNumber, member.IBAN,
+		fullName(member.LegalFirstNames, member.Infix, member.Surname),
+		fullName(member.Nickname, member.Infix, member.Surname),
+		fullName(member.EmergencyContactFirstName, member.EmergencyContactInfix, member.EmergencyContactSurname),
+		member.AccountHolder, member.Address,
+	}
+}
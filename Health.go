@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Build metadata, set at build time with
+//
+//	go build -ldflags "-X main.VERSION=v1.2.3 -X main.COMMIT=$(git rev-parse HEAD) -X main.BUILD_TIME=$(date -u +%FT%TZ)"
+//
+// When they are left empty the VCS information that go build embeds on its own is used instead.
+var (
+	VERSION    = ""
+	COMMIT     = ""
+	BUILD_TIME = ""
+)
+
+// IBAN_VERIFIER_STATUS keeps track of how the last calls to openiban went
+var IBAN_VERIFIER_STATUS = &dependencyStatus{}
+
+// dependencyStatus remembers the outcome of the last call to an external service
+type dependencyStatus struct {
+	mutex       sync.Mutex
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+}
+
+func (status *dependencyStatus) record(err error) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	if err != nil {
+		status.lastFailure = time.Now()
+		status.lastError = err.Error()
+		return
+	}
+	status.lastSuccess = time.Now()
+}
+
+// report tells how the service is doing, with the last error only when detailed is set
+func (status *dependencyStatus) report(detailed bool) gin.H {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	report := gin.H{"status": "unknown"}
+	if !status.lastSuccess.IsZero() {
+		report["status"] = "ok"
+		report["last_success"] = status.lastSuccess
+	}
+	// only report the failure when nothing succeeded after it
+	if !status.lastFailure.IsZero() && status.lastFailure.After(status.lastSuccess) {
+		report["status"] = "failing"
+		report["last_failure"] = status.lastFailure
+		if detailed {
+			report["error"] = status.lastError
+		}
+	}
+	return report
+}
+
+// handleHealth only tells that the process is alive and serving requests
+func handleHealth(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyHandler checks whether a signup can actually be processed right now.
+// The IBAN verifier is reported but does not make the backend unready: its status only changes
+// when signups come in, so an unready backend would never get the traffic to recover.
+// The errors hold paths and hostnames, they are logged and only shown to requests that carry one of
+// tokens, the METRICS_TOKEN or ADMIN_TOKEN, as bearer token. Anyone else just sees what is failing.
+func readyHandler(tokens ...string) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		detailed := false
+		given := context.GetHeader("Authorization")
+		for _, token := range tokens {
+			if token != "" && subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) == 1 {
+				detailed = true
+			}
+		}
+
+		checks := gin.H{}
+		ready := true
+		check := func(name string, err error) {
+			if err == nil {
+				checks[name] = gin.H{"status": "ok"}
+				return
+			}
+			ready = false
+			slog.WarnContext(context.Request.Context(), "Readiness check failed", "check", name, "error", err)
+			checks[name] = gin.H{"status": "failing"}
+			if detailed {
+				checks[name] = gin.H{"status": "failing", "error": err.Error()}
+			}
+		}
+
+		check("config", checkConfig())
+		check("smtp", SMTP_PROBE.check(context.Request.Context()))
+		check("store", SIGNUP_STORE.Ping())
+		checks["iban_verifier"] = IBAN_VERIFIER_STATUS.report(detailed)
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		context.JSON(status, gin.H{"ready": ready, "checks": checks})
+	}
+}
+
+func checkConfig() error {
+	if SERVER_EMAIL_CREDENTIALS.email == "" || SERVER_EMAIL_CREDENTIALS.password == "" || CORRESPONDANCE_EMAIL == "" {
+		return errors.New("email credentials or correspondance address missing")
+	}
+	return CONFIG.validate()
+}
+
+// SMTP_PROBE is what /readyz asks about the mail server. /readyz is public, so a burst of requests to it
+// must not turn into a burst of connections to the relay.
+var SMTP_PROBE = &cachedProbe{probe: checkSMTP, ttl: 5 * time.Second, now: time.Now}
+
+// cachedProbe runs probe at most once per ttl and hands out its last result in between. Callers that come in
+// while it runs wait for it, instead of probing as well.
+type cachedProbe struct {
+	mutex   sync.Mutex
+	probe   func(ctx context.Context) error
+	ttl     time.Duration
+	checked time.Time
+	err     error
+	now     func() time.Time
+}
+
+func (cache *cachedProbe) check(ctx context.Context) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if !cache.checked.IsZero() && cache.now().Sub(cache.checked) < cache.ttl {
+		return cache.err
+	}
+	cache.err = cache.probe(ctx)
+	cache.checked = cache.now()
+	return cache.err
+}
+
+// checkSMTP only opens a TCP connection, logging in on every probe would get the account throttled
+func checkSMTP(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, CONFIG.ReadinessTimeout)
+	defer cancel()
+
+	address := net.JoinHostPort(CONFIG.SMTPHost, strconv.Itoa(CONFIG.SMTPPort))
+	connection, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return connection.Close()
+}
+
+func handleVersion(context *gin.Context) {
+	context.JSON(http.StatusOK, buildInfo())
+}
+
+func buildInfo() gin.H {
+	info := gin.H{
+		"version":     VERSION,
+		"commit":      COMMIT,
+		"build_time":  BUILD_TIME,
+		"commit_time": "",
+		"go_version":  runtime.Version(),
+		"modified":    false,
+	}
+
+	embedded, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if VERSION == "" {
+		info["version"] = embedded.Main.Version
+	}
+	for _, setting := range embedded.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if COMMIT == "" {
+				info["commit"] = setting.Value
+			}
+		case "vcs.time":
+			info["commit_time"] = setting.Value
+		case "vcs.modified":
+			info["modified"] = setting.Value == "true"
+		}
+	}
+	return info
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// replayedHeader tells the client it got the stored response of an earlier request
+	replayedHeader    = "Idempotent-Replayed"
+	idempotencyKeyMax = 255
+)
+
+// IdempotencyStore remembers the responses of signups that were processed, so a double click or a retry
+// gets the first response again instead of mailing the secretary twice. Requests are matched on their
+// Idempotency-Key header, or on a fingerprint of the signup when the client sends none. The responses are
+// kept in memory, so only retries that reach the same instance are recognised.
+type IdempotencyStore struct {
+	mutex     sync.Mutex
+	responses map[string]*storedResponse
+	window    time.Duration
+	swept     time.Time
+	now       func() time.Time
+}
+
+// storedResponse is in flight until done is closed, a status of 0 after that means it was abandoned
+type storedResponse struct {
+	done        chan struct{}
+	fingerprint string
+	status      int
+	body        []byte
+	expires     time.Time
+}
+
+const idempotencyStoreKey = "idempotency_store"
+
+func newIdempotencyStore(window time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{responses: map[string]*storedResponse{}, window: window, now: time.Now}
+}
+
+// claim returns the response stored for key. The caller owns it when it is new, and has to finish or abandon it.
+func (store *IdempotencyStore) claim(key, fingerprint string) (response *storedResponse, owner bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := store.now()
+	if now.Sub(store.swept) > time.Minute {
+		store.swept = now
+		for key, response := range store.responses {
+			if response.status != 0 && !now.Before(response.expires) {
+				delete(store.responses, key)
+			}
+		}
+	}
+
+	if response, exists := store.responses[key]; exists && (response.status == 0 || now.Before(response.expires)) {
+		return response, false
+	}
+	response = &storedResponse{done: make(chan struct{}), fingerprint: fingerprint}
+	store.responses[key] = response
+	return response, true
+}
+
+func (store *IdempotencyStore) finish(response *storedResponse, status int, body []byte) {
+	store.mutex.Lock()
+	response.status, response.body, response.expires = status, body, store.now().Add(store.window)
+	store.mutex.Unlock()
+	close(response.done)
+}
+
+// abandon forgets a request that did not get to process the signup, so it can be sent again
+func (store *IdempotencyStore) abandon(key string, response *storedResponse) {
+	store.mutex.Lock()
+	if store.responses[key] == response {
+		delete(store.responses, key)
+	}
+	store.mutex.Unlock()
+	close(response.done)
+}
+
+// withIdempotency hands the store to replayGuard
+func withIdempotency(store *IdempotencyStore) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		context.Set(idempotencyStoreKey, store)
+		context.Next()
+	}
+}
+
+// signupFingerprint identifies a signup by its contents, without the captcha that a retry may solve again
+func signupFingerprint(member PISignUp) string {
+	member.Altcha = ""
+	encoded, _ := json.Marshal(member)
+	hash := sha256.Sum256(encoded)
+	return hex.EncodeToString(hash[:])
+}
+
+// recordingWriter keeps a copy of the response body, to replay it later
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (writer *recordingWriter) Write(data []byte) (int, error) {
+	writer.body.Write(data)
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *recordingWriter) WriteString(data string) (int, error) {
+	writer.body.WriteString(data)
+	return writer.ResponseWriter.WriteString(data)
+}
+
+// replayGuard answers a repeated signup with the response of the first one and returns false. Otherwise it
+// returns a function that must be called once the signup is handled, telling whether it was processed:
+// only processed signups are remembered, ones that failed validation can be corrected and sent again.
+// Neither are server errors, a retry may well get through once the mail server is back.
+func replayGuard(context *gin.Context, member PISignUp) (settle func(processed bool), ok bool) {
+	value, exists := context.Get(idempotencyStoreKey)
+	if !exists {
+		return func(bool) {}, true
+	}
+	store := value.(*IdempotencyStore)
+
+	fingerprint := signupFingerprint(member)
+	key := "fingerprint:" + fingerprint
+	if header := context.GetHeader(idempotencyKeyHeader); header != "" {
+		if len(header) > idempotencyKeyMax {
+			context.JSON(http.StatusBadRequest, gin.H{"Errors": []string{"Idempotency-Key is te lang"}})
+			return nil, false
+		}
+		key = "key:" + header
+	}
+
+	for {
+		response, owner := store.claim(key, fingerprint)
+		if owner {
+			recorder := &recordingWriter{ResponseWriter: context.Writer}
+			context.Writer = recorder
+			return func(processed bool) {
+				if processed && recorder.Status() < http.StatusInternalServerError {
+					store.finish(response, recorder.Status(), recorder.body.Bytes())
+				} else {
+					store.abandon(key, response)
+				}
+			}, true
+		}
+
+		if response.fingerprint != fingerprint {
+			context.JSON(http.StatusUnprocessableEntity, gin.H{"Errors": []string{"Idempotency-Key is al gebruikt voor een andere aanmelding"}})
+			return nil, false
+		}
+		// a double click, wait for the first request to finish
+		select {
+		case <-response.done:
+		case <-context.Request.Context().Done():
+			context.JSON(http.StatusConflict, gin.H{"Errors": []string{"je aanmelding wordt al verwerkt"}})
+			return nil, false
+		}
+		if response.status != 0 {
+			SIGNUPS.WithLabelValues(signupReplayed).Inc()
+			context.Header(replayedHeader, "true")
+			context.Data(response.status, "application/json; charset=utf-8", response.body)
+			return nil, false
+		}
+		// the first request was abandoned, so this one gets to try
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// incoming request IDs are only reused when they look like something a proxy would generate
+var RequestIDRegex *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// LOGFILE is the file sink set up by setupLogging, nil when logging only goes to stdout
+var LOGFILE *rotatingFile
+
+// setupLogging points slog (and the standard log package, which slog takes over) at stdout and,
+// unless LOG_FILE is "off", at a rotating logfile. Everything passes the redaction of Redact.go first.
+// The returned closer flushes and closes the logfile.
+func setupLogging(config Config) (io.Closer, error) {
+	var output io.Writer = os.Stdout
+	var closer io.Closer = io.NopCloser(nil)
+
+	if config.LogFile != "off" {
+		file, err := openRotatingFile(config.LogFile, config.LogRotateSize, config.LogRotateInterval, config.LogKeepFiles, config.LogKeepFor)
+		if err != nil {
+			return nil, err
+		}
+		output = io.MultiWriter(os.Stdout, file)
+		closer = file
+		LOGFILE = file
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch config.LogFormat {
+	case "json":
+		handler = slog.NewJSONHandler(output, options)
+	case "text":
+		handler = slog.NewTextHandler(output, options)
+	default:
+		return nil, fmt.Errorf("LOG_FORMAT must be json or text, not %q", config.LogFormat)
+	}
+
+	policy := newRedactionPolicy(config.LogRedaction, config.LogRedactKeys)
+	slog.SetDefault(slog.New(newRedactingHandler(requestIDHandler{handler}, policy)))
+	if policy.Mode == redactOff && gin.Mode() == gin.ReleaseMode {
+		slog.Warn("LOG_REDACTION is off, personal data of members will end up in the logs")
+	}
+	return closer, nil
+}
+
+// requestIDHandler adds the request ID from the context to every record logged with one
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (handler requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return handler.Handler.Handle(ctx, record)
+}
+
+func (handler requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{handler.Handler.WithAttrs(attrs)}
+}
+
+func (handler requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{handler.Handler.WithGroup(name)}
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) string {
+	bytes := make([]byte, n)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// assignRequestID reuses the X-Request-ID of the proxy in front of us when there is a sane one,
+// generates one otherwise, and sends it back so users can quote it when something goes wrong
+func assignRequestID(context *gin.Context) {
+	id := context.GetHeader(requestIDHeader)
+	if !RequestIDRegex.MatchString(id) {
+		id = randomHex(16)
+	}
+
+	context.Request = context.Request.WithContext(withRequestID(context.Request.Context(), id))
+	context.Header(requestIDHeader, id)
+	context.Next()
+}
+
+// logRequests replaces the gin logger, so access logs share the format and request ID of everything else
+func logRequests(context *gin.Context) {
+	start := time.Now()
+	context.Next()
+
+	level := slog.LevelInfo
+	if context.Writer.Status() >= 500 {
+		level = slog.LevelError
+	}
+	slog.Log(context.Request.Context(), level, "Handled request",
+		"method", context.Request.Method,
+		"path", context.Request.URL.Path,
+		"status", context.Writer.Status(),
+		"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		"client_ip", clientIP(context),
+	)
+}
+
+// recoverPanics logs a panic with its stack trace through slog instead of gin's own writer
+var recoverPanics = gin.CustomRecoveryWithWriter(io.Discard, func(context *gin.Context, err any) {
+	slog.ErrorContext(context.Request.Context(), "Panic while handling request", "error", err, "stack", string(debug.Stack()))
+	context.AbortWithStatus(500)
+})
+
+// rotatingFile is a logfile that moves itself aside once it grows past maxSize or gets older than interval.
+// Rotated files are named after the original with the rotation time appended, and are deleted once there
+// are more than keepFiles of them or they are older than keepFor.
+// The gdpr erase command scrubs the files from another process, so writes, rotations and scrubs all hold
+// an advisory lock on path.lock, like the signup store does.
+type rotatingFile struct {
+	mutex     sync.Mutex
+	lock      *os.File
+	path      string
+	maxSize   int64
+	interval  time.Duration
+	keepFiles int
+	keepFor   time.Duration
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	now      func() time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, interval time.Duration, keepFiles int, keepFor time.Duration) (*rotatingFile, error) {
+	file := &rotatingFile{
+		path:      path,
+		maxSize:   maxSize,
+		interval:  interval,
+		keepFiles: keepFiles,
+		keepFor:   keepFor,
+		now:       time.Now,
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file.lock = lock
+	if err := file.open(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (file *rotatingFile) open() error {
+	f, err := os.OpenFile(file.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	file.file = f
+	file.size = info.Size()
+	file.openedAt = file.now()
+	return nil
+}
+
+// lockFile takes the mutex and the advisory lock on path.lock, the caller calls unlock when it is done
+func (file *rotatingFile) lockFile() (unlock func(), err error) {
+	file.mutex.Lock()
+	if err := lockExclusive(file.lock); err != nil {
+		file.mutex.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile(file.lock)
+		file.mutex.Unlock()
+	}, nil
+}
+
+func (file *rotatingFile) Write(p []byte) (int, error) {
+	unlock, err := file.lockFile()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	// a scrub from another process may have rewritten the file since our last write
+	if info, err := file.file.Stat(); err == nil {
+		file.size = info.Size()
+	}
+	if file.needsRotation(len(p)) {
+		if err := file.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := file.file.Write(p)
+	file.size += int64(n)
+	return n, err
+}
+
+func (file *rotatingFile) needsRotation(incoming int) bool {
+	if file.size == 0 {
+		return false
+	}
+	if file.maxSize > 0 && file.size+int64(incoming) > file.maxSize {
+		return true
+	}
+	return file.interval > 0 && file.now().Sub(file.openedAt) >= file.interval
+}
+
+func (file *rotatingFile) rotate() error {
+	if err := file.file.Close(); err != nil {
+		return err
+	}
+	rotated := file.path + "." + file.now().UTC().Format("20060102T150405.000")
+	if err := os.Rename(file.path, rotated); err != nil {
+		return err
+	}
+	if err := file.open(); err != nil {
+		return err
+	}
+	file.prune()
+	return nil
+}
+
+// rotated returns the paths of the rotated files, leaving out the lock file that shares their prefix
+func (file *rotatingFile) rotated() ([]string, error) {
+	paths, err := filepath.Glob(file.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var rotated []string
+	for _, path := range paths {
+		if strings.HasPrefix(path, file.path+".") && path != file.lock.Name() {
+			rotated = append(rotated, path)
+		}
+	}
+	return rotated, nil
+}
+
+// prune deletes rotated files beyond the retention limits, errors are ignored as the next rotation tries again
+func (file *rotatingFile) prune() {
+	rotated, err := file.rotated()
+	if err != nil {
+		return
+	}
+	// the timestamp suffix sorts chronologically, newest first after reversing
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+
+	for i, path := range rotated {
+		expired := false
+		if file.keepFor > 0 {
+			if info, err := os.Stat(path); err == nil && file.now().Sub(info.ModTime()) > file.keepFor {
+				expired = true
+			}
+		}
+		if (file.keepFiles > 0 && i >= file.keepFiles) || expired {
+			os.Remove(path)
+		}
+	}
+}
+
+// scrub replaces every occurrence of the values in the current and the rotated logfiles,
+// for erasure requests covering logs written before redaction existed. It returns the number of files changed.
+func (file *rotatingFile) scrub(values []string) (int, error) {
+	unlock, err := file.lockFile()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	var erased []string
+	for _, value := range values {
+		if value != "" {
+			erased = append(erased, value)
+		}
+	}
+	if len(erased) == 0 {
+		return 0, nil
+	}
+	// a full name before the account holder that is part of it
+	sort.Slice(erased, func(i, j int) bool { return len(erased[i]) > len(erased[j]) })
+
+	rotated, err := file.rotated()
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for _, path := range append([]string{file.path}, rotated...) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return changed, err
+		}
+		scrubbed := string(content)
+		for _, value := range erased {
+			scrubbed = eraseWhole(scrubbed, value)
+		}
+		if scrubbed == string(content) {
+			continue
+		}
+		// rewriting in place keeps the open handles of the current file valid, they append to the new end
+		if err := os.WriteFile(path, []byte(scrubbed), 0640); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// eraseWhole replaces the occurrences of value in text that are not part of a longer word or number, so
+// erasing house number 16 leaves 2016 and 16:05 in other lines alone
+func eraseWhole(text, value string) string {
+	var scrubbed strings.Builder
+	written, from := 0, 0
+	for {
+		index := strings.Index(text[from:], value)
+		if index < 0 {
+			break
+		}
+		start, end := from+index, from+index+len(value)
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if start > 0 && isWordRune(before) || end < len(text) && isWordRune(after) {
+			// the value may still start within this occurrence
+			_, size := utf8.DecodeRuneInString(text[start:])
+			from = start + size
+			continue
+		}
+		scrubbed.WriteString(text[written:start])
+		scrubbed.WriteString("[erased]")
+		written, from = end, end
+	}
+	scrubbed.WriteString(text[written:])
+	return scrubbed.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func (file *rotatingFile) Close() error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	file.lock.Close()
+	return file.file.Close()
+}
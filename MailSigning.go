@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/wneessen/go-mail"
+	"github.com/wneessen/go-mail/smtp"
+)
+
+// the headers covered by the DKIM signature, as recommended by RFC 6376 section 5.4.1
+var dkimHeaderKeys = []string{"From", "To", "Cc", "Subject", "Date", "Message-ID", "Reply-To", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+// MailSigner signs outgoing mail with DKIM and S/MIME, each for its own list of message types
+// (emailMemberInfo, emailConfirmation)
+type MailSigner struct {
+	dkim       *dkim.SignOptions
+	dkimTypes  []string
+	smime      *tls.Certificate
+	smimeTypes []string
+}
+
+// MAIL_SIGNER is set by main from the config, nil sends mail unsigned
+var MAIL_SIGNER *MailSigner
+
+// loadMailSigner reads the DKIM key and the S/MIME certificate from their files.
+// It returns nil when neither is configured.
+func loadMailSigner(config Config) (*MailSigner, error) {
+	if config.DKIMKeyFile == "" && config.SMIMECertFile == "" {
+		return nil, nil
+	}
+
+	signer := &MailSigner{dkimTypes: config.DKIMMessages, smimeTypes: config.SMIMEMessages}
+	if config.DKIMKeyFile != "" {
+		if config.DKIMDomain == "" || config.DKIMSelector == "" {
+			return nil, errors.New("DKIM_KEY_FILE needs DKIM_DOMAIN and DKIM_SELECTOR")
+		}
+		key, err := readPrivateKey(config.DKIMKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer.dkim = &dkim.SignOptions{
+			Domain:                 config.DKIMDomain,
+			Selector:               config.DKIMSelector,
+			Signer:                 key,
+			HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+			BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+			HeaderKeys:             dkimHeaderKeys,
+		}
+	}
+	if config.SMIMECertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.SMIMECertFile, config.SMIMEKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading S/MIME certificate: %w", err)
+		}
+		signer.smime = &certificate
+	}
+	return signer, nil
+}
+
+// readPrivateKey reads an RSA or Ed25519 private key from a PEM file, in PKCS #1 or PKCS #8 form
+func readPrivateKey(path string) (crypto.Signer, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM encoded key", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("reading private key %s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s holds an unsupported key type", path)
+	}
+	return signer, nil
+}
+
+func (signer *MailSigner) signsDKIM(messageType string) bool {
+	return signer != nil && signer.dkim != nil && slices.Contains(signer.dkimTypes, messageType)
+}
+
+func (signer *MailSigner) signsSMIME(messageType string) bool {
+	return signer != nil && signer.smime != nil && slices.Contains(signer.smimeTypes, messageType)
+}
+
+// signSMIME makes go-mail sign the message with S/MIME when it is written, if configured for its type
+func (signer *MailSigner) signSMIME(message *mail.Msg, messageType string) error {
+	if !signer.signsSMIME(messageType) {
+		return nil
+	}
+	if err := message.SignWithTLSCertificate(signer.smime); err != nil {
+		return fmt.Errorf("error signing with S/MIME: %w", err)
+	}
+	return nil
+}
+
+// render turns the message into the bytes that go over the wire, signed as configured for its type.
+// go-mail picks new MIME boundaries every time it writes a message, so the DKIM signature is only valid
+// for exactly these bytes.
+func (signer *MailSigner) render(message *mail.Msg, messageType string) ([]byte, error) {
+	if err := signer.signSMIME(message, messageType); err != nil {
+		return nil, err
+	}
+
+	var rendered bytes.Buffer
+	if _, err := message.WriteTo(&rendered); err != nil {
+		return nil, err
+	}
+	if !signer.signsDKIM(messageType) {
+		return rendered.Bytes(), nil
+	}
+
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, bytes.NewReader(rendered.Bytes()), signer.dkim); err != nil {
+		return nil, fmt.Errorf("error signing with DKIM: %w", err)
+	}
+	return signed.Bytes(), nil
+}
+
+// sendRendered delivers already rendered bytes over a connection set up by the go-mail client,
+// which takes care of TLS and authentication
+func sendRendered(ctx context.Context, client *mail.Client, message *mail.Msg, rendered []byte) error {
+	from, err := message.GetSender(false)
+	if err != nil {
+		return err
+	}
+	recipients, err := message.GetRecipients()
+	if err != nil {
+		return err
+	}
+
+	connection, err := client.DialToSMTPClientWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.CloseWithSMTPClient(connection)
+
+	if err := connection.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err := connection.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	return writeData(connection, rendered)
+}
+
+func writeData(connection *smtp.Client, rendered []byte) error {
+	writer, err := connection.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(rendered); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
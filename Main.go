@@ -1,38 +1,73 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"path"
 
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
-	"github.com/k42-software/go-altcha" // altcha
 )
 
 var CORRESPONDANCE_EMAIL = ""
 var SERVER_EMAIL_CREDENTIALS ServerEmailCredentials
 
-func initRouter() *gin.Engine {
-	router := gin.Default()
+func initRouter(captcha CaptchaVerifier) *gin.Engine {
+	router := gin.New()
 	router.SetTrustedProxies(nil)
-	config := cors.DefaultConfig()
-
-	if gin.Mode() == gin.DebugMode {
-		config.AllowOrigins = []string{"*"}
-	} else {
-		config.AllowOrigins = []string{"https://beta.svpromptusimperii.nl", "https://svpromptusimperii.nl"}
+	proxies, err := newProxyTrust(CONFIG.TrustedProxies, CONFIG.ClientIPHeader)
+	if err != nil {
+		log.Fatalf("error setting up trusted proxies: %v", err)
+	}
+	router.Use(proxies.resolveClientIP, assignRequestID, logRequests, recoverPanics, recordRequestMetrics)
+	router.Use(securityHeaders(CONFIG.SecurityHeaders))
+	router.Use(corsByRoute(CONFIG.CORS, map[string]CORSPolicy{"/api/admin": CONFIG.AdminCORS}))
+	router.Use(limitRequestBody(CONFIG.MaxBodyBytes))
+	router.GET("/healthz", handleHealth)
+	router.GET("/readyz", readyHandler(CONFIG.MetricsToken, CONFIG.AdminToken))
+	router.GET("/version", handleVersion)
+	router.GET("/metrics", metricsHandler(CONFIG.MetricsToken))
+
+	limiter, err := newRateLimiter(CONFIG)
+	if err != nil {
+		log.Fatalf("error setting up rate limiting: %v", err)
 	}
 
-	router.Use(cors.New(config))
 	api := router.Group("/api")
-	api.GET("/captcha-challenge", generateCaptchaChallenge)
-	api.POST("/signup", handleSignUp)
-	api.POST("/email", getEmail)
+	public := api.Group("", limiter.limit, withCaptcha(captcha))
+	public.GET("/captcha-challenge", generateCaptchaChallenge)
+	public.GET("/form-token", handleFormToken)
+	idempotency := newIdempotencyStore(CONFIG.IdempotencyWindow)
+	public.POST("/signup", redirectHTMLForms(CONFIG.SignupSuccessURL, CONFIG.SignupErrorURL), withIdempotency(idempotency), handleSignUp)
+	public.POST("/email", getEmail)
+	api.POST("/validate", limiter.scoped("validate", CONFIG.ValidateRateLimitPerIP).limit, handleValidate)
+
+	// the fallback for when the frontend does not work, it posts to the same handler
+	signupPage := newSignupPage(CONFIG, limiter)
+	page := router.Group("/aanmelden", withCaptcha(captcha))
+	page.GET("", limiter.limit, signupPage.show)
+	page.POST("", signupPage.render, limiter.limit, withIdempotency(idempotency), handleSignUp)
+	router.StaticFileFS("/aanmelden/signup.css", "static/signup.css", http.FS(pageFiles))
+	router.StaticFileFS(bundledAltchaWidget, "static/"+path.Base(bundledAltchaWidget), http.FS(pageFiles))
+
+	sessions := newAdminSessions(CONFIG.AdminToken, CONFIG.AdminSessionTTL)
+	admin := api.Group("/admin")
+	if CONFIG.AdminClientCAFile != "" {
+		admin.Use(requireClientCertificate)
+	}
+	admin.Use(requireAdmin(CONFIG.AdminToken, sessions), sessions.requireCSRFToken)
+	admin.POST("/session", sessions.handleLogin)
+	admin.DELETE("/session", handleLogout)
+	admin.POST("/gdpr/export", handleGDPRExport)
+	admin.POST("/gdpr/erase", handleGDPRErase)
+	admin.GET("/audit", handleAuditLog)
+	admin.GET("/signups", handleListSignups)
+	admin.PATCH("/signups/:id", handleSignupStatus)
+	admin.POST("/purge", handlePurge)
 
 	return router
 }
@@ -40,6 +75,39 @@ func initRouter() *gin.Engine {
 func main() {
 	godotenv.Load()
 
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	CONFIG = config
+
+	fieldCipher, err := newFieldCipher(CONFIG.EncryptionKeys, CONFIG.EncryptionKeyID)
+	if err != nil {
+		log.Fatalf("invalid encryption keys: %v", err)
+	}
+	if fieldCipher == nil {
+		log.Println("ENCRYPTION_KEYS not set, IBANs, birth dates and phone numbers are stored unencrypted")
+	}
+	SIGNUP_STORE, err = openSignupStore(CONFIG.StorePath, fieldCipher)
+	if err != nil {
+		log.Fatalf("error opening signup store: %v", err)
+	}
+	AUDIT_LOG, err = openAuditLog(CONFIG.AuditLogPath, CONFIG.AuditSubjectKey)
+	if err != nil {
+		log.Fatalf("error opening audit log: %v", err)
+	}
+	if CONFIG.AuditSubjectKey == "" {
+		log.Println("AUDIT_SUBJECT_KEY not set, the audit trail identifies members with a random key and their entries can not be found after a restart")
+	}
+
+	// Admin commands, like `backend gdpr export <email>`, run instead of the server
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Fail early if the environment variables are not loaded
 	serverEmail, serverEmailAddressExists := os.LookupEnv("SERVER_EMAIL_ADDRESS")
 	emailPassword, emailPasswordExists := os.LookupEnv("EMAIL_PASSWORD")
@@ -49,50 +117,81 @@ func main() {
 		log.Fatalf("SERVER_EMAIL_ADDRESS, EMAIL_PASSWORD and/or CORRESPONDANCE_EMAIL_ADDRESS environmentvariables not set")
 	}
 
+	ATTACHMENT_SEALER, err = loadAttachmentSealer(CONFIG)
+	if err != nil {
+		log.Fatalf("error loading attachment encryption: %v", err)
+	}
+	FORM_TIMER = newFormTimer(CONFIG)
+	if CONFIG.FormTokenKey == "" {
+		log.Println("FORM_TOKEN_KEY not set, form tokens are signed with a random key and open forms have to be reloaded after a restart")
+	}
+	if CONFIG.AltchaHMACKey == "" {
+		log.Println("ALTCHA_HMAC_KEY not set, captcha challenges are signed with a random key and become invalid on restart")
+	}
+	MAIL_SIGNER, err = loadMailSigner(CONFIG)
+	if err != nil {
+		log.Fatalf("error loading mail signing keys: %v", err)
+	}
+
 	SERVER_EMAIL_CREDENTIALS = ServerEmailCredentials{
 		email:    serverEmail,
 		password: emailPassword,
 	}
 	CORRESPONDANCE_EMAIL = correspondanceEmail
 
-	// Set logging to export to both a logfile and to stdout (the terminal)
-	f, err := os.OpenFile("logfile", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	// Set logging to export to both a (rotating) logfile and to stdout (the terminal)
+	logfile, err := setupLogging(CONFIG)
 	if err != nil {
-		log.Fatalf("error opening file: %v", err)
+		log.Fatalf("error setting up logging: %v", err)
 	}
-	defer f.Close()
+	defer logfile.Close()
 
-	stdoutAndFile := io.MultiWriter(f, os.Stdout)
-	log.SetOutput(stdoutAndFile)
+	slog.Info("App has started", "gin_mode", gin.Mode(), "log_file", CONFIG.LogFile)
 
-	log.Printf("App has started, logging to file and stdout. Gin running in %s mode", gin.Mode())
-	r := initRouter()
+	stopPurging := startPurgeSchedule(retentionPolicyFromConfig(CONFIG), CONFIG.PurgeInterval, CONFIG.PurgeDryRun)
+	defer stopPurging()
+	r := initRouter(newAltcha(CONFIG))
 
-	c := cors.DefaultConfig()
-	c.AllowAllOrigins = true
+	server := newHTTPServer(r, CONFIG)
+	if CONFIG.TLSCertFile != "" {
+		server.TLSConfig, err = newTLSConfig(CONFIG)
+		if err != nil {
+			log.Fatalf("error setting up TLS: %v", err)
+		}
+	}
+	listener, err := listen(CONFIG.ListenAddress)
+	if err != nil {
+		log.Fatalf("error listening on %s: %v", CONFIG.ListenAddress, err)
+	}
+	slog.Info("Listening", "address", listener.Addr().String(), "tls", server.TLSConfig != nil)
+	endpoints := []endpoint{{server, listener}}
 
-	r.Use(cors.New(c))
+	if CONFIG.HTTPRedirectAddress != "" {
+		redirectListener, err := listen(CONFIG.HTTPRedirectAddress)
+		if err != nil {
+			log.Fatalf("error listening on %s: %v", CONFIG.HTTPRedirectAddress, err)
+		}
+		slog.Info("Redirecting HTTP to HTTPS", "address", redirectListener.Addr().String())
+		endpoints = append(endpoints, endpoint{newHTTPServer(redirectToHTTPS(CONFIG.ListenAddress), CONFIG), redirectListener})
+	}
 
-	r.Run(":3000")
+	err = serve(CONFIG, endpoints...)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Server stopped with error", "error", err)
+	}
 }
 
 func generateCaptchaChallenge(context *gin.Context) {
-	challenge := altcha.NewChallengeEncoded()
+	challenge := context.MustGet(captchaVerifierKey).(CaptchaVerifier).NewChallenge(clientIP(context))
 
-	log.Printf("Sending Altcha challange: %s", challenge)
+	slog.DebugContext(context.Request.Context(), "Sending Altcha challenge", "challenge", challenge.Challenge)
 
-	jsonData := []byte(challenge)
-	context.Data(http.StatusOK, "application/json", jsonData)
+	context.JSON(http.StatusOK, challenge)
 }
 
 func getEmail(context *gin.Context) {
 	var req EmailRequest
-
-	err := json.NewDecoder(context.Request.Body).Decode(&req)
-
-	if err != nil {
-		log.Println(err.Error())
-		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindJSON(context, &req) {
 		return
 	}
 
@@ -105,63 +204,147 @@ func getEmail(context *gin.Context) {
 
 func handleSignUp(context *gin.Context) {
 	var member PISignUp
+	var trap BotTrap
 
-	err := json.NewDecoder(context.Request.Body).Decode(&member)
+	if !bindJSONOrForm(context, &struct {
+		*PISignUp
+		*BotTrap
+	}{&member, &trap}) {
+		SIGNUPS.WithLabelValues(signupMalformed).Inc()
+		return
+	}
 
-	if err != nil {
-		log.Println(err.Error())
-		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !botGuard(context, trap) {
+		return
+	}
+	// before the captcha, a retry sends the payload that was spent by the first request
+	settle, ok := replayGuard(context, member)
+	if !ok {
 		return
 	}
+	processed := false
+	defer func() { settle(processed) }()
 
 	if !altchaGuard(context, member.Altcha) {
+		SIGNUPS.WithLabelValues(signupCaptchaFailed).Inc()
 		return
 	}
 
-	var errors []string
 	// oh boy i love validating
-	member.PostalCode, err = validatePostalCode(member.PostalCode)
-	errors = appendError(errors, err)
-	errors = appendError(errors, validateDate(member.DateOfBirth))
-	errors = appendError(errors, validatePhoneNumber(member.Phone, "Jouw telefoonnummer"))
-	errors = appendError(errors, validateIBAN(member.IBAN))
-	errors = appendError(errors, validatePhoneNumber(member.EmergencyContactPhoneNumber, "Het telefoonnummer van je noodcontact"))
-	errors = appendError(errors, validateEmail(member.Email))
-	errors = appendError(errors, validateCohortYear(member.CohortYear))
-
-	log.Println(len(errors))
+	var errors []string
+	failures := validateSignup(&member, nil, lookupIBAN)
+	// for the signup page, which shows them next to their fields
+	context.Set(fieldErrorsKey, failures)
+	// an outage of openiban is not the fault of the client
+	abusive := false
+	for _, failed := range failures {
+		VALIDATION_FAILURES.WithLabelValues(failed.Field, failed.Rule).Inc()
+		errors = appendError(errors, failed.Err)
+		abusive = abusive || failed.Rule != ruleVerifierUnavailable
+	}
+
 	if len(errors) != 0 {
+		SIGNUPS.WithLabelValues(signupValidationFailed).Inc()
+		if abusive {
+			recordAbuse(context)
+		}
 		context.JSON(http.StatusBadRequest, gin.H{"Errors": errors})
 		return
 	}
 
-	memberErr := SendMemberInfoEmail(member, SERVER_EMAIL_CREDENTIALS, CORRESPONDANCE_EMAIL)
-	confirmationErr := SendNotificationEmail(member, SERVER_EMAIL_CREDENTIALS, CORRESPONDANCE_EMAIL)
+	processed = deliverSignup(context, member)
+}
+
+// asks openiban about the IBAN of a signup, replaced in tests
+var lookupIBAN = validateIBAN
+
+// the mails of a signup, replaced in tests
+var (
+	sendMemberInfoEmail   = SendMemberInfoEmail
+	sendNotificationEmail = SendNotificationEmail
+)
 
-	if memberErr != nil || confirmationErr != nil {
-		if memberErr != nil {
-			log.Println(memberErr.Error())
+// deliverSignup stores a validated signup and mails it, returning whether the secretary got it. Once they
+// have, a retry must not mail it again, even if the confirmation to the member did not go out.
+func deliverSignup(context *gin.Context, member PISignUp) bool {
+	stored, duplicates, err := SIGNUP_STORE.AddFindingDuplicates(member)
+	if err != nil {
+		// the secretary still gets the signup by mail, so carry on
+		slog.ErrorContext(context.Request.Context(), "Could not store signup", "error", err)
+	} else if len(duplicates) > 0 {
+		ids := make([]string, len(duplicates))
+		for i, duplicate := range duplicates {
+			ids[i] = duplicate.ID
 		}
-		if confirmationErr != nil {
-			log.Println(confirmationErr.Error())
+		slog.WarnContext(context.Request.Context(), "Signup looks like an earlier one", "duplicates", ids)
+	}
+
+	if err := sendMemberInfoEmail(context.Request.Context(), member, duplicates, SERVER_EMAIL_CREDENTIALS, CORRESPONDANCE_EMAIL); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not send member info email", "error", err)
+		SIGNUPS.WithLabelValues(signupEmailFailed).Inc()
+		// the secretary never saw it, a retry or the mail the member is asked to send should not leave a second copy
+		if stored.ID != "" {
+			if err := SIGNUP_STORE.Delete(stored.ID); err != nil {
+				slog.ErrorContext(context.Request.Context(), "Could not remove signup that was not mailed", "error", err)
+			}
 		}
 		context.JSON(http.StatusInternalServerError, gin.H{"Errors": []string{fmt.Sprintf("Er is iets fout gegaan tijdens het verwerken van je aanmelden. Meld jezelf aan via %s", CORRESPONDANCE_EMAIL)}})
-		return
+		return false
+	}
+
+	// the signup is in, the member only misses their copy
+	if err := sendNotificationEmail(context.Request.Context(), member, SERVER_EMAIL_CREDENTIALS, CORRESPONDANCE_EMAIL); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not send confirmation email", "error", err)
 	}
 
+	SIGNUPS.WithLabelValues(signupSuccess).Inc()
 	context.JSON(http.StatusOK, gin.H{"Success": "Registration successful."})
+	return true
 }
 
+const captchaVerifierKey = "captcha_verifier"
+
+// withCaptcha hands the verifier to generateCaptchaChallenge and altchaGuard
+func withCaptcha(captcha CaptchaVerifier) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		context.Set(captchaVerifierKey, captcha)
+		context.Next()
+	}
+}
+
+// the codes of a rejected captcha, in the error field of the response
+const (
+	captchaInvalid = "captcha_invalid"
+	// captchaStale is a challenge that was used or expired, the client has to fetch a new one and can then
+	// send the same request again
+	captchaStale = "captcha_stale"
+)
+
+// altchaGuard checks the captcha of a request and answers it when that fails, with the code of the failure in
+// {"Errors": [...], "error": {"code": ..., "message": ...}}. A challenge is spent as soon as it verifies, also
+// when the request then fails validation, so a member who corrects a field sends a used challenge. That, and
+// a challenge that expired while the form was open, is captcha_stale: not counted towards a ban, the frontend
+// fetches a new challenge from /api/captcha-challenge and sends the form again. Everything else is
+// captcha_invalid. It returns false when the request was answered.
 func altchaGuard(context *gin.Context, payload string) bool {
-	valid := altcha.ValidateResponse(payload, false)
+	err := context.MustGet(captchaVerifierKey).(CaptchaVerifier).Verify(payload)
 
-	if !valid && gin.Mode() != gin.TestMode {
-		log.Println("Invalid Altcha payload", valid)
-		context.JSON(http.StatusBadRequest, gin.H{"Errors": []string{"een geldige captcha is vereist. Probeer de pagina te herladen (je formuliervelden blijven bestaan)"}})
+	if err != nil {
+		CAPTCHA_VERIFICATIONS.WithLabelValues("fail").Inc()
+		slog.WarnContext(context.Request.Context(), "Invalid Altcha payload", "reason", err)
+		if errors.Is(err, ErrCaptchaReplayed) || errors.Is(err, ErrCaptchaExpired) {
+			message := "de captcha is verlopen. Los hem opnieuw op en verstuur het formulier nog een keer"
+			context.JSON(http.StatusBadRequest, gin.H{"Errors": []string{message}, "error": gin.H{"code": captchaStale, "message": message}})
+			return false
+		}
+		recordAbuse(context)
+		message := "een geldige captcha is vereist. Probeer de pagina te herladen (je formuliervelden blijven bestaan)"
+		context.JSON(http.StatusBadRequest, gin.H{"Errors": []string{message}, "error": gin.H{"code": captchaInvalid, "message": message}})
 		return false
 	}
 
-	log.Println("Valid Altcha payload", valid, payload)
+	CAPTCHA_VERIFICATIONS.WithLabelValues("pass").Inc()
+	slog.DebugContext(context.Request.Context(), "Valid Altcha payload")
 	return true
 }
 
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// METRICS_REGISTRY holds our own metrics next to the Go runtime and process metrics.
+// A separate registry keeps /metrics free of whatever libraries register on the global one.
+var METRICS_REGISTRY = prometheus.NewRegistry()
+
+var (
+	metrics = promauto.With(METRICS_REGISTRY)
+
+	REQUEST_DURATION = metrics.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "backend_http_request_duration_seconds",
+		Help:    "Time spent handling HTTP requests, per route.",
+		Buckets: []float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"method", "route", "status"})
+
+	SIGNUPS = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_signups_total",
+		Help: "Signup submissions, by outcome.",
+	}, []string{"outcome"})
+
+	VALIDATION_FAILURES = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_validation_failures_total",
+		Help: "Signup fields rejected by validation, by field and rule.",
+	}, []string{"field", "rule"})
+
+	CAPTCHA_VERIFICATIONS = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_captcha_verifications_total",
+		Help: "Altcha payloads checked, by result.",
+	}, []string{"result"})
+
+	CAPTCHA_CHALLENGES = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_captcha_challenges_total",
+		Help: "Altcha challenges handed out, by what set their difficulty: base, or raised for the ip or global volume. Solutions handed to browsers without JavaScript are delayed.",
+	}, []string{"difficulty"})
+
+	CAPTCHA_DIFFICULTY = metrics.NewHistogram(prometheus.HistogramOpts{
+		Name:    "backend_captcha_challenge_max_number",
+		Help:    "Maximum number of the Altcha challenges handed out, the work a client has to do at most.",
+		Buckets: prometheus.ExponentialBuckets(12500, 2, 10),
+	})
+
+	IBAN_VERIFIER_DURATION = metrics.NewHistogram(prometheus.HistogramOpts{
+		Name:    "backend_iban_verifier_duration_seconds",
+		Help:    "Latency of IBAN lookups at openiban.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	IBAN_VERIFIER_ERRORS = metrics.NewCounter(prometheus.CounterOpts{
+		Name: "backend_iban_verifier_errors_total",
+		Help: "IBAN lookups that failed because openiban could not be reached or answered garbage.",
+	})
+
+	EMAILS_SENT = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_emails_sent_total",
+		Help: "Emails handed to the SMTP server, by message type and result.",
+	}, []string{"type", "result"})
+
+	RATE_LIMITED = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_rate_limited_requests_total",
+		Help: "Requests answered with 429, by the limit that was hit: ip, global or banned.",
+	}, []string{"reason"})
+
+	BANS = metrics.NewCounter(prometheus.CounterOpts{
+		Name: "backend_client_bans_total",
+		Help: "Clients banned for failing the captcha or validation too often.",
+	})
+)
+
+// signup outcomes
+const (
+	signupSuccess          = "success"
+	signupMalformed        = "malformed"
+	signupCaptchaFailed    = "captcha_failed"
+	signupValidationFailed = "validation_failed"
+	signupEmailFailed      = "email_failed"
+	signupBotDetected      = "bot_detected"
+	signupReplayed         = "replayed"
+)
+
+// email message types
+const (
+	emailMemberInfo   = "member_info"
+	emailConfirmation = "confirmation"
+)
+
+func init() {
+	METRICS_REGISTRY.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// recordRequestMetrics observes the latency of every request. Requests that did not match a route
+// are grouped together, otherwise every scanner probing random paths would create a new series.
+func recordRequestMetrics(context *gin.Context) {
+	start := time.Now()
+	context.Next()
+
+	route := context.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	REQUEST_DURATION.
+		WithLabelValues(context.Request.Method, route, strconv.Itoa(context.Writer.Status())).
+		Observe(time.Since(start).Seconds())
+}
+
+// metricsHandler serves the registry, behind a bearer token when METRICS_TOKEN is set
+func metricsHandler(token string) gin.HandlerFunc {
+	handler := promhttp.HandlerFor(METRICS_REGISTRY, promhttp.HandlerOpts{})
+
+	return func(context *gin.Context) {
+		if token != "" {
+			given := context.GetHeader("Authorization")
+			if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) != 1 {
+				context.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(context.Writer, context.Request)
+	}
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Limit is a token bucket that holds Burst requests and refills Burst tokens every Per.
+// A zero Limit lets everything through.
+type Limit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// parseLimit reads a limit written as <requests>/<duration>, like 30/1m, or 0 for no limit
+func parseLimit(value string) (Limit, error) {
+	if value == "0" {
+		return Limit{}, nil
+	}
+	burst, per, found := strings.Cut(value, "/")
+	limit := Limit{}
+	var err error
+	if found {
+		limit.Burst, err = strconv.Atoi(burst)
+	}
+	if err == nil && found {
+		limit.Per, err = time.ParseDuration(per)
+	}
+	if !found || err != nil || limit.Burst <= 0 || limit.Per <= 0 {
+		return Limit{}, fmt.Errorf("%q is not a limit like 30/1m", value)
+	}
+	return limit, nil
+}
+
+func (limit Limit) enabled() bool {
+	return limit.Burst > 0
+}
+
+// tokensPerSecond is how fast an empty bucket fills up again
+func (limit Limit) tokensPerSecond() float64 {
+	return float64(limit.Burst) / limit.Per.Seconds()
+}
+
+// LimiterStore keeps the token buckets, failure counts and bans. The memory store is enough for a single
+// instance, the Redis store shares them between instances behind a load balancer.
+type LimiterStore interface {
+	// Take removes a token from the bucket of key, or returns how long it takes until one is available
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (time.Duration, error)
+	// Fail counts a failure of key and returns the number of failures in the current window
+	Fail(ctx context.Context, key string, window time.Duration, now time.Time) (int, error)
+	Ban(ctx context.Context, key string, duration time.Duration, now time.Time) error
+	// Banned returns how long the ban of key still lasts, 0 when it is not banned
+	Banned(ctx context.Context, key string, now time.Time) (time.Duration, error)
+}
+
+// RateLimiter protects the public endpoints with a token bucket per client IP and one for all clients
+// together. Clients that keep failing the captcha or validation are banned for a while.
+type RateLimiter struct {
+	store     LimiterStore
+	perIP     Limit
+	global    Limit
+	banAfter  int
+	banWindow time.Duration
+	banFor    time.Duration
+	// scope keeps the buckets of limiters for different endpoints apart
+	scope string
+	now   func() time.Time
+}
+
+const rateLimiterKey = "rate_limiter"
+
+func newRateLimiter(config Config) (*RateLimiter, error) {
+	limiter := &RateLimiter{
+		store:     newMemoryLimiterStore(),
+		perIP:     config.RateLimitPerIP,
+		global:    config.RateLimitGlobal,
+		banAfter:  config.BanAfterFailures,
+		banWindow: config.BanWindow,
+		banFor:    config.BanDuration,
+		now:       time.Now,
+	}
+	if config.RateLimitRedisURL != "" {
+		options, err := redis.ParseURL(config.RateLimitRedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("RATE_LIMIT_REDIS_URL: %w", err)
+		}
+		limiter.store = &redisLimiterStore{client: redis.NewClient(options)}
+	}
+	return limiter, nil
+}
+
+// scoped returns a limiter with its own bucket per client for other endpoints, and no global bucket.
+// Bans are shared with limiter.
+func (limiter *RateLimiter) scoped(scope string, perIP Limit) *RateLimiter {
+	scoped := *limiter
+	scoped.scope, scoped.perIP, scoped.global = scope+":", perIP, Limit{}
+	return &scoped
+}
+
+// limit is the middleware for the public endpoints. When the store can not be reached requests are let
+// through: a broken limiter must not take the signup form down with it.
+func (limiter *RateLimiter) limit(context *gin.Context) {
+	context.Set(rateLimiterKey, limiter)
+	ctx := context.Request.Context()
+	ip := clientIP(context)
+	now := limiter.now()
+
+	// without an address, like on a Unix socket that is not trusted, all clients would share one bucket and
+	// one ban, so only the global limit applies
+	var wait time.Duration
+	var err error
+	if ip != "" {
+		wait, err = limiter.store.Banned(ctx, "ban:"+ip, now)
+		if err == nil && wait > 0 {
+			limiter.reject(context, "banned", wait)
+			return
+		}
+		if err == nil && limiter.perIP.enabled() {
+			wait, err = limiter.store.Take(ctx, limiter.scope+"ip:"+ip, limiter.perIP, now)
+			if err == nil && wait > 0 {
+				limiter.reject(context, "ip", wait)
+				return
+			}
+		}
+	}
+	if err == nil && limiter.global.enabled() {
+		wait, err = limiter.store.Take(ctx, limiter.scope+"global", limiter.global, now)
+		if err == nil && wait > 0 {
+			limiter.reject(context, "global", wait)
+			return
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Rate limiter unavailable, letting request through", "error", err)
+	}
+	context.Next()
+}
+
+// allow takes a token from the bucket of the client without answering the request, for what a page hands out
+// instead of an endpoint. Unlike limit it refuses when the store can not be reached, or when the client has
+// no address to keep its bucket under.
+func (limiter *RateLimiter) allow(context *gin.Context) bool {
+	ctx := context.Request.Context()
+	ip := clientIP(context)
+	now := limiter.now()
+	if ip == "" {
+		return false
+	}
+
+	wait, err := limiter.store.Banned(ctx, "ban:"+ip, now)
+	if err == nil && wait == 0 && limiter.perIP.enabled() {
+		wait, err = limiter.store.Take(ctx, limiter.scope+"ip:"+ip, limiter.perIP, now)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Rate limiter unavailable, refusing", "scope", limiter.scope, "error", err)
+		return false
+	}
+	return wait == 0
+}
+
+func (limiter *RateLimiter) reject(context *gin.Context, reason string, wait time.Duration) {
+	RATE_LIMITED.WithLabelValues(reason).Inc()
+	slog.WarnContext(context.Request.Context(), "Rate limited request", "reason", reason, "retry_after", wait.Round(time.Second).String())
+	context.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	context.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"Errors": []string{"te veel verzoeken, probeer het later opnieuw"}})
+}
+
+// recordAbuse counts a failed captcha or validation against the client, and bans it once it failed too often.
+// Clients without an address are not counted, banning them would ban everyone that shares it.
+func recordAbuse(context *gin.Context) {
+	value, exists := context.Get(rateLimiterKey)
+	if !exists {
+		return
+	}
+	limiter := value.(*RateLimiter)
+	ip := clientIP(context)
+	if limiter.banAfter <= 0 || ip == "" {
+		return
+	}
+
+	ctx := context.Request.Context()
+	now := limiter.now()
+	failures, err := limiter.store.Fail(ctx, "fail:"+ip, limiter.banWindow, now)
+	if err == nil && failures >= limiter.banAfter {
+		err = limiter.store.Ban(ctx, "ban:"+ip, limiter.banFor, now)
+		if err == nil {
+			BANS.Inc()
+			slog.WarnContext(ctx, "Banned client after repeated failures", "client_ip", ip, "failures", failures, "duration", limiter.banFor.String())
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Could not record failure in rate limiter", "error", err)
+	}
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket is back at its burst, after that it can be forgotten
+	full time.Time
+}
+
+type failureWindow struct {
+	count int
+	ends  time.Time
+}
+
+type memoryLimiterStore struct {
+	mutex    sync.Mutex
+	buckets  map[string]*tokenBucket
+	failures map[string]*failureWindow
+	bans     map[string]time.Time
+	swept    time.Time
+}
+
+func newMemoryLimiterStore() *memoryLimiterStore {
+	return &memoryLimiterStore{
+		buckets:  map[string]*tokenBucket{},
+		failures: map[string]*failureWindow{},
+		bans:     map[string]time.Time{},
+	}
+}
+
+func (store *memoryLimiterStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (time.Duration, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.sweep(now)
+
+	bucket, exists := store.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		store.buckets[key] = bucket
+	}
+	bucket.tokens = min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*limit.tokensPerSecond())
+	bucket.updated = now
+	wait := time.Duration(0)
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+	} else {
+		wait = time.Duration((1 - bucket.tokens) / limit.tokensPerSecond() * float64(time.Second))
+	}
+	bucket.full = now.Add(time.Duration((float64(limit.Burst) - bucket.tokens) / limit.tokensPerSecond() * float64(time.Second)))
+	return wait, nil
+}
+
+func (store *memoryLimiterStore) Fail(ctx context.Context, key string, window time.Duration, now time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	failures, exists := store.failures[key]
+	if !exists || !now.Before(failures.ends) {
+		failures = &failureWindow{ends: now.Add(window)}
+		store.failures[key] = failures
+	}
+	failures.count++
+	return failures.count, nil
+}
+
+func (store *memoryLimiterStore) Ban(ctx context.Context, key string, duration time.Duration, now time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.bans[key] = now.Add(duration)
+	return nil
+}
+
+func (store *memoryLimiterStore) Banned(ctx context.Context, key string, now time.Time) (time.Duration, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return max(0, store.bans[key].Sub(now)), nil
+}
+
+// sweep forgets full buckets, closed failure windows and lifted bans once a minute, so a flood of
+// different addresses does not pile up in memory. A bucket that is full again is the same as a new one.
+func (store *memoryLimiterStore) sweep(now time.Time) {
+	if now.Sub(store.swept) < time.Minute {
+		return
+	}
+	store.swept = now
+	for key, bucket := range store.buckets {
+		if now.After(bucket.full) {
+			delete(store.buckets, key)
+		}
+	}
+	for key, failures := range store.failures {
+		if !now.Before(failures.ends) {
+			delete(store.failures, key)
+		}
+	}
+	for key, until := range store.bans {
+		if !now.Before(until) {
+			delete(store.bans, key)
+		}
+	}
+}
+
+// takeScript refills and takes from a token bucket in one step, so instances can not race each other
+var takeScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) / 1000 * rate)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000))
+return wait
+`)
+
+// redisLimiterStore shares the limits between instances, keys are prefixed so the database can be shared
+type redisLimiterStore struct {
+	client *redis.Client
+}
+
+const redisKeyPrefix = "backend:ratelimit:"
+
+func (store *redisLimiterStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (time.Duration, error) {
+	wait, err := takeScript.Run(ctx, store.client, []string{redisKeyPrefix + key}, limit.Burst, limit.tokensPerSecond(), now.UnixMilli()).Int64()
+	return time.Duration(wait) * time.Millisecond, err
+}
+
+func (store *redisLimiterStore) Fail(ctx context.Context, key string, window time.Duration, now time.Time) (int, error) {
+	pipeline := store.client.TxPipeline()
+	count := pipeline.Incr(ctx, redisKeyPrefix+key)
+	pipeline.ExpireNX(ctx, redisKeyPrefix+key, window)
+	if _, err := pipeline.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return int(count.Val()), nil
+}
+
+func (store *redisLimiterStore) Ban(ctx context.Context, key string, duration time.Duration, now time.Time) error {
+	return store.client.Set(ctx, redisKeyPrefix+key, now.Add(duration).UnixMilli(), duration).Err()
+}
+
+func (store *redisLimiterStore) Banned(ctx context.Context, key string, now time.Time) (time.Duration, error) {
+	until, err := store.client.Get(ctx, redisKeyPrefix+key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return max(0, time.UnixMilli(until).Sub(now)), nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// ---
+// regexes for personal data that can show up in free text, like error messages
+// ---
+var (
+	EmailAddressRegex *regexp.Regexp = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+	IBANRegex         *regexp.Regexp = regexp.MustCompile(`\b[A-Za-z]{2}[0-9]{2}(?: ?[A-Za-z0-9]){11,30}\b`)
+	DateRegex         *regexp.Regexp = regexp.MustCompile(`\b(?:\d{4}[-/.]\d{1,2}[-/.]\d{1,2}|\d{1,2}[-/.]\d{1,2}[-/.]\d{4})\b`)
+	// numbers dialed with a country code (+31 or 0031) or the 0 of a national number, like 06-12345678. Other
+	// runs of digits, like counters, byte sizes and timestamps, never start with a 0 or a +.
+	PhoneNumberRegex *regexp.Regexp = regexp.MustCompile(`(?:\+|\b00)[1-9](?:[ \-]?[0-9]){7,14}\b|\b0[1-9](?:[ \-]?[0-9]){7,8}\b`)
+)
+
+// redaction modes
+const (
+	// redactMask keeps a few characters, enough to recognise a value you already know
+	redactMask = "mask"
+	// redactFull replaces the value with the kind of data it was
+	redactFull = "full"
+	// redactOff logs everything as is, only meant for a developer machine
+	redactOff = "off"
+)
+
+// attribute keys whose values are always replaced completely: every field of PISignUp (by its json name,
+// so new fields are covered too), plus the keys we have used for recipients.
+// Free text is scanned with the regexes above instead.
+var personalLogKeys = append(jsonFieldNames(PISignUp{}), "name", "to")
+
+// keys that never contain personal data but could trip the regexes, like request IDs full of digits
+// and signup IDs, random hex that easily starts like an IBAN
+var trustedLogKeys = map[string]bool{
+	"request_id": true,
+	"time":       true,
+	"id":         true,
+	"duplicates": true,
+}
+
+// RedactionPolicy decides how personal data is removed from log output
+type RedactionPolicy struct {
+	Mode string
+	Keys map[string]bool
+}
+
+func jsonFieldNames(value any) []string {
+	var names []string
+	fields := reflect.TypeOf(value)
+	for i := 0; i < fields.NumField(); i++ {
+		name, _, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func newRedactionPolicy(mode string, extraKeys []string) RedactionPolicy {
+	policy := RedactionPolicy{Mode: mode, Keys: map[string]bool{}}
+	for _, key := range personalLogKeys {
+		policy.Keys[key] = true
+	}
+	for _, key := range extraKeys {
+		policy.Keys[strings.ToLower(key)] = true
+	}
+	return policy
+}
+
+// redactingHandler scrubs the message and every attribute of a record before passing it on
+type redactingHandler struct {
+	slog.Handler
+	policy RedactionPolicy
+}
+
+func newRedactingHandler(handler slog.Handler, policy RedactionPolicy) slog.Handler {
+	if policy.Mode == redactOff {
+		return handler
+	}
+	return redactingHandler{handler, policy}
+}
+
+func (handler redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, handler.policy.redactText(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(handler.policy.redactAttr(attr))
+		return true
+	})
+	return handler.Handler.Handle(ctx, redacted)
+}
+
+func (handler redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = handler.policy.redactAttr(attr)
+	}
+	return redactingHandler{handler.Handler.WithAttrs(redacted), handler.policy}
+}
+
+func (handler redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{handler.Handler.WithGroup(name), handler.policy}
+}
+
+func (policy RedactionPolicy) redactAttr(attr slog.Attr) slog.Attr {
+	attr.Value = attr.Value.Resolve()
+	key := strings.ToLower(attr.Key)
+
+	switch {
+	case trustedLogKeys[key]:
+		return attr
+	case policy.Keys[key]:
+		return slog.String(attr.Key, "[redacted]")
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, policy.redactText(attr.Value.String()))
+	case slog.KindGroup:
+		group := attr.Value.Group()
+		redacted := make([]any, len(group))
+		for i, member := range group {
+			redacted[i] = policy.redactAttr(member)
+		}
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindAny:
+		// errors, structs and maps are flattened to text, otherwise the JSON handler would print their fields as is
+		return slog.String(attr.Key, policy.redactText(fmt.Sprintf("%+v", attr.Value.Any())))
+	default:
+		return attr
+	}
+}
+
+func (policy RedactionPolicy) redactText(text string) string {
+	text = EmailAddressRegex.ReplaceAllStringFunc(text, policy.replacer("email", maskEmail))
+	text = IBANRegex.ReplaceAllStringFunc(text, policy.replacer("iban", maskIBAN))
+	text = DateRegex.ReplaceAllStringFunc(text, policy.replacer("date", maskDate))
+	text = PhoneNumberRegex.ReplaceAllStringFunc(text, policy.replacer("phone", maskPhoneNumber))
+	return text
+}
+
+func (policy RedactionPolicy) replacer(kind string, mask func(string) string) func(string) string {
+	if policy.Mode == redactMask {
+		return mask
+	}
+	return func(string) string {
+		return "[" + kind + "]"
+	}
+}
+
+// ---
+// masks, these keep just enough to tell two values apart when you already know them
+// ---
+
+// maskEmail turns jandevries@example.org into j***@***.org
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	dot := strings.LastIndex(email, ".")
+	if at < 1 || dot < at {
+		return "[email]"
+	}
+	return email[:1] + "***@***" + email[dot:]
+}
+
+// maskIBAN turns NL18RABO0123459876 into NL**************76
+func maskIBAN(iban string) string {
+	iban = strings.ReplaceAll(iban, " ", "")
+	return iban[:2] + strings.Repeat("*", len(iban)-4) + iban[len(iban)-2:]
+}
+
+// maskPhoneNumber turns +31612345678 into +31*******78
+func maskPhoneNumber(number string) string {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(number)
+	prefix := ""
+	if strings.HasPrefix(digits, "+") {
+		prefix, digits = "+", digits[1:]
+	}
+	if len(digits) < 6 {
+		return "[phone]"
+	}
+	return prefix + digits[:2] + strings.Repeat("*", len(digits)-4) + digits[len(digits)-2:]
+}
+
+// maskDate hides the whole date, a partial birth date is still a birth date
+func maskDate(string) string {
+	return "****-**-**"
+}
+
+// LogValue keeps a signup out of the logs when it is passed to slog as a whole,
+// the request ID already tells which signup a log line is about
+func (member PISignUp) LogValue() slog.Value {
+	return slog.StringValue("[redacted signup]")
+}
+
+// String does the same for fmt, so a stray %v in a log message can not leak a signup either
+func (member PISignUp) String() string {
+	return "[redacted signup]"
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// purge modes
+const (
+	purgeDelete    = "delete"
+	purgeAnonymize = "anonymize"
+)
+
+// RetentionPolicy says how long a signup is kept after its last status change, per status.
+// A status without a period (or a period of 0) is kept forever.
+type RetentionPolicy struct {
+	Periods map[SignupStatus]time.Duration
+	Mode    string
+}
+
+type PurgedSignup struct {
+	ID        string       `json:"id"`
+	Status    SignupStatus `json:"status"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+type PurgeReport struct {
+	DryRun  bool           `json:"dry_run"`
+	Mode    string         `json:"mode"`
+	Signups []PurgedSignup `json:"signups"`
+}
+
+func retentionPolicyFromConfig(config Config) RetentionPolicy {
+	return RetentionPolicy{
+		Periods: map[SignupStatus]time.Duration{
+			StatusReceived:  config.RetainReceived,
+			StatusProcessed: config.RetainProcessed,
+			StatusRejected:  config.RetainRejected,
+			StatusAbandoned: config.RetainAbandoned,
+		},
+		Mode: config.PurgeMode,
+	}
+}
+
+// expired tells whether the signup outlived the retention period of its status.
+// Anonymized signups hold nothing personal anymore and stay for the statistics.
+func (policy RetentionPolicy) expired(signup StoredSignup, now time.Time) bool {
+	period := policy.Periods[signup.Status]
+	return !signup.Anonymized && period > 0 && now.Sub(signup.UpdatedAt) > period
+}
+
+// purgeExpiredSignups deletes or anonymizes every signup past its retention period. With dryRun it only reports
+// what it would remove. Mail is sent while handling the signup, so there are no queued emails to remove.
+func purgeExpiredSignups(policy RetentionPolicy, dryRun bool, actor string) (PurgeReport, error) {
+	report := PurgeReport{DryRun: dryRun, Mode: policy.Mode, Signups: []PurgedSignup{}}
+	now := time.Now()
+	expired := func(signup StoredSignup) bool {
+		return policy.expired(signup, now)
+	}
+
+	var signups []StoredSignup
+	var err error
+	switch {
+	case dryRun:
+		signups, err = SIGNUP_STORE.All()
+		signups = slices.DeleteFunc(signups, func(signup StoredSignup) bool { return !expired(signup) })
+	case policy.Mode == purgeAnonymize:
+		// the store checks again under its lock, a signup the secretary handled meanwhile is left alone
+		signups, err = SIGNUP_STORE.AnonymizeFunc(expired)
+	default:
+		signups, err = SIGNUP_STORE.DeleteFunc(expired)
+	}
+	if err != nil {
+		return report, err
+	}
+	for _, signup := range signups {
+		report.Signups = append(report.Signups, PurgedSignup{ID: signup.ID, Status: signup.Status, UpdatedAt: signup.UpdatedAt})
+	}
+	if dryRun || len(signups) == 0 {
+		return report, nil
+	}
+	return report, AUDIT_LOG.Record(AuditEntry{Action: auditPurge, Actor: actor, Records: len(signups), Details: policy.Mode})
+}
+
+// startPurgeSchedule purges expired signups right away and then every interval, until stop is called
+func startPurgeSchedule(policy RetentionPolicy, interval time.Duration, dryRun bool) (stop func()) {
+	done := make(chan struct{})
+	if interval <= 0 {
+		return func() {}
+	}
+
+	purge := func() {
+		report, err := purgeExpiredSignups(policy, dryRun, "schedule")
+		if err != nil {
+			slog.Error("Scheduled purge failed", "error", err)
+			return
+		}
+		if len(report.Signups) > 0 {
+			slog.Info("Purged expired signups", "count", len(report.Signups), "mode", report.Mode, "dry_run", report.DryRun)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		purge()
+		for {
+			select {
+			case <-ticker.C:
+				purge()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// headerOff leaves a security header out
+const headerOff = "off"
+
+// SecurityHeaders are the headers every response gets, a header set to off is left out
+type SecurityHeaders struct {
+	// HSTSMaxAge is how long browsers only use HTTPS for us, 0 leaves the header out
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+	ContentSecurityPolicy string
+	ReferrerPolicy        string
+	PermissionsPolicy     string
+}
+
+// securityHeaders is the middleware that sets the SecurityHeaders on every response
+func securityHeaders(headers SecurityHeaders) gin.HandlerFunc {
+	values := map[string]string{"X-Content-Type-Options": "nosniff"}
+	if headers.HSTSMaxAge > 0 {
+		hsts := "max-age=" + strconv.FormatInt(int64(headers.HSTSMaxAge/time.Second), 10)
+		if headers.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if headers.HSTSPreload {
+			hsts += "; preload"
+		}
+		values["Strict-Transport-Security"] = hsts
+	}
+	for name, value := range map[string]string{
+		"Content-Security-Policy": headers.ContentSecurityPolicy,
+		"Referrer-Policy":         headers.ReferrerPolicy,
+		"Permissions-Policy":      headers.PermissionsPolicy,
+	} {
+		if value != "" && value != headerOff {
+			values[name] = value
+		}
+	}
+
+	return func(context *gin.Context) {
+		for name, value := range values {
+			context.Header(name, value)
+		}
+		context.Next()
+	}
+}
+
+const (
+	adminSessionCookie = "admin_session"
+	csrfHeader         = "X-CSRF-Token"
+	adminCookieKey     = "admin_cookie"
+)
+
+// AdminSessions lets the admin page log in once with the ADMIN_TOKEN and then use a cookie, so the token
+// does not have to be kept in the browser. Sessions are signed with a key derived from the token, changing
+// ADMIN_TOKEN ends all of them.
+//
+// Browsers send cookies along with requests other sites make, so requests that change something and are
+// authenticated with the cookie also need the CSRF token: a signature over the session, handed to the admin
+// page when it logs in. Other sites can make the browser send the cookie, but can not read the token.
+type AdminSessions struct {
+	key []byte
+	ttl time.Duration
+	now func() time.Time
+}
+
+func newAdminSessions(token string, ttl time.Duration) *AdminSessions {
+	key := hmac.New(sha256.New, []byte(token))
+	key.Write([]byte("admin-session"))
+	return &AdminSessions{key: key.Sum(nil), ttl: ttl, now: time.Now}
+}
+
+func (sessions *AdminSessions) sign(purpose, value string) string {
+	signer := hmac.New(sha256.New, sessions.key)
+	signer.Write([]byte(purpose + ":" + value))
+	return hex.EncodeToString(signer.Sum(nil))
+}
+
+// issue returns a new session like <nonce>.<expiry>.<signature> and its CSRF token
+func (sessions *AdminSessions) issue() (session, csrf string) {
+	value := randomHex(16) + "." + strconv.FormatInt(sessions.now().Add(sessions.ttl).Unix(), 10)
+	session = value + "." + sessions.sign("session", value)
+	return session, sessions.sign("csrf", session)
+}
+
+func (sessions *AdminSessions) valid(session string) bool {
+	dot := strings.LastIndex(session, ".")
+	if dot < 0 || !hmac.Equal([]byte(sessions.sign("session", session[:dot])), []byte(session[dot+1:])) {
+		return false
+	}
+	_, expiry, _ := strings.Cut(session[:dot], ".")
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && sessions.now().Before(time.Unix(expires, 0))
+}
+
+func setSessionCookie(context *gin.Context, session string, maxAge int) {
+	context.SetSameSite(http.SameSiteStrictMode)
+	context.SetCookie(adminSessionCookie, session, maxAge, "/api/admin", "", true, true)
+}
+
+// handleLogin starts a session for a request authenticated with the bearer token
+func (sessions *AdminSessions) handleLogin(context *gin.Context) {
+	session, csrf := sessions.issue()
+	setSessionCookie(context, session, int(sessions.ttl/time.Second))
+	context.JSON(http.StatusOK, gin.H{"csrf_token": csrf, "expires_in": int(sessions.ttl / time.Second)})
+}
+
+func handleLogout(context *gin.Context) {
+	setSessionCookie(context, "", -1)
+	context.Status(http.StatusNoContent)
+}
+
+// requireCSRFToken checks the CSRF token of requests that are authenticated with the session cookie and can
+// change something. Requests with the bearer token can not be forged by another site, browsers do not add it.
+func (sessions *AdminSessions) requireCSRFToken(context *gin.Context) {
+	session, cookie := context.Get(adminCookieKey)
+	safe := context.Request.Method == http.MethodGet || context.Request.Method == http.MethodHead
+	if cookie && !safe && !hmac.Equal([]byte(context.GetHeader(csrfHeader)), []byte(sessions.sign("csrf", session.(string)))) {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"Errors": []string{"CSRF token missing or invalid"}})
+		return
+	}
+	context.Next()
+}
@@ -2,62 +2,106 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gocarina/gocsv"
 	"github.com/wneessen/go-mail"
 )
 
-func SendMemberInfoEmail(member PISignUp, serverEmailCredentials ServerEmailCredentials, correspondanceEmail string) error {
+func SendMemberInfoEmail(ctx context.Context, member PISignUp, duplicates []DuplicateMatch, serverEmailCredentials ServerEmailCredentials, correspondanceEmail string) error {
 	if gin.Mode() == gin.TestMode {
-		log.Println("Testing mode: email will not be sent")
+		slog.InfoContext(ctx, "Testing mode: email will not be sent")
 		return nil
 	}
 
-	// Write member info to a CSV file
-	csvBytes, err := WriteToCSV(member)
+	m, err := newMemberInfoMessage(ctx, member, duplicates, serverEmailCredentials.email, correspondanceEmail)
+	if err != nil {
+		return err
+	}
+
+	// Send the email
+	err = SendEmail(ctx, serverEmailCredentials, emailMemberInfo, m)
+	EMAILS_SENT.WithLabelValues(emailMemberInfo, resultLabel(err)).Inc()
 	if err != nil {
+		slog.ErrorContext(ctx, "Error sending email to contact email", "error", err)
 		return err
 	}
 
+	slog.InfoContext(ctx, "Email to contact sent")
+	return nil
+}
+
+// newMemberInfoMessage builds the mail to the secretary with the signup attached as CSV. With an
+// ATTACHMENT_SEALER the attachment is encrypted and the subject leaves out the name of the member,
+// so nothing personal is readable without the key. Signups that look like earlier ones are marked in the subject.
+func newMemberInfoMessage(ctx context.Context, member PISignUp, duplicates []DuplicateMatch, from string, to string) (*mail.Msg, error) {
+	// Write member info to a CSV file
+	csvBytes, err := WriteToCSV(ctx, member)
+	if err != nil {
+		return nil, err
+	}
+	attachmentName, attachment, err := ATTACHMENT_SEALER.seal("nieuw_lid.csv", csvBytes)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error encrypting csv", "error", err)
+		return nil, err
+	}
+
 	// Create a new email message
 	m := mail.NewMsg()
 
 	// Set sender and recipient
-	m.From(serverEmailCredentials.email)
-	m.To(correspondanceEmail)
+	m.From(from)
+	m.To(to)
 
 	// Set subject and body
-	m.Subject(fmt.Sprintf("[Server] Nieuwe aanmelding lid: %s", getFullName(member)))
-	m.SetBodyString(mail.TypeTextPlain, "Nieuw lid aangemeld, zie bijlage.")
+	subject, body := "[Server] Nieuwe aanmelding lid", "Nieuw lid aangemeld, zie bijlage."
+	if ATTACHMENT_SEALER != nil {
+		body = "Nieuw lid aangemeld, zie de versleutelde bijlage."
+	} else {
+		subject += ": " + getFullName(member)
+	}
+	if len(duplicates) > 0 {
+		subject += " (mogelijk dubbel)"
+		body += "\n\n" + describeDuplicates(duplicates)
+	}
+	m.Subject(subject)
+	m.SetBodyString(mail.TypeTextPlain, body)
 
 	// Attach the CSV file
-	m.AttachReader("nieuw_lid.csv", bytes.NewReader(csvBytes))
+	m.AttachReader(attachmentName, bytes.NewReader(attachment))
+	return m, nil
+}
+
+func SendNotificationEmail(ctx context.Context, member PISignUp, serverEmailCredentials ServerEmailCredentials, correspondanceEmail string) error {
+	if gin.Mode() == gin.TestMode || gin.Mode() == gin.DebugMode {
+		slog.InfoContext(ctx, "Testing or debug mode: email will not be sent")
+		return nil
+	}
+
+	m := newConfirmationMessage(member, serverEmailCredentials.email, correspondanceEmail)
 
 	// Send the email
-	err = SendEmail(serverEmailCredentials, m)
+	err := SendEmail(ctx, serverEmailCredentials, emailConfirmation, m)
+	EMAILS_SENT.WithLabelValues(emailConfirmation, resultLabel(err)).Inc()
 	if err != nil {
-		log.Println("Error sending email to contact email:", err)
+		slog.ErrorContext(ctx, "Error writing confirmation email", "error", err)
 		return err
 	}
 
-	log.Println("Email to contact sent")
+	slog.InfoContext(ctx, "Confirmation email sent")
 	return nil
 }
 
-func SendNotificationEmail(member PISignUp, serverEmailCredentials ServerEmailCredentials, correspondanceEmail string) error {
-	if gin.Mode() == gin.TestMode || gin.Mode() == gin.DebugMode {
-		log.Println("Testing or debug mode: email will not be sent")
-		return nil
-	}
-
+// newConfirmationMessage builds the mail that confirms the signup to the member
+func newConfirmationMessage(member PISignUp, from string, correspondanceEmail string) *mail.Msg {
 	// Create a new email message
 	m := mail.NewMsg()
 
 	// Set sender and recipient
-	m.From(serverEmailCredentials.email)
+	m.From(from)
 	m.To(member.Email)
 
 	// Set subject and body
@@ -67,23 +111,15 @@ func SendNotificationEmail(member PISignUp, serverEmailCredentials ServerEmailCr
 		correspondanceEmail,
 	)
 	m.SetBodyString(mail.TypeTextPlain, body)
-
-	// Send the email
-	err := SendEmail(serverEmailCredentials, m)
-	if err != nil {
-		log.Println("Error writing confirmation email to", member.Email, err)
-		return err
-	}
-
-	log.Println("Confirmation email sent")
-	return nil
+	return m
 }
 
-func SendEmail(serverEmailCredentials ServerEmailCredentials, message *mail.Msg) error {
+// SendEmail sends the message, signed with DKIM and/or S/MIME when MAIL_SIGNER is configured for messageType
+func SendEmail(ctx context.Context, serverEmailCredentials ServerEmailCredentials, messageType string, message *mail.Msg) error {
 	// Configure the email client
 	client, err := mail.NewClient(
-		"smtp.office365.com",
-		mail.WithPort(587),
+		CONFIG.SMTPHost,
+		mail.WithPort(CONFIG.SMTPPort),
 		mail.WithSMTPAuth(mail.SMTPAuthLogin),
 		mail.WithUsername(serverEmailCredentials.email),
 		mail.WithPassword(serverEmailCredentials.password),
@@ -93,24 +129,38 @@ func SendEmail(serverEmailCredentials ServerEmailCredentials, message *mail.Msg)
 		return fmt.Errorf("error creating mail client: %w", err)
 	}
 
-	// Send the email
-	if err := client.DialAndSend(message); err != nil {
+	// Send the email. A visitor closing the tab halfway must not stop the mail to the secretary,
+	// so only the values of the request context are kept, not its cancellation.
+	ctx = context.WithoutCancel(ctx)
+	if MAIL_SIGNER.signsDKIM(messageType) {
+		var rendered []byte
+		rendered, err = MAIL_SIGNER.render(message, messageType)
+		if err == nil {
+			err = sendRendered(ctx, client, message, rendered)
+		}
+	} else {
+		err = MAIL_SIGNER.signSMIME(message, messageType)
+		if err == nil {
+			err = client.DialAndSendWithContext(ctx, message)
+		}
+	}
+	if err != nil {
 		return fmt.Errorf("error sending email: %w", err)
 	}
 
 	return nil
 }
 
-func WriteToCSV(member PISignUp) ([]byte, error) {
+func WriteToCSV(ctx context.Context, member PISignUp) ([]byte, error) {
 	array := []*PISignUpExport{}
 	array = append(array, member.ToPISignUpExport())
 	csvBytes, err := gocsv.MarshalBytes(array)
 
 	if err != nil {
-		log.Println("Error writing csv:", err)
+		slog.ErrorContext(ctx, "Error writing csv", "error", err)
 		return nil, err
 	}
-	log.Println("CSV file created successfully")
+	slog.DebugContext(ctx, "CSV file created successfully")
 	return csvBytes, nil
 }
 
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+)
+
+const unixSocketPrefix = "unix:"
+
+func newHTTPServer(handler http.Handler, config Config) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+}
+
+// listen opens the configured address. Addresses starting with "unix:" are treated as a Unix socket path,
+// a socket left behind by a previous run that did not shut down cleanly is removed first.
+func listen(address string) (net.Listener, error) {
+	if path, isUnix := strings.CutPrefix(address, unixSocketPrefix); isUnix {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", address)
+}
+
+// endpoint is a server and the listener it serves on
+type endpoint struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// serve runs the servers until one fails or the process receives SIGINT or SIGTERM. Servers with a
+// TLSConfig speak HTTPS. On a signal they stop accepting connections and wait for in-flight requests to
+// finish, signups send their emails inside the request so those are flushed as well.
+func serve(config Config, endpoints ...endpoint) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, len(endpoints))
+	for _, endpoint := range endpoints {
+		go func() {
+			if endpoint.server.TLSConfig != nil {
+				// the certificate comes from TLSConfig.GetCertificate
+				serveErr <- endpoint.server.ServeTLS(endpoint.listener, "", "")
+			} else {
+				serveErr <- endpoint.server.Serve(endpoint.listener)
+			}
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+		// a second signal kills the process the default way
+		stop()
+		slog.Info("Shutting down, waiting for in-flight requests", "timeout", config.ShutdownTimeout.String())
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	for _, endpoint := range endpoints {
+		if shutdownErr := endpoint.server.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	if err == nil {
+		slog.Info("Server stopped")
+	}
+	return err
+}
+
+// limitRequestBody caps the size of every request body, handlers get an error when they read past it
+func limitRequestBody(maxBytes int64) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if context.Request.Body != nil {
+			context.Request.Body = http.MaxBytesReader(context.Writer, context.Request.Body, maxBytes)
+		}
+		context.Next()
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed templates static
+var pageFiles embed.FS
+
+// bundledAltchaWidget is where the Altcha widget in static/ is served, so the page does not depend on a CDN.
+// It is the widget go-altcha ships, see static/altcha-0.1.5.license.txt.
+const bundledAltchaWidget = "/aanmelden/altcha-0.1.5.min.js"
+
+var signupTemplate = template.Must(template.ParseFS(pageFiles, "templates/signup.html"))
+
+const fieldErrorsKey = "field_errors"
+
+// formField is an input of the signup page, named after the JSON field of PISignUp it fills in
+type formField struct {
+	Name         string
+	Label        string
+	Type         string
+	Autocomplete string
+	Placeholder  string
+	Required     bool
+	Options      []formOption
+}
+
+type formOption struct {
+	Value string
+	Label string
+}
+
+type formSection struct {
+	Title  string
+	Fields []formField
+}
+
+// signupForm is the form of the signup page, the same fields the frontend asks for
+var signupForm = []formSection{
+	{"Over jou", []formField{
+		{Name: "legal_first_names", Label: "Voornamen (zoals in je paspoort)", Type: "text", Autocomplete: "given-name", Required: true},
+		{Name: "nickname", Label: "Roepnaam", Type: "text", Autocomplete: "nickname", Required: true},
+		{Name: "infix", Label: "Tussenvoegsel", Type: "text", Autocomplete: "additional-name"},
+		{Name: "surname", Label: "Achternaam", Type: "text", Autocomplete: "family-name", Required: true},
+		{Name: "date_of_birth", Label: "Geboortedatum", Type: "date", Autocomplete: "bday", Required: true},
+		{Name: "email", Label: "E-mailadres", Type: "email", Autocomplete: "email", Required: true},
+		{Name: "phone", Label: "Telefoonnummer", Type: "tel", Autocomplete: "tel", Placeholder: "+31612345678", Required: true},
+	}},
+	{"Adres", []formField{
+		{Name: "address", Label: "Straat en huisnummer", Type: "text", Autocomplete: "street-address", Required: true},
+		{Name: "postal_code", Label: "Postcode", Type: "text", Autocomplete: "postal-code", Placeholder: "1234AB", Required: true},
+		{Name: "city", Label: "Woonplaats", Type: "text", Autocomplete: "address-level2", Required: true},
+		{Name: "country", Label: "Land", Type: "select", Required: true, Options: []formOption{{"NL", "Nederland"}, {"BE", "België"}}},
+	}},
+	{"Opleiding", []formField{
+		{Name: "education", Label: "Opleiding", Type: "select", Required: true, Options: []formOption{{"TI", "Technische Informatica"}, {"I", "Informatica"}}},
+		{Name: "cohort_year", Label: "Cohortjaar", Type: "text", Placeholder: "2024/2025", Required: true},
+	}},
+	{"Noodcontact", []formField{
+		{Name: "emergency_contact_first_name", Label: "Voornaam", Type: "text", Required: true},
+		{Name: "emergency_contact_infix", Label: "Tussenvoegsel", Type: "text"},
+		{Name: "emergency_contact_surname", Label: "Achternaam", Type: "text", Required: true},
+		{Name: "emergency_contact_phone_number", Label: "Telefoonnummer", Type: "tel", Placeholder: "+31687654321", Required: true},
+	}},
+	{"Contributie", []formField{
+		{Name: "iban", Label: "IBAN", Type: "text", Autocomplete: "off", Placeholder: "NL18RABO0123459876", Required: true},
+		{Name: "account_holder", Label: "Naam rekeninghouder", Type: "text", Autocomplete: "cc-name", Required: true},
+		{Name: "accept_contribution", Label: "Ik machtig de vereniging om de contributie jaarlijks af te schrijven", Type: "checkbox", Required: true},
+		{Name: "accept_terms_and_conditions", Label: "Ik ga akkoord met de algemene voorwaarden", Type: "checkbox", Required: true},
+	}},
+}
+
+// signupPageData is what the template of the signup page shows
+type signupPageData struct {
+	Sections    []formSection
+	Values      map[string]string
+	FieldErrors map[string]string
+	Errors      []string
+	Success     bool
+	FormToken   string
+	WidgetURL   string
+	// WidgetIntegrity makes the browser refuse a widget that was changed
+	WidgetIntegrity string
+	// DelayedSolution is the captcha for browsers without JavaScript, valid after FallbackDelay seconds
+	DelayedSolution string
+	FallbackDelay   int
+	Contact         string
+}
+
+// SignupPage is a signup form rendered by the server, for when the frontend is broken or its scripts are
+// blocked. It posts to handleSignUp, like the frontend, and shows the errors next to the fields. With
+// JavaScript the Altcha widget solves the captcha, without it the form can carry a delayed solution.
+type SignupPage struct {
+	widgetURL       string
+	widgetIntegrity string
+	fallbackDelay   time.Duration
+	// fallbackLimiter limits how many delayed solutions a client gets, as they skip the work of the captcha
+	fallbackLimiter *RateLimiter
+	// csp lets the page load the widget and post the form, the API itself allows nothing
+	csp string
+}
+
+func newSignupPage(config Config, limiter *RateLimiter) *SignupPage {
+	integrity := config.AltchaWidgetIntegrity
+	if config.AltchaWidgetURL == bundledAltchaWidget && integrity == "" {
+		widget, _ := pageFiles.ReadFile("static/" + path.Base(bundledAltchaWidget))
+		hash := sha512.Sum384(widget)
+		integrity = "sha384-" + base64.StdEncoding.EncodeToString(hash[:])
+	}
+	// only the widget itself may run, not everything else on its host
+	scriptSource := "'self'"
+	if widget, err := url.Parse(config.AltchaWidgetURL); err == nil && widget.Host != "" {
+		scriptSource = widget.Scheme + "://" + widget.Host + widget.EscapedPath()
+	}
+	return &SignupPage{
+		widgetURL:       config.AltchaWidgetURL,
+		widgetIntegrity: integrity,
+		fallbackDelay:   config.CaptchaFallbackDelay,
+		fallbackLimiter: limiter.scoped("fallback", config.CaptchaFallbackPerIP),
+		// the widget styles itself inline and solves the challenge in a worker
+		csp: "default-src 'none'; script-src " + scriptSource + "; style-src 'self' 'unsafe-inline'; img-src 'self' data:; " +
+			"connect-src 'self'; worker-src blob:; form-action 'self'; frame-ancestors 'none'; base-uri 'none'",
+	}
+}
+
+func (page *SignupPage) data(context *gin.Context) signupPageData {
+	data := signupPageData{
+		Sections:        signupForm,
+		Values:          map[string]string{},
+		FieldErrors:     map[string]string{},
+		FormToken:       FORM_TIMER.Issue(),
+		WidgetURL:       page.widgetURL,
+		WidgetIntegrity: page.widgetIntegrity,
+		Contact:         CORRESPONDANCE_EMAIL,
+	}
+	return data
+}
+
+// offerFallback adds a delayed solution to a form that is shown, while the client has not had too many
+func (page *SignupPage) offerFallback(context *gin.Context, data *signupPageData) {
+	if page.fallbackDelay > 0 && page.fallbackLimiter.allow(context) {
+		data.DelayedSolution = context.MustGet(captchaVerifierKey).(CaptchaVerifier).DelayedSolution(page.fallbackDelay)
+		data.FallbackDelay = int(page.fallbackDelay / time.Second)
+	}
+}
+
+func (page *SignupPage) write(context *gin.Context, status int, data signupPageData) {
+	var rendered bytes.Buffer
+	if err := signupTemplate.Execute(&rendered, data); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not render signup page", "error", err)
+		context.String(http.StatusInternalServerError, "De aanmeldpagina is stuk, meld je aan via %s", CORRESPONDANCE_EMAIL)
+		return
+	}
+	context.Header("Content-Security-Policy", page.csp)
+	context.Header("Cache-Control", "no-store")
+	context.Data(status, "text/html; charset=utf-8", rendered.Bytes())
+}
+
+// show serves the empty form
+func (page *SignupPage) show(context *gin.Context) {
+	data := page.data(context)
+	page.offerFallback(context, &data)
+	page.write(context, http.StatusOK, data)
+}
+
+// render turns the JSON answer of handleSignUp, and of the middleware before it, into the page: a thank you
+// when the signup went through, otherwise the form again with what was filled in and the errors.
+func (page *SignupPage) render(context *gin.Context) {
+	writer := &bufferingWriter{ResponseWriter: context.Writer, status: http.StatusOK}
+	context.Writer = writer
+	context.Next()
+	context.Writer = writer.ResponseWriter
+	context.Writer.Header().Del("Content-Type")
+
+	var response struct {
+		Success string
+		Errors  []string
+	}
+	json.Unmarshal(writer.body.Bytes(), &response)
+
+	data := page.data(context)
+	if writer.status < http.StatusBadRequest && response.Success != "" {
+		data.Success = true
+		page.write(context, writer.status, data)
+		return
+	}
+
+	for name, values := range context.Request.PostForm {
+		switch name {
+		case "altcha", "form_token", "website":
+		default:
+			data.Values[name] = values[0]
+		}
+	}
+	if value, exists := context.Get(fieldErrorsKey); exists {
+		for _, failed := range value.([]FieldError) {
+			data.FieldErrors[failed.Field] = failed.Err.Error()
+		}
+	}
+	if len(data.FieldErrors) > 0 {
+		data.Errors = []string{"Niet alle velden zijn goed ingevuld, kijk de gemarkeerde velden na."}
+	} else {
+		data.Errors = response.Errors
+	}
+	if len(data.Errors) == 0 {
+		data.Errors = []string{"Er is iets fout gegaan (" + strconv.Itoa(writer.status) + "), probeer het opnieuw of meld je aan via " + CORRESPONDANCE_EMAIL + "."}
+	}
+	page.offerFallback(context, &data)
+	page.write(context, writer.status, data)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SignupStatus string
+
+const (
+	// StatusReceived is every signup the secretary has not looked at yet
+	StatusReceived  SignupStatus = "received"
+	StatusProcessed SignupStatus = "processed"
+	StatusRejected  SignupStatus = "rejected"
+	StatusAbandoned SignupStatus = "abandoned"
+)
+
+var ErrSignupNotFound = errors.New("signup not found")
+
+type StoredSignup struct {
+	ID        string       `json:"id"`
+	Status    SignupStatus `json:"status"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+	// Anonymized signups only hold the fields kept for statistics
+	Anonymized bool `json:"anonymized,omitempty"`
+	// Envelope is set when the sensitive fields of Member are encrypted, see Crypto.go
+	Envelope *Envelope `json:"encryption,omitempty"`
+	Member   PISignUp  `json:"member"`
+}
+
+// anonymize empties every field except the few in anonymizationKeeps
+func (signup *StoredSignup) anonymize() {
+	signup.Member = anonymizeMember(signup.Member)
+	signup.Anonymized = true
+	signup.Envelope = nil
+}
+
+func validSignupStatus(status SignupStatus) bool {
+	switch status {
+	case StatusReceived, StatusProcessed, StatusRejected, StatusAbandoned:
+		return true
+	}
+	return false
+}
+
+// SignupStore keeps every signup in memory and, when it has a path, in a JSON file.
+// The association gets a few hundred signups a year, so rewriting the whole file on every change is fine.
+// Admin commands change the file from another process, so it is read again whenever it changed on disk, and
+// every method holds an advisory lock on path.lock while it reads, changes and writes it.
+// With a cipher the sensitive fields are encrypted before they are stored, and stay encrypted in everything
+// the store returns. Only admin views and exports decrypt them, with Reveal.
+type SignupStore struct {
+	mutex  sync.Mutex
+	path   string
+	cipher *FieldCipher
+	// read is the file as we last read or wrote it, every save replaces it with a new one
+	read    os.FileInfo
+	signups []StoredSignup
+}
+
+// SIGNUP_STORE is replaced by main with the store at STORE_PATH, tests use this in-memory one
+var SIGNUP_STORE = &SignupStore{}
+
+func openSignupStore(path string, cipher *FieldCipher) (*SignupStore, error) {
+	store := &SignupStore{path: path, cipher: cipher}
+
+	unlock, err := store.lockFile()
+	if err != nil {
+		return store, err
+	}
+	defer unlock()
+
+	_, err = os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, store.save()
+	}
+	return store, store.refresh()
+}
+
+// lock takes the mutex and the lock on the file, and reads the file again when another process changed it.
+// The caller calls unlock when it is done, unless lock returned an error.
+func (store *SignupStore) lock() (unlock func(), err error) {
+	unlock, err = store.lockFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.refresh(); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// lockFile takes the mutex and the advisory lock on path.lock, which the admin commands take as well.
+// path itself is replaced on every save, so it can not hold the lock.
+func (store *SignupStore) lockFile() (unlock func(), err error) {
+	store.mutex.Lock()
+	if store.path == "" {
+		return store.mutex.Unlock, nil
+	}
+
+	file, err := os.OpenFile(store.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		store.mutex.Unlock()
+		return nil, err
+	}
+	if err := lockExclusive(file); err != nil {
+		file.Close()
+		store.mutex.Unlock()
+		return nil, err
+	}
+	return func() {
+		// closing the file releases the lock
+		file.Close()
+		store.mutex.Unlock()
+	}, nil
+}
+
+// commit saves the signups, or puts back those from before the change when that fails, so what is in
+// memory never differs from the file and the change is not written by the next unrelated save
+func (store *SignupStore) commit(before []StoredSignup) error {
+	if err := store.save(); err != nil {
+		store.signups = before
+		return err
+	}
+	return nil
+}
+
+// refresh reads the file again when another process changed it since we last read or wrote it. A save renames
+// a new file over the old one, so that shows even when both happened within the resolution of the clock.
+func (store *SignupStore) refresh() error {
+	if store.path == "" {
+		return nil
+	}
+	info, err := os.Stat(store.path)
+	if err != nil {
+		return err
+	}
+	if store.read != nil && os.SameFile(info, store.read) && info.ModTime().Equal(store.read.ModTime()) {
+		return nil
+	}
+
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		return err
+	}
+	var signups []StoredSignup
+	if err := json.Unmarshal(data, &signups); err != nil {
+		return err
+	}
+	store.signups = signups
+	store.read = info
+	return nil
+}
+
+// save writes to a temporary file first, so a crash halfway never leaves a truncated store behind
+func (store *SignupStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(store.signups)
+	if err != nil {
+		return err
+	}
+	temporary, err := os.CreateTemp(filepath.Dir(store.path), ".signups-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+
+	if _, err := temporary.Write(data); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Chmod(0600); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary.Name(), store.path); err != nil {
+		return err
+	}
+	info, err := os.Stat(store.path)
+	if err != nil {
+		return err
+	}
+	store.read = info
+	return nil
+}
+
+// Add stores a new signup, the captcha payload is dropped as it is worthless once checked
+func (store *SignupStore) Add(member PISignUp) (StoredSignup, error) {
+	unlock, err := store.lock()
+	if err != nil {
+		return StoredSignup{}, err
+	}
+	defer unlock()
+	return store.add(member)
+}
+
+// AddFindingDuplicates stores a new signup like Add and returns the signups before it that look like the same
+// person, see findDuplicates. Both happen under one lock, so two signups sent at the same time see each other.
+func (store *SignupStore) AddFindingDuplicates(member PISignUp) (StoredSignup, []DuplicateMatch, error) {
+	unlock, err := store.lock()
+	if err != nil {
+		return StoredSignup{}, nil, err
+	}
+	defer unlock()
+	earlier, err := store.Reveal(store.signups...)
+	if err != nil {
+		return StoredSignup{}, nil, err
+	}
+	signup, err := store.add(member)
+	return signup, findDuplicates(member, earlier), err
+}
+
+// add stores a new signup, the caller holds the lock
+func (store *SignupStore) add(member PISignUp) (StoredSignup, error) {
+	member.Altcha = ""
+	now := time.Now().UTC()
+	signup := StoredSignup{
+		ID:        randomHex(16),
+		Status:    StatusReceived,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Member:    member,
+	}
+	if store.cipher != nil {
+		if err := store.cipher.seal(&signup); err != nil {
+			return StoredSignup{}, err
+		}
+	}
+	before := store.signups
+	store.signups = append(slices.Clip(store.signups), signup)
+	return signup, store.commit(before)
+}
+
+func (store *SignupStore) All() ([]StoredSignup, error) {
+	unlock, err := store.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return slices.Clone(store.signups), nil
+}
+
+func (store *SignupStore) Get(id string) (StoredSignup, error) {
+	unlock, err := store.lock()
+	if err != nil {
+		return StoredSignup{}, err
+	}
+	defer unlock()
+
+	for _, signup := range store.signups {
+		if signup.ID == id {
+			return signup, nil
+		}
+	}
+	return StoredSignup{}, ErrSignupNotFound
+}
+
+// FindByEmail returns every signup made with the address, ignoring case and surrounding spaces
+func (store *SignupStore) FindByEmail(email string) ([]StoredSignup, error) {
+	unlock, err := store.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	found := []StoredSignup{}
+	for _, signup := range store.signups {
+		if sameEmail(signup.Member.Email, email) {
+			found = append(found, signup)
+		}
+	}
+	return found, nil
+}
+
+// Update applies change to the signup with the given ID and saves the result
+func (store *SignupStore) Update(id string, change func(signup *StoredSignup)) (StoredSignup, error) {
+	unlock, err := store.lock()
+	if err != nil {
+		return StoredSignup{}, err
+	}
+	defer unlock()
+
+	before := slices.Clone(store.signups)
+	for i := range store.signups {
+		if store.signups[i].ID == id {
+			change(&store.signups[i])
+			store.signups[i].UpdatedAt = time.Now().UTC()
+			return store.signups[i], store.commit(before)
+		}
+	}
+	return StoredSignup{}, ErrSignupNotFound
+}
+
+func (store *SignupStore) Delete(ids ...string) error {
+	unlock, err := store.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	before := slices.Clone(store.signups)
+	store.signups = slices.DeleteFunc(store.signups, func(signup StoredSignup) bool {
+		return slices.Contains(ids, signup.ID)
+	})
+	return store.commit(before)
+}
+
+// DeleteFunc removes every signup remove returns true for and returns what it removed. remove sees the
+// signups as they are under the lock, so one that changed since the caller last looked is judged on its change.
+func (store *SignupStore) DeleteFunc(remove func(signup StoredSignup) bool) ([]StoredSignup, error) {
+	unlock, err := store.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	before := slices.Clone(store.signups)
+	var removed []StoredSignup
+	store.signups = slices.DeleteFunc(store.signups, func(signup StoredSignup) bool {
+		if remove(signup) {
+			removed = append(removed, signup)
+			return true
+		}
+		return false
+	})
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	return removed, store.commit(before)
+}
+
+// AnonymizeFunc is DeleteFunc for anonymizing, it returns the signups as they were before
+func (store *SignupStore) AnonymizeFunc(anonymize func(signup StoredSignup) bool) ([]StoredSignup, error) {
+	unlock, err := store.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	before := slices.Clone(store.signups)
+	var anonymized []StoredSignup
+	for i := range store.signups {
+		if anonymize(store.signups[i]) {
+			anonymized = append(anonymized, store.signups[i])
+			store.signups[i].anonymize()
+			store.signups[i].UpdatedAt = time.Now().UTC()
+		}
+	}
+	if len(anonymized) == 0 {
+		return nil, nil
+	}
+	return anonymized, store.commit(before)
+}
+
+// Reveal decrypts the sensitive fields of signups returned by the store, for admin views and exports only
+func (store *SignupStore) Reveal(signups ...StoredSignup) ([]StoredSignup, error) {
+	revealed := make([]StoredSignup, len(signups))
+	for i, signup := range signups {
+		if err := store.cipher.open(&signup); err != nil {
+			return nil, err
+		}
+		revealed[i] = signup
+	}
+	return revealed, nil
+}
+
+// RotateKeys re-encrypts every signup that is stored in plain text or under a key that is no longer the
+// active one. Afterwards the old keys can be removed from ENCRYPTION_KEYS.
+func (store *SignupStore) RotateKeys() (int, error) {
+	if store.cipher == nil {
+		return 0, errors.New("no ENCRYPTION_KEYS configured")
+	}
+	unlock, err := store.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	before := slices.Clone(store.signups)
+	rotated := 0
+	for i := range store.signups {
+		signup := store.signups[i]
+		if signup.Anonymized || !store.cipher.needsRotation(signup) {
+			continue
+		}
+		if err := store.cipher.open(&signup); err != nil {
+			store.signups = before
+			return 0, err
+		}
+		if err := store.cipher.seal(&signup); err != nil {
+			store.signups = before
+			return 0, err
+		}
+		store.signups[i] = signup
+		rotated++
+	}
+	if rotated == 0 {
+		return 0, nil
+	}
+	return rotated, store.commit(before)
+}
+
+// Ping checks that the directory of the store can still be written to, for /readyz
+func (store *SignupStore) Ping() error {
+	if store.path == "" {
+		return nil
+	}
+	temporary, err := os.CreateTemp(filepath.Dir(store.path), ".ping-*")
+	if err != nil {
+		return err
+	}
+	temporary.Close()
+	return os.Remove(temporary.Name())
+}
+
+func sameEmail(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
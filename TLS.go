@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// certificateCheckInterval is how often the certificate files are checked for changes, at most once per handshake
+const certificateCheckInterval = 10 * time.Second
+
+// certificateReloader serves the certificate from TLS_CERT_FILE and TLS_KEY_FILE, and loads it again once
+// the files change, so a renewed certificate is picked up without a restart. A broken renewal keeps the old one.
+type certificateReloader struct {
+	certFile   string
+	keyFile    string
+	checkEvery time.Duration
+	now        func() time.Time
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	// version tells whether the files changed, from their size and modification time
+	version string
+	checked time.Time
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	reloader := &certificateReloader{certFile: certFile, keyFile: keyFile, checkEvery: certificateCheckInterval, now: time.Now}
+	version, err := reloader.fileVersion()
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading TLS certificate: %w", err)
+	}
+	reloader.certificate, reloader.version, reloader.checked = &certificate, version, reloader.now()
+	return reloader, nil
+}
+
+func (reloader *certificateReloader) fileVersion() (string, error) {
+	var version strings.Builder
+	for _, path := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&version, "%d@%d;", info.Size(), info.ModTime().UnixNano())
+	}
+	return version.String(), nil
+}
+
+// GetCertificate is the tls.Config hook that hands out the current certificate
+func (reloader *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	now := reloader.now()
+	if now.Sub(reloader.checked) < reloader.checkEvery {
+		return reloader.certificate, nil
+	}
+	reloader.checked = now
+
+	version, err := reloader.fileVersion()
+	if err != nil || version == reloader.version {
+		return reloader.certificate, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		// the certificate and key may be halfway through being replaced, try again at the next check
+		slog.Error("Could not reload TLS certificate, keeping the current one", "error", err)
+		return reloader.certificate, nil
+	}
+	reloader.certificate, reloader.version = &certificate, version
+	slog.Info("Reloaded TLS certificate", "not_after", certificate.Leaf.NotAfter.String())
+	return reloader.certificate, nil
+}
+
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// cipherSuites looks up the suites by their Go names, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+// Only secure suites can be chosen. They apply to TLS 1.2, Go does not let TLS 1.3 suites be configured.
+func cipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				ids, found = append(ids, suite.ID), true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("TLS_CIPHER_SUITES: %q is not a secure cipher suite", name)
+		}
+	}
+	return ids, nil
+}
+
+// newTLSConfig sets up HTTPS from the TLS_* settings. With ADMIN_CLIENT_CA_FILE clients may present a
+// certificate, which requireClientCertificate demands for the admin API.
+func newTLSConfig(config Config) (*tls.Config, error) {
+	reloader, err := newCertificateReloader(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := cipherSuites(config.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tlsVersions[config.TLSMinVersion],
+		CipherSuites:   suites,
+	}
+
+	if config.AdminClientCAFile != "" {
+		contents, err := os.ReadFile(config.AdminClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		authorities := x509.NewCertPool()
+		if !authorities.AppendCertsFromPEM(contents) {
+			return nil, fmt.Errorf("%s holds no PEM encoded certificates", config.AdminClientCAFile)
+		}
+		tlsConfig.ClientCAs = authorities
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// requireClientCertificate lets requests through that came with a client certificate signed by
+// ADMIN_CLIENT_CA_FILE. The TLS handshake already checked it against the CA.
+func requireClientCertificate(context *gin.Context) {
+	if context.Request.TLS == nil || len(context.Request.TLS.VerifiedChains) == 0 {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"Errors": []string{"client certificate required"}})
+		return
+	}
+	context.Next()
+}
+
+// redirectToHTTPS sends every request to the same host and path on the HTTPS listener
+func redirectToHTTPS(httpsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		host := request.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" {
+			http.Error(writer, "use https", http.StatusBadRequest)
+			return
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(writer, request, "https://"+host+request.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+func (config Config) validateTLS() []error {
+	var errs []error
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		errs = append(errs, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+	if _, known := tlsVersions[config.TLSMinVersion]; !known {
+		errs = append(errs, errors.New("TLS_MIN_VERSION must be 1.2 or 1.3"))
+	}
+	if _, err := cipherSuites(config.TLSCipherSuites); err != nil {
+		errs = append(errs, err)
+	}
+	if config.TLSCertFile == "" && config.HTTPRedirectAddress != "" {
+		errs = append(errs, errors.New("HTTP_REDIRECT_ADDRESS needs TLS_CERT_FILE"))
+	}
+	if config.TLSCertFile == "" && config.AdminClientCAFile != "" {
+		errs = append(errs, errors.New("ADMIN_CLIENT_CA_FILE needs TLS_CERT_FILE, client certificates are checked in the TLS handshake"))
+	}
+	return errs
+}
@@ -4,10 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/mail"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 )
@@ -25,6 +25,16 @@ var (
 	MobilePhoneRegex *regexp.Regexp = regexp.MustCompile(`^\+`)
 )
 
+// ---
+// errors
+// ---
+var (
+	ErrIBANMissing     = errors.New("IBAN-nummer is niet ingevuld")
+	ErrIBANUnavailable = errors.New("kon IBAN niet valideren, probeer het later opnieuw")
+	ErrIBANVerifier    = errors.New("serverfout tijdens het valideren van de IBAN. Neem contact op met de vereniging")
+	ErrIBANInvalid     = errors.New("IBAN is ongeldig: controleer of je alles goed hebt overgenomen")
+)
+
 // ---
 // validation functions
 // ---
@@ -50,7 +60,6 @@ func validatePostalCode(postalCode string) (string, error) {
 func validateDate(dateString string) error {
 	_, err := time.Parse("2006-01-02", dateString)
 	if err != nil {
-		log.Println("Error parsing date:", err)
 		return fmt.Errorf("de datum %s is niet correct", dateString)
 	}
 	return nil
@@ -77,25 +86,77 @@ func validatePhoneNumber(numberString, label string) error {
 func validateIBAN(iban string) error {
 
 	if iban == "" {
-		return errors.New("IBAN-nummer is niet ingevuld")
+		return ErrIBANMissing
 	}
 
+	start := time.Now()
+	defer func() {
+		IBAN_VERIFIER_DURATION.Observe(time.Since(start).Seconds())
+	}()
+
 	resp, err := http.Get("https://openiban.com/validate/" + iban)
 	if err != nil {
-		return errors.New("kon IBAN niet valideren, probeer het later opnieuw")
+		IBAN_VERIFIER_STATUS.record(err)
+		IBAN_VERIFIER_ERRORS.Inc()
+		return ErrIBANUnavailable
 	}
+	defer resp.Body.Close()
 	var ibanval IBANValidationResponse
 
 	err = json.NewDecoder(resp.Body).Decode(&ibanval)
+	IBAN_VERIFIER_STATUS.record(err)
 	if err != nil {
-		return errors.New("serverfout tijdens het valideren van de IBAN. Neem contact op met de vereniging")
+		IBAN_VERIFIER_ERRORS.Inc()
+		return ErrIBANVerifier
 	}
 
 	if ibanval.Valid {
 		return nil
 	}
 
-	return errors.New("IBAN is ongeldig: controleer of je alles goed hebt overgenomen")
+	return ErrIBANInvalid
+}
+
+// ruleVerifierUnavailable is the rule of an IBAN that could not be checked because openiban failed
+const ruleVerifierUnavailable = "verifier_unavailable"
+
+// ibanFailureRule names the rule an IBAN failed on, for the validation metrics
+func ibanFailureRule(err error) string {
+	switch {
+	case errors.Is(err, ErrIBANMissing):
+		return "required"
+	case errors.Is(err, ErrIBANUnavailable), errors.Is(err, ErrIBANVerifier):
+		return ruleVerifierUnavailable
+	default:
+		return "checksum"
+	}
+}
+
+// validateIBANChecksum checks the length and the mod 97 checksum of an IBAN, without asking openiban.
+// It catches typos, openiban also knows which banks and accounts exist.
+func validateIBANChecksum(iban string) error {
+	iban = normalizeIBAN(iban)
+	if iban == "" {
+		return ErrIBANMissing
+	}
+	if len(iban) < 15 || len(iban) > 34 || iban[0] < 'A' || iban[0] > 'Z' || iban[1] < 'A' || iban[1] > 'Z' {
+		return ErrIBANInvalid
+	}
+	remainder := 0
+	for _, r := range iban[4:] + iban[:4] {
+		switch {
+		case r >= '0' && r <= '9':
+			remainder = (remainder*10 + int(r-'0')) % 97
+		case r >= 'A' && r <= 'Z':
+			remainder = (remainder*100 + int(r-'A') + 10) % 97
+		default:
+			return ErrIBANInvalid
+		}
+	}
+	if remainder != 1 {
+		return ErrIBANInvalid
+	}
+	return nil
 }
 
 func validateEmail(email string) error {
@@ -115,3 +176,60 @@ func validateCohortYear(cohortYear string) error {
 
 	return nil
 }
+
+// fieldCheck validates one field of a signup, normalizing it in place, and returns the rule it failed for the metrics
+type fieldCheck func(member *PISignUp, verifyIBAN func(string) error) (rule string, err error)
+
+// signupChecks are the fields the server validates, in the order their errors are reported
+var signupChecks = []struct {
+	field string
+	check fieldCheck
+}{
+	{"postal_code", func(member *PISignUp, _ func(string) error) (string, error) {
+		var err error
+		member.PostalCode, err = validatePostalCode(member.PostalCode)
+		return "format", err
+	}},
+	{"date_of_birth", func(member *PISignUp, _ func(string) error) (string, error) {
+		return "format", validateDate(member.DateOfBirth)
+	}},
+	{"phone", func(member *PISignUp, _ func(string) error) (string, error) {
+		return "format", validatePhoneNumber(member.Phone, "Jouw telefoonnummer")
+	}},
+	{"iban", func(member *PISignUp, verifyIBAN func(string) error) (string, error) {
+		member.IBAN = normalizeIBAN(member.IBAN)
+		err := verifyIBAN(member.IBAN)
+		return ibanFailureRule(err), err
+	}},
+	{"emergency_contact_phone_number", func(member *PISignUp, _ func(string) error) (string, error) {
+		return "format", validatePhoneNumber(member.EmergencyContactPhoneNumber, "Het telefoonnummer van je noodcontact")
+	}},
+	{"email", func(member *PISignUp, _ func(string) error) (string, error) {
+		return "format", validateEmail(member.Email)
+	}},
+	{"cohort_year", func(member *PISignUp, _ func(string) error) (string, error) {
+		return "format", validateCohortYear(member.CohortYear)
+	}},
+}
+
+// FieldError is a field that failed validation
+type FieldError struct {
+	Field string
+	Rule  string
+	Err   error
+}
+
+// validateSignup runs the checks of the fields, or of every field when fields is nil, and normalizes them in
+// member. The IBAN is checked with verifyIBAN: validateIBAN for a signup, validateIBANChecksum while typing.
+func validateSignup(member *PISignUp, fields []string, verifyIBAN func(string) error) []FieldError {
+	var failed []FieldError
+	for _, check := range signupChecks {
+		if fields != nil && !slices.Contains(fields, check.field) {
+			continue
+		}
+		if rule, err := check.check(member, verifyIBAN); err != nil {
+			failed = append(failed, FieldError{Field: check.field, Rule: rule, Err: err})
+		}
+	}
+	return failed
+}
@@ -1,11 +1,54 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/emersion/go-msgauth/dkim"
 	"github.com/gavv/httpexpect/v2"
 	"github.com/gin-gonic/gin"
+	"github.com/k42-software/go-altcha"
+	"github.com/redis/go-redis/v9"
 )
 
 var correctUser = map[string]interface{}{
@@ -30,11 +73,49 @@ var correctUser = map[string]interface{}{
 	"account_holder":                 "B. B. de Tak",
 	"accept_contribution":            "on",
 	"accept_terms_and_conditions":    "on",
+	"altcha":                         testCaptchaSolution,
 }
 
+// testCaptcha is a CaptchaVerifier that hands out one fixed challenge and only accepts testCaptchaSolution,
+// so tests of the signup do not have to do the work of a real challenge
+type testCaptcha struct{}
+
+const testCaptchaSolution = "solution-of-the-test-captcha"
+
+func (testCaptcha) NewChallenge(ip string) AltchaChallenge {
+	return AltchaChallenge{Algorithm: "SHA-256", Challenge: "test-challenge", Salt: "test-salt", Signature: "test-signature"}
+}
+
+func (testCaptcha) DelayedSolution(delay time.Duration) string {
+	return testCaptchaSolution
+}
+
+func (testCaptcha) Verify(payload string) error {
+	if payload != testCaptchaSolution {
+		return ErrCaptchaInvalid
+	}
+	return nil
+}
+
+// testClientAddress is where the requests of getGinHandler come from
+const testClientAddress = "192.0.2.10:40000"
+
 func getGinHandler(t *testing.T) *httpexpect.Expect {
+	return getGinHandlerWithCaptcha(t, testCaptcha{})
+}
+
+func getGinHandlerWithCaptcha(t *testing.T, captcha CaptchaVerifier) *httpexpect.Expect {
 	// Create new gin instance
-	handler := initRouter()
+	router := initRouter(captcha)
+	// the binder leaves the address of the client empty, which the rate limiter does not keep buckets for
+	return expectFor(t, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		request.RemoteAddr = testClientAddress
+		router.ServeHTTP(writer, request)
+	}))
+}
+
+// expectFor sends the requests of the test to handler, without an address for the client like over a Unix socket
+func expectFor(t *testing.T, handler http.Handler) *httpexpect.Expect {
 	// Create httpexpect instance
 	gin.SetMode(gin.TestMode)
 	return httpexpect.WithConfig(httpexpect.Config{
@@ -47,11 +128,11 @@ func getGinHandler(t *testing.T) *httpexpect.Expect {
 			httpexpect.NewDebugPrinter(t, true),
 		},
 	})
-
 }
 
 func TestSignupShouldReturnSuccessWhenUserIsCorrect(t *testing.T) {
 	// Arrange
+	withoutFormToken(t)
 	e := getGinHandler(t)
 
 	// Act & Assert
@@ -64,6 +145,7 @@ func TestSignupShouldReturnSuccessWhenUserIsCorrect(t *testing.T) {
 
 func TestSignupShouldReturnErrorWhenPostalCodeIsInvalid(t *testing.T) {
 	// Arrange
+	withoutFormToken(t)
 	e := getGinHandler(t)
 	userWithIncorrectPostalcodeNumbers := correctUser
 	userWithIncorrectPostalcodeLetters := correctUser
@@ -208,3 +290,2663 @@ func TestValidateCohortYearWithInvalidCohortYearFormat(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestLoadConfigUsesDefaultsWhenEnvironmentIsEmpty(t *testing.T) {
+	config, err := loadConfig()
+	if err != nil || config.ListenAddress != ":3000" {
+		t.FailNow()
+	}
+}
+
+func TestLoadConfigRejectsMalformedValues(t *testing.T) {
+	t.Setenv("HTTP_READ_TIMEOUT", "soon")
+	t.Setenv("HTTP_MAX_BODY_BYTES", "lots")
+
+	_, err := loadConfig()
+	if err == nil {
+		t.FailNow()
+	}
+}
+
+func TestLoadConfigRejectsNegativeTimeouts(t *testing.T) {
+	for _, name := range []string{"HTTP_READ_TIMEOUT", "HTTP_WRITE_TIMEOUT", "HTTP_IDLE_TIMEOUT", "SHUTDOWN_TIMEOUT"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, "-1s")
+
+			if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), name) {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+	t.Setenv("SHUTDOWN_TIMEOUT", "0s")
+	if _, err := loadConfig(); err == nil {
+		t.Fatal("a shutdown without any time for running requests was accepted")
+	}
+}
+
+func TestShutdownWaitsAsLongAsARequestMayTakeByDefault(t *testing.T) {
+	config := defaultConfig()
+
+	if config.ShutdownTimeout < config.WriteTimeout {
+		t.Fatalf("shutdown timeout %v is shorter than the write timeout %v", config.ShutdownTimeout, config.WriteTimeout)
+	}
+}
+
+func TestListenOnUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backend.sock")
+
+	listener, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if listener.Addr().Network() != "unix" {
+		t.FailNow()
+	}
+}
+
+func TestSignupRejectsOversizedBody(t *testing.T) {
+	// Arrange
+	e := getGinHandler(t)
+	oversizedUser := map[string]interface{}{
+		"surname": strings.Repeat("a", int(CONFIG.MaxBodyBytes)),
+	}
+
+	// Act & Assert
+	e.POST("/api/signup").
+		WithJSON(oversizedUser).
+		Expect().
+		Status(http.StatusRequestEntityTooLarge).JSON().Object().
+		Value("error").Object().HasValue("code", "too_large")
+}
+
+func TestRaisedBodyLimitIsNotCappedByTheDecoder(t *testing.T) {
+	useConfig(t, func(config *Config) { config.MaxBodyBytes = 128 << 10 })
+	e := getGinHandler(t)
+
+	e.POST("/api/validate").
+		WithJSON(gin.H{"field": "surname", "value": strings.Repeat("a", 32<<10)}).
+		Expect().
+		Status(http.StatusOK)
+}
+
+func TestSignupRejectsMalformedBodies(t *testing.T) {
+	e := getGinHandler(t)
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		error  map[string]interface{}
+	}{
+		{"unknown field", `{"surname": "tak", "lastname": "tak"}`, http.StatusBadRequest, map[string]interface{}{"code": "unknown_field", "field": "lastname"}},
+		{"wrong type", `{"surname": 12}`, http.StatusBadRequest, map[string]interface{}{"code": "type", "field": "surname"}},
+		{"syntax", `{"surname" "tak"}`, http.StatusBadRequest, map[string]interface{}{"code": "syntax", "offset": 12}},
+		{"cut off", `{"surname": "tak"`, http.StatusBadRequest, map[string]interface{}{"code": "syntax"}},
+		{"two values", `{} {}`, http.StatusBadRequest, map[string]interface{}{"code": "trailing_data"}},
+		{"empty", ``, http.StatusBadRequest, map[string]interface{}{"code": "empty"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e.POST("/api/signup").WithBytes([]byte(test.body)).WithHeader("Content-Type", "application/json; charset=utf-8").
+				Expect().
+				Status(test.status).JSON().Object().
+				Value("error").Object().ContainsSubset(test.error)
+		})
+	}
+}
+
+func TestSignupMustBeJSON(t *testing.T) {
+	e := getGinHandler(t)
+
+	e.POST("/api/signup").WithText(`{"surname": "tak"}`).
+		Expect().
+		Status(http.StatusUnsupportedMediaType).JSON().Object().
+		Value("error").Object().HasValue("code", "unsupported_media_type")
+}
+
+func TestDecodingTrimsAndNormalizesStrings(t *testing.T) {
+	// Arrange
+	var member PISignUp
+	body := "{\"surname\": \"  Te\u0301llez \", \"city\": \"Breda\\n\"}"
+
+	// Act
+	err := decodeStrict(strings.NewReader(body), &struct{ *PISignUp }{&member})
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member.Surname != "T\u00e9llez" || member.City != "Breda" {
+		t.Fatalf("got %q and %q", member.Surname, member.City)
+	}
+}
+
+func TestHTMLFormSignupIsRedirected(t *testing.T) {
+	// Arrange
+	useTestStore(t)
+	useConfig(t, func(config *Config) { config.SignupErrorURL = "/aanmelden?lang=nl" })
+	invalid := testMember()
+	invalid.PostalCode = "not a postal code"
+	bot := testMember()
+	e := getGinHandler(t)
+
+	// Act
+	failed := e.POST("/api/signup").WithRedirectPolicy(httpexpect.DontFollowRedirects).
+		WithHeader("Accept", "text/html,application/xhtml+xml").WithForm(signupWithTrap(invalid, BotTrap{})).
+		Expect()
+	caught := e.POST("/api/signup").WithRedirectPolicy(httpexpect.DontFollowRedirects).
+		WithHeader("Accept", "text/html").WithMultipart().WithForm(signupWithTrap(bot, BotTrap{Honeypot: "https://spam.example"})).
+		Expect()
+
+	// Assert
+	failed.Status(http.StatusSeeOther).Header("Location").IsEqual("/aanmelden?lang=nl&status=400")
+	caught.Status(http.StatusSeeOther).Header("Location").IsEqual(CONFIG.SignupSuccessURL)
+}
+
+func TestFormSignupFromScriptsGetsJSON(t *testing.T) {
+	e := getGinHandler(t)
+
+	e.POST("/api/signup").WithMultipart().WithFormField("surname", "tak").WithFormField("lastname", "tak").
+		Expect().
+		Status(http.StatusBadRequest).JSON().Object().
+		Value("error").Object().HasValue("code", "unknown_field").HasValue("field", "lastname")
+}
+
+func TestSignupPageWorksWithoutJavaScript(t *testing.T) {
+	useConfig(t, func(config *Config) { config.CaptchaFallbackDelay = 30 * time.Second })
+	e := getGinHandler(t)
+
+	response := e.GET("/aanmelden").Expect().Status(http.StatusOK)
+
+	response.Header("Content-Type").HasPrefix("text/html")
+	response.Header("Content-Security-Policy").Contains("script-src 'self';")
+	page := response.Body()
+	page.Contains(`<altcha-widget challengeurl="/api/captcha-challenge" name="altcha">`)
+	page.Contains(`<input type="hidden" name="altcha" value="` + testCaptchaSolution + `">`)
+	page.Contains(`name="form_token" value="`)
+	e.GET("/aanmelden/signup.css").Expect().Status(http.StatusOK).Body().Contains(".website")
+}
+
+func TestSignupPageServesTheWidgetWithItsIntegrity(t *testing.T) {
+	// Arrange
+	e := getGinHandler(t)
+
+	// Act
+	page := e.GET("/aanmelden").Expect().Status(http.StatusOK).Body().Raw()
+	widget := e.GET("/aanmelden/altcha-0.1.5.min.js").Expect().Status(http.StatusOK)
+
+	// Assert
+	widget.Header("Content-Type").HasPrefix("text/javascript")
+	hash := sha512.Sum384([]byte(widget.Body().Raw()))
+	integrity := "sha384-" + base64.StdEncoding.EncodeToString(hash[:])
+	script := `<script async defer type="module" src="/aanmelden/altcha-0.1.5.min.js" integrity="` + integrity + `" crossorigin="anonymous">`
+	if !strings.Contains(html.UnescapeString(page), script) {
+		t.Fatalf("the page does not load the widget with integrity %s", integrity)
+	}
+}
+
+func TestSignupPageOnlyAllowsTheWidgetFromAnotherHost(t *testing.T) {
+	// Arrange
+	const widget = "https://cdn.jsdelivr.net/npm/altcha@0.1.5/dist/altcha.min.js"
+	const integrity = "sha384-uC0pgQaL+z+KMtLVLqLJSM27dIzVsrs2LzAkrjfd9VxdWoMs1pAYJN2X5FRWPfSB"
+	useConfig(t, func(config *Config) {
+		config.AltchaWidgetURL = widget
+		config.AltchaWidgetIntegrity = integrity
+	})
+	e := getGinHandler(t)
+
+	// Act
+	response := e.GET("/aanmelden").Expect().Status(http.StatusOK)
+
+	// Assert
+	response.Header("Content-Security-Policy").Contains("script-src " + widget + ";")
+	if !strings.Contains(html.UnescapeString(response.Body().Raw()), `src="`+widget+`" integrity="`+integrity+`"`) {
+		t.Fatal("the page does not load the widget with its integrity")
+	}
+}
+
+func TestLoadConfigRequiresTheIntegrityOfAWidgetFromAnotherHost(t *testing.T) {
+	t.Setenv("ALTCHA_WIDGET_URL", "https://cdn.jsdelivr.net/npm/altcha@0.1.5/dist/altcha.min.js")
+
+	if _, err := loadConfig(); err == nil {
+		t.Fatal("a widget from another host was accepted without its integrity")
+	}
+	t.Setenv("ALTCHA_WIDGET_INTEGRITY", "sha384-not-a-hash")
+	if _, err := loadConfig(); err == nil {
+		t.Fatal("a malformed integrity was accepted")
+	}
+}
+
+func TestSignupPageOnlyGivesAwayCaptchasWhenTheFallbackIsOn(t *testing.T) {
+	e := getGinHandler(t)
+
+	page := e.GET("/aanmelden").Expect().Status(http.StatusOK).Body()
+
+	page.NotContains(testCaptchaSolution)
+	page.Contains("Zet JavaScript aan of meld je aan via")
+}
+
+func TestSignupPageLimitsTheDelayedCaptchasPerClient(t *testing.T) {
+	// Arrange
+	useConfig(t, func(config *Config) {
+		config.CaptchaFallbackDelay = 30 * time.Second
+		config.CaptchaFallbackPerIP = Limit{Burst: 2, Per: time.Hour}
+	})
+	e := getGinHandler(t)
+
+	// Act
+	e.GET("/aanmelden").Expect().Status(http.StatusOK).Body().Contains(testCaptchaSolution)
+	e.GET("/aanmelden").Expect().Status(http.StatusOK).Body().Contains(testCaptchaSolution)
+	page := e.GET("/aanmelden").Expect().Status(http.StatusOK).Body()
+
+	// Assert
+	page.NotContains(testCaptchaSolution)
+	page.Contains("Zet JavaScript aan of meld je aan via")
+}
+
+func TestSignupPageShowsErrorsNextToTheFields(t *testing.T) {
+	// Arrange
+	withoutFormToken(t)
+	useTestStore(t)
+	invalid := testMember()
+	invalid.PostalCode = "not a postal code"
+	invalid.City = `<script>alert("hoi")</script>`
+	e := getGinHandler(t)
+
+	// Act
+	page := e.POST("/aanmelden").WithForm(signupWithTrap(invalid, BotTrap{})).
+		Expect().
+		Status(http.StatusBadRequest).Body()
+
+	// Assert
+	page.Contains(`<div class="field invalid">`)
+	page.Contains(`<p class="error" id="postal_code-error">postcode is onjuist.`)
+	page.Contains(`value="Lovensdijkstaat 16"`)
+	page.Contains(`value="&lt;script&gt;alert(&#34;hoi&#34;)&lt;/script&gt;"`)
+	page.Contains(`<option value="NL" selected>`)
+	page.Contains(`<input type="checkbox" name="accept_terms_and_conditions" value="on" checked required>`)
+	if signups, _ := SIGNUP_STORE.All(); len(signups) != 0 {
+		t.Fatal("an invalid signup was stored")
+	}
+}
+
+func TestSignupPageThanksAfterASignup(t *testing.T) {
+	useTestStore(t)
+	e := getGinHandler(t)
+
+	e.POST("/aanmelden").WithForm(signupWithTrap(testMember(), BotTrap{Honeypot: "https://spam.example"})).
+		Expect().
+		Status(http.StatusOK).Body().Contains(`<p class="success">Bedankt voor je aanmelding!`).NotContains("<form")
+}
+
+func TestHealthzReturnsOk(t *testing.T) {
+	e := getGinHandler(t)
+
+	e.GET("/healthz").
+		Expect().
+		Status(http.StatusOK).JSON().Object().HasValue("status", "ok")
+}
+
+func TestReadyzIsUnavailableWithoutEmailCredentials(t *testing.T) {
+	e := getGinHandler(t)
+
+	e.GET("/readyz").
+		Expect().
+		Status(http.StatusServiceUnavailable).JSON().Object().HasValue("ready", false)
+}
+
+func TestReadyzOnlyShowsErrorsWithAToken(t *testing.T) {
+	previousConfig := CONFIG
+	defer func() { CONFIG = previousConfig }()
+	CONFIG.MetricsToken = "scrape-me"
+	e := getGinHandler(t)
+
+	e.GET("/readyz").
+		Expect().
+		Status(http.StatusServiceUnavailable).JSON().Object().
+		Path("$.checks.config").Object().IsEqual(map[string]string{"status": "failing"})
+	e.GET("/readyz").WithHeader("Authorization", "Bearer scrape-me").
+		Expect().
+		Status(http.StatusServiceUnavailable).JSON().Object().
+		Path("$.checks.config").Object().ContainsKey("error")
+}
+
+func TestReadyzIsOkWhenConfiguredAndSMTPIsReachable(t *testing.T) {
+	// Arrange
+	smtp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smtp.Close()
+	host, port, _ := net.SplitHostPort(smtp.Addr().String())
+
+	previousConfig, previousCredentials, previousCorrespondance := CONFIG, SERVER_EMAIL_CREDENTIALS, CORRESPONDANCE_EMAIL
+	defer func() {
+		CONFIG, SERVER_EMAIL_CREDENTIALS, CORRESPONDANCE_EMAIL = previousConfig, previousCredentials, previousCorrespondance
+	}()
+	CONFIG.SMTPHost = host
+	CONFIG.SMTPPort, _ = strconv.Atoi(port)
+	SERVER_EMAIL_CREDENTIALS = ServerEmailCredentials{email: "server@example.org", password: "secret"}
+	CORRESPONDANCE_EMAIL = "info@example.org"
+	useSMTPProbe(t, checkSMTP)
+	e := getGinHandler(t)
+
+	// Act & Assert
+	e.GET("/readyz").
+		Expect().
+		Status(http.StatusOK).JSON().Object().HasValue("ready", true)
+}
+
+// useSMTPProbe gives the test a probe of the mail server without the result of an earlier test
+func useSMTPProbe(t *testing.T, probe func(ctx context.Context) error) *time.Time {
+	previous := SMTP_PROBE
+	t.Cleanup(func() { SMTP_PROBE = previous })
+	now := time.Now()
+	SMTP_PROBE = &cachedProbe{probe: probe, ttl: 5 * time.Second, now: func() time.Time { return now }}
+	return &now
+}
+
+func TestReadyzDoesNotConnectToTheMailServerOnEveryRequest(t *testing.T) {
+	// Arrange
+	probes := 0
+	now := useSMTPProbe(t, func(context.Context) error {
+		probes++
+		return errors.New("connection refused")
+	})
+	e := getGinHandler(t)
+
+	// Act
+	for range 10 {
+		e.GET("/readyz").Expect().Status(http.StatusServiceUnavailable)
+	}
+	*now = now.Add(5 * time.Second)
+	e.GET("/readyz").Expect().Status(http.StatusServiceUnavailable)
+
+	// Assert
+	if probes != 2 {
+		t.Fatalf("probed the mail server %d times, want 2", probes)
+	}
+}
+
+func TestVersionReturnsBuildInfo(t *testing.T) {
+	e := getGinHandler(t)
+
+	e.GET("/version").
+		Expect().
+		Status(http.StatusOK).JSON().Object().HasValue("go_version", runtime.Version())
+}
+
+func TestMetricsCountsMalformedSignups(t *testing.T) {
+	// Arrange
+	e := getGinHandler(t)
+	e.POST("/api/signup").WithBytes([]byte("{")).WithHeader("Content-Type", "application/json").Expect().Status(http.StatusBadRequest)
+
+	// Act & Assert
+	e.GET("/metrics").
+		Expect().
+		Status(http.StatusOK).
+		Body().Contains(`backend_signups_total{outcome="malformed"}`).
+		Contains(`backend_http_request_duration_seconds_count{method="POST",route="/api/signup",status="400"}`)
+}
+
+func TestMetricsRequiresTokenWhenConfigured(t *testing.T) {
+	// Arrange
+	previousConfig := CONFIG
+	defer func() { CONFIG = previousConfig }()
+	CONFIG.MetricsToken = "scrape-me"
+	e := getGinHandler(t)
+
+	// Act & Assert
+	e.GET("/metrics").Expect().Status(http.StatusUnauthorized)
+	e.GET("/metrics").WithHeader("Authorization", "Bearer scrape-me").Expect().Status(http.StatusOK)
+}
+
+func TestRequestIDIsGeneratedAndEchoed(t *testing.T) {
+	e := getGinHandler(t)
+
+	e.GET("/healthz").
+		Expect().
+		Status(http.StatusOK).Header(requestIDHeader).Match(`^[0-9a-f]{32}$`)
+
+	e.GET("/healthz").WithHeader(requestIDHeader, "proxy-id-123").
+		Expect().
+		Status(http.StatusOK).Header(requestIDHeader).IsEqual("proxy-id-123")
+}
+
+func TestRequestIDIsAddedToLogLines(t *testing.T) {
+	// Arrange
+	var output bytes.Buffer
+	logger := slog.New(requestIDHandler{slog.NewJSONHandler(&output, nil)})
+
+	// Act
+	logger.InfoContext(withRequestID(context.Background(), "abc"), "hello")
+
+	// Assert
+	if !strings.Contains(output.String(), `"request_id":"abc"`) {
+		t.Fatal(output.String())
+	}
+}
+
+func TestRotatingFileRotatesOnSizeAndKeepsLimitedBackups(t *testing.T) {
+	// Arrange
+	path := filepath.Join(t.TempDir(), "logfile")
+	now := time.Date(2024, 3, 23, 12, 0, 0, 0, time.UTC)
+	file, err := openRotatingFile(path, 10, 0, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.now = func() time.Time { return now }
+
+	// Act
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		file.Write([]byte("0123456789"))
+	}
+
+	// Assert
+	rotated, _ := file.rotated()
+	if len(rotated) != 2 {
+		t.Fatalf("expected 2 rotated files, got %v", rotated)
+	}
+}
+
+func TestRotatingFileRotatesAfterInterval(t *testing.T) {
+	// Arrange
+	path := filepath.Join(t.TempDir(), "logfile")
+	now := time.Date(2024, 3, 23, 12, 0, 0, 0, time.UTC)
+	file, err := openRotatingFile(path, 0, time.Hour, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.now = func() time.Time { return now }
+	file.openedAt = now
+
+	// Act
+	file.Write([]byte("first\n"))
+	now = now.Add(2 * time.Hour)
+	file.Write([]byte("second\n"))
+
+	// Assert
+	rotated, _ := file.rotated()
+	if len(rotated) != 1 {
+		t.Fatalf("expected 1 rotated file, got %v", rotated)
+	}
+}
+
+// captureLogs sends everything logged during the test through the production handler chain into a buffer
+func captureLogs(t *testing.T, mode string) *bytes.Buffer {
+	var output bytes.Buffer
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	handler := requestIDHandler{slog.NewJSONHandler(&output, &slog.HandlerOptions{Level: slog.LevelDebug})}
+	slog.SetDefault(slog.New(newRedactingHandler(handler, newRedactionPolicy(mode, nil))))
+	return &output
+}
+
+// assertNoSignupFieldInLogs fails when the value of any field of the signup shows up in the logs.
+// Values of one or two characters ("NL", "de", "on") can not be told apart from other output and are skipped.
+func assertNoSignupFieldInLogs(t *testing.T, logs string, signup map[string]interface{}) {
+	for field, value := range signup {
+		text, _ := value.(string)
+		if len(text) < 3 {
+			continue
+		}
+		if strings.Contains(logs, text) {
+			t.Errorf("%s (%q) appears unmasked in the logs:\n%s", field, text, logs)
+		}
+	}
+}
+
+func TestSignupDoesNotLogPersonalData(t *testing.T) {
+	// Arrange
+	logs := captureLogs(t, redactMask)
+	e := getGinHandler(t)
+
+	// Act
+	e.POST("/api/signup").WithJSON(correctUser).Expect()
+
+	// Assert
+	assertNoSignupFieldInLogs(t, logs.String(), correctUser)
+}
+
+func TestLoggingAWholeSignupDoesNotLogPersonalData(t *testing.T) {
+	// Arrange
+	logs := captureLogs(t, redactMask)
+	member := PISignUp{}
+	encoded, _ := json.Marshal(correctUser)
+	json.Unmarshal(encoded, &member)
+
+	// Act
+	slog.Info("New signup", "member", member)
+	slog.Info("Signup as text: " + fmt.Sprintf("%+v", member))
+	slog.Error("Could not process signup", "error", fmt.Errorf("processing %v", member))
+	for field, value := range correctUser {
+		slog.Info("Field", field, value)
+	}
+
+	// Assert
+	assertNoSignupFieldInLogs(t, logs.String(), correctUser)
+}
+
+func TestRedactionMasksPersonalDataInFreeText(t *testing.T) {
+	policy := newRedactionPolicy(redactMask, nil)
+
+	redacted := policy.redactText("mail jandevries@example.org, call +31 6 12345678, pay NL18 RABO 0123 4598 76, born 23-03-2024")
+
+	expected := "mail j***@***.org, call +31*******78, pay NL**************76, born ****-**-**"
+	if redacted != expected {
+		t.Fatalf("got %q", redacted)
+	}
+}
+
+func TestRedactionKeepsSignupIDs(t *testing.T) {
+	// Arrange
+	logs := captureLogs(t, redactMask)
+	ids := []string{"ab12cd34ef56ab78cd90ef12ab34cd56", "nl18abcdef0123456789abcdef012345"}
+
+	// Act
+	slog.Warn("Signup looks like an earlier one", "duplicates", ids)
+	slog.Info("Signup stored", "id", ids[0])
+
+	// Assert
+	for _, id := range ids {
+		if !strings.Contains(logs.String(), id) {
+			t.Errorf("signup ID %s was masked:\n%s", id, logs.String())
+		}
+	}
+}
+
+func TestRedactionOnlyMasksPhoneShapedNumbers(t *testing.T) {
+	policy := newRedactionPolicy(redactFull, nil)
+
+	redacted := policy.redactText("call 06-1234 5678 or 0032 470 12 34 56, sent 12345678 bytes at 1760873412 after 100000000 requests")
+
+	expected := "call [phone] or [phone], sent 12345678 bytes at 1760873412 after 100000000 requests"
+	if redacted != expected {
+		t.Fatalf("got %q", redacted)
+	}
+}
+
+func TestRedactionInFullModeOnlyKeepsTheKind(t *testing.T) {
+	policy := newRedactionPolicy(redactFull, nil)
+
+	redacted := policy.redactText("jandevries@example.org +31612345678")
+
+	if redacted != "[email] [phone]" {
+		t.Fatalf("got %q", redacted)
+	}
+}
+
+// useTestStore gives the test an empty signup store and audit log, seeded with the signups given
+func useTestStore(t *testing.T, members ...PISignUp) []StoredSignup {
+	previousStore, previousAudit := SIGNUP_STORE, AUDIT_LOG
+	t.Cleanup(func() { SIGNUP_STORE, AUDIT_LOG = previousStore, previousAudit })
+	SIGNUP_STORE, AUDIT_LOG = &SignupStore{}, &AuditLog{}
+
+	var stored []StoredSignup
+	for _, member := range members {
+		signup, err := SIGNUP_STORE.Add(member)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, signup)
+	}
+	return stored
+}
+
+func useAdminToken(t *testing.T, token string) {
+	previousConfig := CONFIG
+	t.Cleanup(func() { CONFIG = previousConfig })
+	CONFIG.AdminToken = token
+}
+
+// testMember is a signup with every field of PISignUp filled in
+func testMember() PISignUp {
+	member := PISignUp{}
+	encoded, _ := json.Marshal(correctUser)
+	json.Unmarshal(encoded, &member)
+	member.PostalCode = "4793 AB"
+	return member
+}
+
+func TestAdminAPIIsDisabledWithoutToken(t *testing.T) {
+	e := getGinHandler(t)
+
+	e.POST("/api/admin/gdpr/export").WithJSON(gin.H{"email": "jandevries@example.org"}).
+		Expect().
+		Status(http.StatusNotFound)
+}
+
+func TestAdminAPIRejectsWrongToken(t *testing.T) {
+	useAdminToken(t, "letmein")
+	e := getGinHandler(t)
+
+	e.POST("/api/admin/gdpr/export").WithHeader("Authorization", "Bearer guess").WithJSON(gin.H{"email": "jandevries@example.org"}).
+		Expect().
+		Status(http.StatusUnauthorized)
+}
+
+func TestGDPRExportContainsEveryFieldOfTheSignup(t *testing.T) {
+	// Arrange
+	member := testMember()
+	useTestStore(t, member, PISignUp{Email: "someone@example.org"})
+	useAdminToken(t, "letmein")
+	e := getGinHandler(t)
+
+	// Act
+	export := e.POST("/api/admin/gdpr/export").WithHeader("Authorization", "Bearer letmein").
+		WithJSON(gin.H{"email": "JanDeVries@example.org "}).
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+
+	// Assert
+	export.Value("signups").Array().Length().IsEqual(1)
+	stored := export.Value("signups").Array().Value(0).Object().Value("member").Object()
+	for _, field := range jsonFieldNames(PISignUp{}) {
+		stored.ContainsKey(field)
+	}
+	stored.HasValue("iban", member.IBAN).HasValue("date_of_birth", member.DateOfBirth)
+
+	entries, _ := AUDIT_LOG.Entries()
+	if len(entries) != 1 || entries[0].Action != auditExport || entries[0].Subject != AUDIT_LOG.Subject("jandevries@example.org") {
+		t.Fatalf("unexpected audit trail %+v", entries)
+	}
+}
+
+func TestAuditSubjectNeedsTheKey(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	audit, _ := openAuditLog(filepath.Join(dir, "audit.jsonl"), "a test key that is long enough for the config")
+	sameKey, _ := openAuditLog(filepath.Join(dir, "other.jsonl"), "a test key that is long enough for the config")
+	otherKey, _ := openAuditLog(filepath.Join(dir, "third.jsonl"), "")
+	unkeyed := sha256.Sum256([]byte("jandevries@example.org"))
+
+	// Act
+	subject := audit.Subject(" JanDeVries@example.org")
+
+	// Assert
+	if subject != sameKey.Subject("jandevries@example.org") {
+		t.Error("the same key gives another subject")
+	}
+	if subject == otherKey.Subject("jandevries@example.org") || subject == hex.EncodeToString(unkeyed[:]) {
+		t.Error("the subject can be found without the key")
+	}
+}
+
+func TestGDPRExportAsCSVHasAColumnForEveryField(t *testing.T) {
+	// Arrange
+	member := testMember()
+	useTestStore(t, member)
+	useAdminToken(t, "letmein")
+	e := getGinHandler(t)
+
+	// Act
+	body := e.POST("/api/admin/gdpr/export").WithHeader("Authorization", "Bearer letmein").
+		WithJSON(gin.H{"email": member.Email, "format": "csv"}).
+		Expect().
+		Status(http.StatusOK).Body().Raw()
+
+	// Assert
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a header and one row, got %q", body)
+	}
+	for _, field := range jsonFieldNames(PISignUp{}) {
+		if !strings.Contains(lines[0], field) {
+			t.Errorf("column %s missing", field)
+		}
+	}
+	if !strings.Contains(lines[1], member.IBAN) || !strings.Contains(lines[1], member.AccountHolder) {
+		t.Errorf("row misses values: %s", lines[1])
+	}
+}
+
+func TestGDPREraseDeletesEverySignupOfTheMember(t *testing.T) {
+	// Arrange
+	member := testMember()
+	useTestStore(t, member, member, PISignUp{Email: "someone@example.org"})
+	useAdminToken(t, "letmein")
+	e := getGinHandler(t)
+
+	// Act
+	e.POST("/api/admin/gdpr/erase").WithHeader("Authorization", "Bearer letmein").
+		WithJSON(gin.H{"email": member.Email}).
+		Expect().
+		Status(http.StatusOK).JSON().Object().HasValue("signups", 2)
+
+	// Assert
+	remaining, _ := SIGNUP_STORE.All()
+	if len(remaining) != 1 || remaining[0].Member.Email != "someone@example.org" {
+		t.Fatalf("unexpected remaining signups %+v", remaining)
+	}
+	entries, _ := AUDIT_LOG.Entries()
+	if len(entries) != 1 || entries[0].Action != auditErase || entries[0].Records != 2 {
+		t.Fatalf("unexpected audit trail %+v", entries)
+	}
+}
+
+func TestGDPRAnonymizeOnlyKeepsStatisticsFields(t *testing.T) {
+	// Arrange
+	member := testMember()
+	stored := useTestStore(t, member)
+
+	// Act
+	_, err := eraseMemberData(member.Email, true)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymized, _ := SIGNUP_STORE.Get(stored[0].ID)
+	expected := PISignUp{
+		Country:                    member.Country,
+		Education:                  member.Education,
+		CohortYear:                 member.CohortYear,
+		Contribution:               member.Contribution,
+		ApprovalTermsAndConditions: member.ApprovalTermsAndConditions,
+	}
+	if anonymized.Member != expected {
+		t.Fatalf("got %+v", anonymized.Member)
+	}
+}
+
+func TestGDPREraseScrubsLogfiles(t *testing.T) {
+	// Arrange
+	member := testMember()
+	useTestStore(t, member)
+	path := filepath.Join(t.TempDir(), "logfile")
+	file, err := openRotatingFile(path, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	previousLogfile := LOGFILE
+	defer func() { LOGFILE = previousLogfile }()
+	LOGFILE = file
+	file.Write([]byte("Error writing confirmation email to " + member.Email + "\n"))
+
+	// Act
+	result, err := eraseMemberData(member.Email, false)
+
+	// Assert
+	content, _ := os.ReadFile(path)
+	if err != nil || result.LogFiles != 1 || strings.Contains(string(content), member.Email) {
+		t.Fatalf("logfile not scrubbed: %q", content)
+	}
+}
+
+func TestScrubFromAnotherProcessKeepsConcurrentWrites(t *testing.T) {
+	// Arrange
+	path := filepath.Join(t.TempDir(), "logfile")
+	server, err := openRotatingFile(path, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// a second open of the logfile, as the gdpr erase command does
+	command, err := openRotatingFile(path, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer command.Close()
+	const lines = 2000
+
+	// Act
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < lines; i++ {
+			fmt.Fprintf(server, "line %d of jandevries@example.org\n", i)
+		}
+	}()
+	for scrubbing := true; scrubbing; {
+		select {
+		case <-done:
+			scrubbing = false
+		default:
+		}
+		if _, err := command.scrub([]string{"jandevries@example.org"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Assert
+	content, _ := os.ReadFile(path)
+	for i := 0; i < lines; i++ {
+		if !strings.Contains(string(content), fmt.Sprintf("line %d of [erased]\n", i)) {
+			t.Fatalf("line %d lost or not scrubbed:\n%s", i, content)
+		}
+	}
+	fmt.Fprint(server, "last line\n")
+	info, _ := os.Stat(path)
+	if server.size != info.Size() {
+		t.Fatalf("server thinks the logfile is %d bytes, it is %d", server.size, info.Size())
+	}
+}
+
+func TestGDPREraseOnlyScrubsWholeValues(t *testing.T) {
+	// Arrange
+	member := testMember()
+	member.Address = "Kerkstraat 16"
+	useTestStore(t, member)
+	path := filepath.Join(t.TempDir(), "logfile")
+	useConfig(t, func(config *Config) { config.LogFile = path })
+	os.WriteFile(path, []byte(strings.Join([]string{
+		`{"time":"2024-03-23T16:05:00Z","msg":"Signup","address":"Kerkstraat 16"}`,
+		`{"time":"2024-03-23T16:06:00Z","msg":"Signup","address":"Kerkstraat 160","postal_code":"4793 AB"}`,
+		`{"msg":"Signup","email":"x` + member.Email + `"}`,
+	}, "\n")), 0640)
+
+	// Act
+	err := runCommand([]string{"gdpr", "erase", member.Email}, io.Discard)
+
+	// Assert
+	content, _ := os.ReadFile(path)
+	want := strings.Join([]string{
+		`{"time":"2024-03-23T16:05:00Z","msg":"Signup","address":"[erased]"}`,
+		`{"time":"2024-03-23T16:06:00Z","msg":"Signup","address":"Kerkstraat 160","postal_code":"4793 AB"}`,
+		`{"msg":"Signup","email":"x` + member.Email + `"}`,
+	}, "\n")
+	if err != nil || string(content) != want {
+		t.Fatalf("%v: %s", err, content)
+	}
+}
+
+func TestGDPREraseCommandScrubsTheConfiguredLogfile(t *testing.T) {
+	// Arrange
+	member := testMember()
+	useTestStore(t, member)
+	path := filepath.Join(t.TempDir(), "logfile")
+	useConfig(t, func(config *Config) { config.LogFile = path })
+	name := member.LegalFirstNames + " " + member.Infix + " " + member.Surname
+	os.WriteFile(path, []byte("Signup of "+name+", living at "+member.Address+"\n"), 0640)
+	os.WriteFile(path+".20240101T000000.000", []byte("Error writing confirmation email to "+member.Email+"\n"), 0640)
+	var output bytes.Buffer
+
+	// Act
+	err := runCommand([]string{"gdpr", "erase", member.Email}, &output)
+
+	// Assert
+	if err != nil || !strings.Contains(output.String(), "scrubbed 2 logfile(s)") {
+		t.Fatalf("%v: %s", err, output.String())
+	}
+	current, _ := os.ReadFile(path)
+	rotated, _ := os.ReadFile(path + ".20240101T000000.000")
+	if strings.Contains(string(current), name) || strings.Contains(string(current), member.Address) || strings.Contains(string(rotated), member.Email) {
+		t.Fatalf("logfiles not scrubbed: %q %q", current, rotated)
+	}
+}
+
+func TestSignupStoreSeesChangesMadeByAnotherProcess(t *testing.T) {
+	// Arrange
+	path := filepath.Join(t.TempDir(), "signups.json")
+	server, _ := openSignupStore(path, nil)
+	command, _ := openSignupStore(path, nil)
+	signup, _ := server.Add(testMember())
+
+	// Act
+	command.Delete(signup.ID)
+	server.Add(PISignUp{Email: "someone@example.org"})
+
+	// Assert
+	signups, _ := server.All()
+	if len(signups) != 1 || signups[0].Member.Email != "someone@example.org" {
+		t.Fatalf("deleted signup came back: %+v", signups)
+	}
+}
+
+func TestSignupStoreWaitsForTheLockOfAnotherProcess(t *testing.T) {
+	// Arrange: the server is in the middle of a change when a command adds a signup
+	path := filepath.Join(t.TempDir(), "signups.json")
+	server, _ := openSignupStore(path, nil)
+	command, _ := openSignupStore(path, nil)
+	unlock, err := server.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := make(chan error)
+
+	// Act
+	go func() {
+		_, err := command.Add(PISignUp{Email: "someone@example.org"})
+		added <- err
+	}()
+	select {
+	case <-added:
+		t.Fatal("the command did not wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	server.signups = append(server.signups, StoredSignup{ID: "from-the-server"})
+	server.save()
+	unlock()
+
+	// Assert
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+	signups, _ := server.All()
+	if len(signups) != 2 {
+		t.Fatalf("a change was overwritten: %+v", signups)
+	}
+}
+
+func TestSignupStoreUndoesAChangeThatCouldNotBeSaved(t *testing.T) {
+	// Arrange: a directory in the place of the file makes the rename of a save fail
+	path := filepath.Join(t.TempDir(), "signups.json")
+	store, _ := openSignupStore(path, nil)
+	store.Add(testMember())
+	os.Remove(path)
+	os.MkdirAll(filepath.Join(path, "in-the-way"), 0700)
+	store.read, _ = os.Stat(path)
+
+	// Act
+	_, err := store.Add(PISignUp{Email: "someone@example.org"})
+
+	// Assert
+	if err == nil || len(store.signups) != 1 {
+		t.Fatalf("%v: %d signups in memory, want 1", err, len(store.signups))
+	}
+}
+
+func TestGDPRExportCommand(t *testing.T) {
+	// Arrange
+	member := testMember()
+	useTestStore(t, member)
+	var output bytes.Buffer
+
+	// Act
+	err := runCommand([]string{"gdpr", "export", "-format", "csv", member.Email}, &output)
+
+	// Assert
+	if err != nil || !strings.Contains(output.String(), member.IBAN) {
+		t.Fatalf("%v: %s", err, output.String())
+	}
+}
+
+// ageSignup moves the last status change of a stored signup back in time
+func ageSignup(t *testing.T, id string, status SignupStatus, age time.Duration) {
+	SIGNUP_STORE.mutex.Lock()
+	defer SIGNUP_STORE.mutex.Unlock()
+	for i := range SIGNUP_STORE.signups {
+		if SIGNUP_STORE.signups[i].ID == id {
+			SIGNUP_STORE.signups[i].Status = status
+			SIGNUP_STORE.signups[i].UpdatedAt = time.Now().Add(-age)
+			return
+		}
+	}
+	t.Fatalf("signup %s not found", id)
+}
+
+var testRetention = RetentionPolicy{
+	Periods: map[SignupStatus]time.Duration{
+		StatusReceived: 180 * day,
+		StatusRejected: 30 * day,
+	},
+	Mode: purgeDelete,
+}
+
+func TestPurgeDryRunOnlyReports(t *testing.T) {
+	// Arrange
+	stored := useTestStore(t, testMember())
+	ageSignup(t, stored[0].ID, StatusRejected, 31*day)
+
+	// Act
+	report, err := purgeExpiredSignups(testRetention, true, "test")
+
+	// Assert
+	remaining, _ := SIGNUP_STORE.All()
+	if err != nil || len(report.Signups) != 1 || len(remaining) != 1 {
+		t.Fatalf("%v: report %+v, remaining %d", err, report, len(remaining))
+	}
+}
+
+func TestPurgeRemovesOnlyExpiredSignups(t *testing.T) {
+	// Arrange
+	stored := useTestStore(t, testMember(), testMember(), testMember(), testMember())
+	ageSignup(t, stored[0].ID, StatusRejected, 31*day)
+	ageSignup(t, stored[1].ID, StatusRejected, 29*day)
+	ageSignup(t, stored[2].ID, StatusReceived, 31*day)
+	// no retention period for processed signups, so they are kept forever
+	ageSignup(t, stored[3].ID, StatusProcessed, 1000*day)
+
+	// Act
+	report, err := purgeExpiredSignups(testRetention, false, "test")
+
+	// Assert
+	remaining, _ := SIGNUP_STORE.All()
+	if err != nil || len(report.Signups) != 1 || report.Signups[0].ID != stored[0].ID || len(remaining) != 3 {
+		t.Fatalf("%v: report %+v, remaining %d", err, report, len(remaining))
+	}
+	entries, _ := AUDIT_LOG.Entries()
+	if len(entries) != 1 || entries[0].Action != auditPurge {
+		t.Fatalf("unexpected audit trail %+v", entries)
+	}
+}
+
+func TestPurgeCanAnonymizeInsteadOfDelete(t *testing.T) {
+	// Arrange
+	stored := useTestStore(t, testMember())
+	ageSignup(t, stored[0].ID, StatusRejected, 31*day)
+	policy := testRetention
+	policy.Mode = purgeAnonymize
+
+	// Act
+	purgeExpiredSignups(policy, false, "test")
+	report, _ := purgeExpiredSignups(policy, false, "test")
+
+	// Assert
+	signup, _ := SIGNUP_STORE.Get(stored[0].ID)
+	if !signup.Anonymized || signup.Member.IBAN != "" || signup.Member.Education == "" || len(report.Signups) != 0 {
+		t.Fatalf("got %+v, second report %+v", signup, report)
+	}
+}
+
+func TestAdminCanChangeSignupStatus(t *testing.T) {
+	// Arrange
+	stored := useTestStore(t, testMember())
+	useAdminToken(t, "letmein")
+	e := getGinHandler(t)
+
+	// Act & Assert
+	e.PATCH("/api/admin/signups/"+stored[0].ID).WithHeader("Authorization", "Bearer letmein").
+		WithJSON(gin.H{"status": "processed"}).
+		Expect().
+		Status(http.StatusOK).JSON().Object().HasValue("status", "processed")
+
+	e.PATCH("/api/admin/signups/"+stored[0].ID).WithHeader("Authorization", "Bearer letmein").
+		WithJSON(gin.H{"status": "archived"}).
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func TestLoadConfigAcceptsDurationsInDays(t *testing.T) {
+	t.Setenv("RETAIN_REJECTED", "14d")
+
+	config, err := loadConfig()
+	if err != nil || config.RetainRejected != 14*day {
+		t.FailNow()
+	}
+}
+
+// useEncryptedTestStore replaces the store with one on disk that encrypts with the given keys
+func useEncryptedTestStore(t *testing.T, keys []string, activeID string) (*SignupStore, string) {
+	previousStore := SIGNUP_STORE
+	t.Cleanup(func() { SIGNUP_STORE = previousStore })
+
+	fieldCipher, err := newFieldCipher(keys, activeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "signups.json")
+	SIGNUP_STORE, err = openSignupStore(path, fieldCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return SIGNUP_STORE, path
+}
+
+func TestSensitiveFieldsAreEncryptedOnDisk(t *testing.T) {
+	// Arrange
+	member := testMember()
+	store, path := useEncryptedTestStore(t, []string{"2026:" + generateKey()}, "2026")
+	useAdminToken(t, "letmein")
+	e := getGinHandler(t)
+
+	// Act
+	store.Add(member)
+
+	// Assert
+	contents, _ := os.ReadFile(path)
+	for _, value := range []string{member.IBAN, member.DateOfBirth, member.Phone, member.EmergencyContactPhoneNumber} {
+		if strings.Contains(string(contents), value) {
+			t.Errorf("%q is stored in plain text", value)
+		}
+	}
+	e.POST("/api/admin/gdpr/export").WithHeader("Authorization", "Bearer letmein").
+		WithJSON(gin.H{"email": member.Email}).
+		Expect().
+		Status(http.StatusOK).JSON().Object().
+		Value("signups").Array().Value(0).Object().Value("member").Object().
+		HasValue("iban", member.IBAN).HasValue("phone", member.Phone)
+}
+
+func TestRotateKeysReencryptsWithTheActiveKey(t *testing.T) {
+	// Arrange
+	oldKey, newKey := "old:"+generateKey(), "new:"+generateKey()
+	store, path := useEncryptedTestStore(t, []string{oldKey}, "old")
+	signup, _ := store.Add(testMember())
+	bothKeys, _ := newFieldCipher([]string{oldKey, newKey}, "new")
+	rotated, _ := openSignupStore(path, bothKeys)
+
+	// Act
+	count, err := rotated.RotateKeys()
+
+	// Assert
+	if err != nil || count != 1 {
+		t.Fatalf("rotated %d signups: %v", count, err)
+	}
+	newKeyOnly, _ := newFieldCipher([]string{newKey}, "new")
+	onlyNew, _ := openSignupStore(path, newKeyOnly)
+	stored, _ := onlyNew.Get(signup.ID)
+	revealed, err := onlyNew.Reveal(stored)
+	if err != nil || revealed[0].Member.IBAN != testMember().IBAN {
+		t.Fatalf("signup not readable with the new key alone: %v", err)
+	}
+}
+
+func TestEncryptedFieldCanNotBeMovedToAnotherSignup(t *testing.T) {
+	// Arrange
+	store, _ := useEncryptedTestStore(t, []string{"2026:" + generateKey()}, "2026")
+	first, _ := store.Add(testMember())
+	second, _ := store.Add(testMember())
+
+	// Act
+	second.Member.IBAN = first.Member.IBAN
+
+	// Assert
+	if _, err := store.Reveal(second); err == nil {
+		t.Fatal("decrypted a field copied from another signup")
+	}
+}
+
+// useOpenPGPAttachments makes a key pair for the secretary, loads the public key from a file like main does
+// and returns the private key to decrypt with
+func useOpenPGPAttachments(t *testing.T) *openpgp.Entity {
+	previous := ATTACHMENT_SEALER
+	t.Cleanup(func() { ATTACHMENT_SEALER = previous })
+
+	secretary, err := openpgp.NewEntity("Secretaris", "", "secretaris@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var publicKey bytes.Buffer
+	armored, _ := armor.Encode(&publicKey, openpgp.PublicKeyType, nil)
+	secretary.Serialize(armored)
+	armored.Close()
+	path := filepath.Join(t.TempDir(), "secretaris.asc")
+	os.WriteFile(path, publicKey.Bytes(), 0600)
+
+	config := defaultConfig()
+	config.AttachmentEncryption = attachmentOpenPGP
+	config.AttachmentPGPKeys = []string{path}
+	ATTACHMENT_SEALER, err = loadAttachmentSealer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secretary
+}
+
+func TestOpenPGPAttachmentDecryptsToTheCSV(t *testing.T) {
+	// Arrange
+	secretary := useOpenPGPAttachments(t)
+	member := testMember()
+	csvBytes, _ := WriteToCSV(context.Background(), member)
+
+	// Act
+	name, sealed, err := ATTACHMENT_SEALER.seal("nieuw_lid.csv", csvBytes)
+
+	// Assert
+	if err != nil || name != "nieuw_lid.csv.asc" || bytes.Contains(sealed, []byte(member.IBAN)) {
+		t.Fatalf("attachment %s not encrypted: %v", name, err)
+	}
+	block, err := armor.Decode(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{secretary}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, _ := io.ReadAll(message.UnverifiedBody)
+	if !bytes.Equal(decrypted, csvBytes) {
+		t.Fatalf("decrypted attachment differs from the CSV:\n%s", decrypted)
+	}
+}
+
+func TestZipAttachmentDecryptsToTheCSV(t *testing.T) {
+	// Arrange
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(passwordFile, []byte("correct horse battery staple\n"), 0600)
+	config := defaultConfig()
+	config.AttachmentEncryption = attachmentZip
+	config.AttachmentPasswordFile = passwordFile
+	sealer, err := loadAttachmentSealer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvBytes, _ := WriteToCSV(context.Background(), testMember())
+
+	// Act
+	name, sealed, err := sealer.seal("nieuw_lid.csv", csvBytes)
+
+	// Assert
+	if err != nil || name != "nieuw_lid.zip" {
+		t.Fatalf("attachment %s: %v", name, err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(sealed), int64(len(sealed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := archive.File[0]
+	if file.Name != "nieuw_lid.csv" || file.Method != winzipAESMethod || file.Flags&0x1 == 0 || file.ReaderVersion != 51 {
+		t.Fatalf("unexpected header %+v", file.FileHeader)
+	}
+	// AE-2, so the CRC is left out
+	if file.CRC32 != 0 || !bytes.Contains(file.Extra, []byte{0x01, 0x99, 7, 0, 2, 0, 'A', 'E', 3, 8, 0}) {
+		t.Fatalf("unexpected AES extra field % x, crc %x", file.Extra, file.CRC32)
+	}
+	if decrypted := decryptWinzipAES(t, file, "correct horse battery staple"); !bytes.Equal(decrypted, csvBytes) {
+		t.Fatalf("decrypted attachment differs from the CSV:\n%s", decrypted)
+	}
+}
+
+// testdata/libarchive-aes256.zip was made with bsdtar 3.7.7:
+//
+//	bsdtar --format zip --options zip:encryption=aes256 --passphrase 'correct horse battery staple' -cf libarchive-aes256.zip nieuw_lid.csv
+//
+// so our key derivation, counter mode and authentication code are checked against another implementation
+func TestZipAttachmentCryptoMatchesLibarchive(t *testing.T) {
+	archive, err := zip.OpenReader(filepath.Join("testdata", "libarchive-aes256.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	decrypted := decryptWinzipAES(t, archive.File[0], "correct horse battery staple")
+
+	if string(decrypted) != "Voornamen;Achternaam\nJan;de Vries\n" {
+		t.Fatalf("got %q", decrypted)
+	}
+}
+
+func TestZipAttachmentOpensWithBsdtar(t *testing.T) {
+	// Arrange
+	bsdtar, err := exec.LookPath("bsdtar")
+	if err != nil {
+		t.Skip("bsdtar is not installed")
+	}
+	sealer := &AttachmentSealer{mode: attachmentZip, password: "correct horse battery staple"}
+	csvBytes, _ := WriteToCSV(context.Background(), testMember())
+	_, sealed, _ := sealer.seal("nieuw_lid.csv", csvBytes)
+	path := filepath.Join(t.TempDir(), "nieuw_lid.zip")
+	os.WriteFile(path, sealed, 0600)
+
+	// Act
+	extracted, err := exec.Command(bsdtar, "-xOf", path, "--passphrase", "correct horse battery staple").Output()
+
+	// Assert
+	if err != nil || !bytes.Equal(extracted, csvBytes) {
+		t.Fatalf("%v: %s", err, extracted)
+	}
+	if exec.Command(bsdtar, "-xOf", path, "--passphrase", "wrong").Run() == nil {
+		t.Fatal("bsdtar opened the archive with the wrong password")
+	}
+}
+
+// decryptWinzipAES checks the password verifier and authentication code of a WinZip AES-256 encrypted file
+// and returns its contents, following https://www.winzip.com/en/support/aes-encryption/
+func decryptWinzipAES(t *testing.T, file *zip.File, password string) []byte {
+	t.Helper()
+	extra := file.Extra
+	method := uint16(0)
+	for len(extra) >= 4 {
+		id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if id == 0x9901 && size == 7 && extra[8] == 3 {
+			method = binary.LittleEndian.Uint16(extra[9:])
+		}
+		extra = extra[4+size:]
+	}
+	if method == 0 && file.Method == winzipAESMethod {
+		t.Fatalf("no AES-256 extra field in % x", file.Extra)
+	}
+
+	raw, _ := file.OpenRaw()
+	data, _ := io.ReadAll(raw)
+	salt, verifier := data[:winzipAESSaltSize], data[winzipAESSaltSize:winzipAESSaltSize+2]
+	encrypted, code := data[winzipAESSaltSize+2:len(data)-winzipAESMACSize], data[len(data)-winzipAESMACSize:]
+
+	encryptionKey, macKey, expectedVerifier := winzipAESKeys(password, salt)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(encrypted)
+	if !bytes.Equal(verifier, expectedVerifier) || !hmac.Equal(code, mac.Sum(nil)[:winzipAESMACSize]) {
+		t.Fatal("password verifier or authentication code does not match")
+	}
+	winzipAESCrypt(encryptionKey, encrypted)
+	if method == zip.Store {
+		return encrypted
+	}
+	decrypted, _ := io.ReadAll(flate.NewReader(bytes.NewReader(encrypted)))
+	return decrypted
+}
+
+func TestEncryptedMemberInfoMailHoldsNoPersonalData(t *testing.T) {
+	// Arrange
+	useOpenPGPAttachments(t)
+	member := testMember()
+
+	// Act
+	message, err := newMemberInfoMessage(context.Background(), member, nil, "server@example.org", "secretaris@example.org")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	message.WriteTo(&raw)
+	for _, value := range []string{member.IBAN, member.DateOfBirth, member.Surname, member.Email, member.Phone} {
+		if strings.Contains(raw.String(), value) {
+			t.Errorf("mail contains %q", value)
+		}
+	}
+}
+
+func TestValidateReportsEachFieldWithItsNormalizedValue(t *testing.T) {
+	// Arrange
+	useTestStore(t)
+	e := getGinHandler(t)
+
+	// Act
+	response := e.POST("/api/validate").
+		WithJSON(gin.H{"postal_code": "4793ab", "iban": "nl18 rabo 0123 4598 76", "phone": "0612345678", "city": "  Breda "}).
+		Expect()
+
+	// Assert
+	result := response.Status(http.StatusOK).JSON().Object()
+	result.HasValue("valid", false)
+	fields := result.Value("fields").Object()
+	fields.Keys().ContainsOnly("postal_code", "iban", "phone", "city")
+	fields.Value("city").Object().HasValue("valid", true).HasValue("value", "Breda")
+	fields.Value("postal_code").Object().HasValue("valid", true).HasValue("value", "4793 AB")
+	fields.Value("iban").Object().HasValue("valid", true).HasValue("value", "NL18RABO0123459876")
+	fields.Value("phone").Object().HasValue("valid", false).Value("error").String().Contains("+31612345678")
+	if signups, _ := SIGNUP_STORE.All(); len(signups) != 0 {
+		t.Fatalf("validating stored %d signups", len(signups))
+	}
+}
+
+func TestValidateChecksASingleField(t *testing.T) {
+	e := getGinHandler(t)
+
+	e.POST("/api/validate").WithJSON(gin.H{"field": "iban", "value": "NL18RABO0123459877"}).
+		Expect().
+		Status(http.StatusOK).JSON().Object().
+		HasValue("valid", false).
+		Value("fields").Object().Value("iban").Object().HasValue("error", ErrIBANInvalid.Error())
+}
+
+func TestValidateRefusesAFieldNameThatIsNotAString(t *testing.T) {
+	e := getGinHandler(t)
+
+	for _, field := range []any{42, nil, ""} {
+		e.POST("/api/validate").WithJSON(gin.H{"field": field, "value": "4793ab"}).
+			Expect().
+			Status(http.StatusBadRequest).JSON().Object().Value("error").Object().HasValue("field", "field")
+	}
+}
+
+func TestIBANChecksum(t *testing.T) {
+	for iban, want := range map[string]error{
+		"NL18RABO0123459876":          nil,
+		"BE68 5390 0754 7034":         nil,
+		"NL18RABO0123459867":          ErrIBANInvalid,
+		"NL18RABO01234598":            ErrIBANInvalid,
+		"NL18":                        ErrIBANInvalid,
+		"1234RABO0123459876":          ErrIBANInvalid,
+		"":                            ErrIBANMissing,
+		"NL18RABO0123459876!":         ErrIBANInvalid,
+		"GB82 WEST 1234 5698 7654 32": nil,
+	} {
+		if err := validateIBANChecksum(iban); err != want {
+			t.Errorf("%q: got %v, want %v", iban, err, want)
+		}
+	}
+}
+
+func TestDuplicatesAreFoundDespiteDifferentSpelling(t *testing.T) {
+	earlier := testMember()
+	tests := []struct {
+		name    string
+		change  func(member *PISignUp)
+		reasons []string
+	}{
+		{"email with capitals and a tag", func(member *PISignUp) { member.Email = " JanDeVries+pi@Example.org" }, []string{duplicateEmail}},
+		{"phone without country code", func(member *PISignUp) { member.Phone = "06-1234 5678" }, []string{duplicatePhone}},
+		{"phone with 0031", func(member *PISignUp) { member.Phone = "0031 6 12345678" }, []string{duplicatePhone}},
+		{"iban with spaces", func(member *PISignUp) { member.IBAN = "nl18 rabo 0123 4598 76" }, []string{duplicateIBAN}},
+		{"name with a typo", func(member *PISignUp) { member.LegalFirstNames, member.Nickname, member.Surname = "Bobben", "", "Täk" }, []string{duplicateNameAndBirth}},
+		{"nickname for the first name", func(member *PISignUp) { member.LegalFirstNames, member.Infix, member.Surname = "Bob", "", "De Tak" }, []string{duplicateNameAndBirth}},
+		{"same name, other birthday", func(member *PISignUp) { member.DateOfBirth = "2001-03-23" }, nil},
+		{"other name, same birthday", func(member *PISignUp) { member.LegalFirstNames, member.Nickname, member.Surname = "Anna", "", "Jansen" }, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			member := PISignUp{
+				Email: "someone@example.org", Phone: "+32470000000", Country: "NL", IBAN: "NL91ABNA0417164300",
+				LegalFirstNames: earlier.LegalFirstNames, Nickname: earlier.Nickname, Infix: earlier.Infix, Surname: earlier.Surname, DateOfBirth: "1999-01-01",
+			}
+			if test.reasons != nil && test.reasons[0] == duplicateNameAndBirth {
+				member.DateOfBirth = earlier.DateOfBirth
+			}
+			test.change(&member)
+
+			// Act
+			matches := findDuplicates(member, []StoredSignup{{ID: "earlier", Member: earlier}})
+
+			// Assert
+			if test.reasons == nil {
+				if len(matches) != 0 {
+					t.Fatalf("found %v", matches)
+				}
+				return
+			}
+			if len(matches) != 1 || !slices.Equal(matches[0].Reasons, test.reasons) {
+				t.Fatalf("found %v, want reasons %v", matches, test.reasons)
+			}
+		})
+	}
+}
+
+func TestGmailAddressesWithDotsAreTheSame(t *testing.T) {
+	if normalizeEmail("Jan.De.Vries+pi@googlemail.com") != normalizeEmail("jandevries@gmail.com") {
+		t.Fatal("gmail addresses differ")
+	}
+	if normalizeEmail("jan.devries@example.org") == normalizeEmail("jandevries@example.org") {
+		t.Fatal("dots only do not matter at gmail")
+	}
+}
+
+func TestSimultaneousDuplicateSignupsSeeEachOther(t *testing.T) {
+	// Arrange
+	useTestStore(t)
+	found := make(chan []DuplicateMatch, 2)
+
+	// Act
+	for range 2 {
+		go func() {
+			_, duplicates, _ := SIGNUP_STORE.AddFindingDuplicates(testMember())
+			found <- duplicates
+		}()
+	}
+
+	// Assert
+	first, second := <-found, <-found
+	if len(first)+len(second) != 1 {
+		t.Fatalf("got duplicates %+v and %+v, want one of them to see the other", first, second)
+	}
+}
+
+func TestAdminListShowsPossibleDuplicates(t *testing.T) {
+	// Arrange
+	again := testMember()
+	again.Email = "JanDeVries@Example.org"
+	stored := useTestStore(t, testMember(), again, PISignUp{Email: "someone@example.org"})
+	useAdminToken(t, "letmein")
+	e := getGinHandler(t)
+
+	// Act
+	signups := e.GET("/api/admin/signups").WithHeader("Authorization", "Bearer letmein").
+		Expect().
+		Status(http.StatusOK).JSON().Object().Value("Signups").Array()
+
+	// Assert
+	duplicate := signups.Value(1).Object().Value("possible_duplicates").Array()
+	duplicate.Length().IsEqual(1)
+	duplicate.Value(0).Object().HasValue("id", stored[0].ID).Value("reasons").Array().ContainsAll(duplicateEmail, duplicatePhone, duplicateIBAN)
+	signups.Value(2).Object().NotContainsKey("possible_duplicates")
+}
+
+func TestMemberInfoMailWarnsAboutDuplicates(t *testing.T) {
+	// Arrange
+	useOpenPGPAttachments(t)
+	member := testMember()
+	duplicates := []DuplicateMatch{{ID: "3f2a", Status: StatusProcessed, CreatedAt: "2026-09-01", Reasons: []string{duplicateIBAN}}}
+
+	// Act
+	message, err := newMemberInfoMessage(context.Background(), member, duplicates, "server@example.org", "secretaris@example.org")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	message.WriteTo(&raw)
+	for _, value := range []string{"mogelijk dubbel", "aanmelding 3f2a van 2026-09-01 (processed): zelfde IBAN"} {
+		if !strings.Contains(raw.String(), value) {
+			t.Errorf("mail does not mention %q", value)
+		}
+	}
+	if strings.Contains(raw.String(), member.IBAN) {
+		t.Error("mail contains the IBAN")
+	}
+}
+
+// writePEM stores a DER encoded key or certificate in a temporary PEM file
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	return path
+}
+
+// testMailSigner makes a DKIM key and a self-signed S/MIME certificate and returns the signer loaded from
+// them, together with the DKIM TXT record to verify with
+func testMailSigner(t *testing.T, config Config) (*MailSigner, string) {
+	dkimPublic, dkimPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(dkimPrivate)
+	config.DKIMKeyFile = writePEM(t, "dkim.pem", "PRIVATE KEY", der)
+	config.DKIMDomain, config.DKIMSelector = "svpromptusimperii.nl", "backend"
+
+	smimeKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "noreply@svpromptusimperii.nl"},
+		EmailAddresses: []string{"noreply@svpromptusimperii.nl"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	certificate, _ := x509.CreateCertificate(rand.Reader, template, template, &smimeKey.PublicKey, smimeKey)
+	config.SMIMECertFile = writePEM(t, "smime.crt", "CERTIFICATE", certificate)
+	der, _ = x509.MarshalPKCS8PrivateKey(smimeKey)
+	config.SMIMEKeyFile = writePEM(t, "smime.key", "PRIVATE KEY", der)
+
+	signer, err := loadMailSigner(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(dkimPublic)
+}
+
+func verifyDKIM(t *testing.T, rendered []byte, record string) {
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(rendered), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != "backend._domainkey.svpromptusimperii.nl" {
+				return nil, fmt.Errorf("unexpected lookup of %s", domain)
+			}
+			return []string{record}, nil
+		},
+	})
+	if err != nil || len(verifications) != 1 || verifications[0].Err != nil {
+		t.Fatalf("DKIM signature does not verify: %v %+v", err, verifications)
+	}
+}
+
+func TestConfirmationMailIsSignedWithDKIMAndSMIME(t *testing.T) {
+	// Arrange
+	signer, record := testMailSigner(t, defaultConfig())
+	message := newConfirmationMessage(testMember(), "noreply@svpromptusimperii.nl", "secretaris@svpromptusimperii.nl")
+
+	// Act
+	rendered, err := signer.render(message, emailConfirmation)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyDKIM(t, rendered, record)
+	if !bytes.Contains(rendered, []byte("multipart/signed")) || !bytes.Contains(rendered, []byte("application/pkcs7-signature")) {
+		t.Fatalf("confirmation is not signed with S/MIME:\n%s", rendered)
+	}
+}
+
+func TestMailSigningIsConfiguredPerMessageType(t *testing.T) {
+	// Arrange
+	config := defaultConfig()
+	config.DKIMMessages = []string{emailMemberInfo}
+	config.SMIMEMessages = []string{emailConfirmation}
+	signer, record := testMailSigner(t, config)
+	message, _ := newMemberInfoMessage(context.Background(), testMember(), nil, "noreply@svpromptusimperii.nl", "secretaris@svpromptusimperii.nl")
+
+	// Act
+	rendered, err := signer.render(message, emailMemberInfo)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyDKIM(t, rendered, record)
+	if bytes.Contains(rendered, []byte("application/pkcs7-signature")) {
+		t.Fatal("member info is signed with S/MIME, but only the confirmation should be")
+	}
+	if signer.signsDKIM(emailConfirmation) {
+		t.Fatal("confirmation would be signed with DKIM")
+	}
+}
+
+// useConfig lets a test change CONFIG, the change is undone when the test ends
+func useConfig(t *testing.T, change func(config *Config)) {
+	previousConfig := CONFIG
+	t.Cleanup(func() { CONFIG = previousConfig })
+	change(&CONFIG)
+}
+
+func TestRateLimitAnswers429WithRetryAfter(t *testing.T) {
+	// Arrange
+	useConfig(t, func(config *Config) { config.RateLimitPerIP = Limit{Burst: 2, Per: time.Minute} })
+	e := getGinHandler(t)
+
+	// Act
+	e.GET("/api/captcha-challenge").Expect().Status(http.StatusOK)
+	e.GET("/api/captcha-challenge").Expect().Status(http.StatusOK)
+	response := e.GET("/api/captcha-challenge").Expect()
+
+	// Assert
+	response.Status(http.StatusTooManyRequests).Header("Retry-After").IsEqual("30")
+	e.GET("/healthz").Expect().Status(http.StatusOK)
+}
+
+func TestValidateLimitHasItsOwnBuckets(t *testing.T) {
+	// Arrange
+	useConfig(t, func(config *Config) {
+		config.RateLimitPerIP = Limit{Burst: 1, Per: time.Minute}
+		config.ValidateRateLimitPerIP = Limit{Burst: 2, Per: time.Minute}
+	})
+	e := getGinHandler(t)
+
+	// Act
+	e.POST("/api/validate").WithJSON(gin.H{"field": "email", "value": "a@example.org"}).Expect().Status(http.StatusOK)
+	e.POST("/api/validate").WithJSON(gin.H{"field": "email", "value": "a@example.org"}).Expect().Status(http.StatusOK)
+	response := e.POST("/api/validate").WithJSON(gin.H{"field": "email", "value": "a@example.org"}).Expect()
+
+	// Assert
+	response.Status(http.StatusTooManyRequests)
+	e.GET("/api/captcha-challenge").Expect().Status(http.StatusOK)
+}
+
+func TestClientIsBannedAfterRepeatedFailures(t *testing.T) {
+	// Arrange
+	withoutFormToken(t)
+	useConfig(t, func(config *Config) { config.BanAfterFailures = 2 })
+	invalid := testMember()
+	invalid.PostalCode = "not a postal code"
+	e := getGinHandler(t)
+
+	// Act
+	e.POST("/api/signup").WithJSON(invalid).Expect().Status(http.StatusBadRequest)
+	e.POST("/api/signup").WithJSON(invalid).Expect().Status(http.StatusBadRequest)
+
+	// Assert
+	e.GET("/api/captcha-challenge").Expect().
+		Status(http.StatusTooManyRequests).Header("Retry-After").IsEqual("3600")
+}
+
+func TestClientsWithoutAddressShareNoBucketOrBan(t *testing.T) {
+	// Arrange: a Unix socket that is not trusted leaves every client without an address
+	withoutFormToken(t)
+	useConfig(t, func(config *Config) {
+		config.BanAfterFailures = 1
+		config.RateLimitPerIP = Limit{Burst: 1, Per: time.Minute}
+	})
+	invalid := testMember()
+	invalid.PostalCode = "not a postal code"
+	e := expectFor(t, initRouter(testCaptcha{}))
+
+	// Act
+	e.POST("/api/signup").WithJSON(invalid).Expect().Status(http.StatusBadRequest)
+
+	// Assert
+	e.GET("/api/captcha-challenge").Expect().Status(http.StatusOK)
+	e.GET("/api/captcha-challenge").Expect().Status(http.StatusOK)
+}
+
+func TestTokenBucketRefillsOverTime(t *testing.T) {
+	for name, store := range map[string]LimiterStore{
+		"memory": newMemoryLimiterStore(),
+		"redis":  &redisLimiterStore{client: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, limit, now := context.Background(), Limit{Burst: 1, Per: 10 * time.Second}, time.Now()
+
+			first, err := store.Take(ctx, "ip:192.0.2.1", limit, now)
+			second, _ := store.Take(ctx, "ip:192.0.2.1", limit, now)
+			later, _ := store.Take(ctx, "ip:192.0.2.1", limit, now.Add(11*time.Second))
+
+			if err != nil || first != 0 || second != 10*time.Second || later != 0 {
+				t.Fatalf("waits %v, %v, %v: %v", first, second, later, err)
+			}
+		})
+	}
+}
+
+func TestBanListExpires(t *testing.T) {
+	for name, store := range map[string]LimiterStore{
+		"memory": newMemoryLimiterStore(),
+		"redis":  &redisLimiterStore{client: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, now := context.Background(), time.Now()
+
+			store.Ban(ctx, "ban:192.0.2.1", time.Hour, now)
+			during, err := store.Banned(ctx, "ban:192.0.2.1", now.Add(time.Minute))
+			after, _ := store.Banned(ctx, "ban:192.0.2.1", now.Add(2*time.Hour))
+			other, _ := store.Banned(ctx, "ban:192.0.2.2", now)
+
+			if err != nil || during.Round(time.Second) != 59*time.Minute || after != 0 || other != 0 {
+				t.Fatalf("ban lasts %v, %v after it ended, %v for another client: %v", during, after, other, err)
+			}
+		})
+	}
+}
+
+// testAltcha is an Altcha with an easy work factor and a clock the test controls
+func testAltcha(now *time.Time) *Altcha {
+	config := defaultConfig()
+	config.AltchaHMACKey = "a test key that is long enough for the config"
+	captcha := newAltcha(config)
+	captcha.maxNumber = 1000
+	captcha.now = func() time.Time { return *now }
+	captcha.startedAt = *now
+	return captcha
+}
+
+// solveAltcha does the work of the widget and returns the payload it would submit
+func solveAltcha(t *testing.T, challenge AltchaChallenge) string {
+	encoded, _ := json.Marshal(challenge)
+	payload, solved := altcha.SolveChallenge(string(encoded), challenge.MaxNumber)
+	if !solved {
+		t.Fatal("could not solve the challenge")
+	}
+	return payload
+}
+
+func TestAltchaPayloadCanOnlyBeUsedOnce(t *testing.T) {
+	// Arrange
+	now := time.Now()
+	captcha := testAltcha(&now)
+	payload := solveAltcha(t, captcha.NewChallenge("192.0.2.1"))
+
+	// Act
+	first := captcha.Verify(payload)
+	replayed := captcha.Verify(payload)
+
+	// Assert
+	if first != nil || !errors.Is(replayed, ErrCaptchaReplayed) {
+		t.Fatalf("first use: %v, replay: %v", first, replayed)
+	}
+}
+
+func TestAltchaRejectsChallengesFromBeforeARestart(t *testing.T) {
+	// Arrange
+	now := time.Now()
+	payload := solveAltcha(t, testAltcha(&now).NewChallenge("192.0.2.1"))
+	now = now.Add(time.Minute)
+
+	// Act
+	err := testAltcha(&now).Verify(payload)
+
+	// Assert
+	if !errors.Is(err, ErrCaptchaExpired) {
+		t.Fatalf("challenge from before the restart gave %v", err)
+	}
+}
+
+func TestAltchaRemembersSpentChallengesInRedisOverARestart(t *testing.T) {
+	// Arrange
+	config := defaultConfig()
+	config.AltchaHMACKey = "a test key that is long enough for the config"
+	config.RateLimitRedisURL = "redis://" + miniredis.RunT(t).Addr()
+	now := time.Now()
+	start := func() *Altcha {
+		captcha := newAltcha(config)
+		captcha.maxNumber = 1000
+		captcha.now = func() time.Time { return now }
+		return captcha
+	}
+	payload := solveAltcha(t, start().NewChallenge("192.0.2.1"))
+
+	// Act
+	first := start().Verify(payload)
+	now = now.Add(time.Minute)
+	replayed := start().Verify(payload)
+
+	// Assert
+	if first != nil || !errors.Is(replayed, ErrCaptchaReplayed) {
+		t.Fatalf("first use: %v, replay after the restart: %v", first, replayed)
+	}
+}
+
+func TestDelayedAltchaSolutionIsValidAfterTheDelay(t *testing.T) {
+	// Arrange
+	now := time.Now()
+	captcha := testAltcha(&now)
+	payload := captcha.DelayedSolution(30 * time.Second)
+
+	// Act
+	early := captcha.Verify(payload)
+	now = now.Add(31 * time.Second)
+	later := captcha.Verify(payload)
+
+	// Assert
+	if !errors.Is(early, ErrCaptchaTooEarly) || later != nil {
+		t.Fatalf("got %v before the delay and %v after it", early, later)
+	}
+}
+
+func TestAltchaChallengeExpires(t *testing.T) {
+	// Arrange
+	now := time.Now()
+	captcha := testAltcha(&now)
+	payload := solveAltcha(t, captcha.NewChallenge("192.0.2.1"))
+
+	// Act
+	now = now.Add(CONFIG.AltchaChallengeTTL + time.Second)
+
+	// Assert
+	if err := captcha.Verify(payload); !errors.Is(err, ErrCaptchaExpired) {
+		t.Fatalf("expired challenge gave %v", err)
+	}
+}
+
+func TestAltchaRejectsTamperedOrForeignChallenges(t *testing.T) {
+	now := time.Now()
+	captcha := testAltcha(&now)
+
+	// an attacker pushing the expiry forward changes the salt, so the solution no longer matches
+	solved, _ := altcha.DecodeResponse(solveAltcha(t, captcha.NewChallenge("192.0.2.1")))
+	solved.Salt = strings.Split(solved.Salt, "?")[0] + "?expires=" + strconv.FormatInt(now.Add(24*time.Hour).Unix(), 10)
+	if err := captcha.Verify(solved.EncodeWithBase64()); !errors.Is(err, ErrCaptchaInvalid) {
+		t.Errorf("challenge with another expiry gave %v", err)
+	}
+
+	// a challenge signed by another key, like the library default
+	foreign := newAltcha(defaultConfig())
+	foreign.maxNumber = 1000
+	if err := captcha.Verify(solveAltcha(t, foreign.NewChallenge("192.0.2.1"))); !errors.Is(err, ErrCaptchaInvalid) {
+		t.Errorf("challenge signed with another key gave %v", err)
+	}
+
+	if err := captcha.Verify("not a payload"); !errors.Is(err, ErrCaptchaMalformed) {
+		t.Errorf("garbage gave %v", err)
+	}
+}
+
+func TestAltchaDifficultyRisesWithVolume(t *testing.T) {
+	// Arrange
+	now := time.Now()
+	captcha := testAltcha(&now)
+	captcha.adaptive = AdaptiveDifficulty{Window: time.Minute, PerIP: 2, Global: 5, MaxNumber: 6000}
+
+	// Act
+	var perIP []int
+	for range 7 {
+		perIP = append(perIP, captcha.NewChallenge("192.0.2.1").MaxNumber)
+	}
+	other := captcha.NewChallenge("192.0.2.2").MaxNumber
+	now = now.Add(time.Minute)
+	nextWindow := captcha.NewChallenge("192.0.2.1").MaxNumber
+
+	// Assert
+	if fmt.Sprint(perIP) != "[1000 1000 2000 2000 4000 4000 6000]" {
+		t.Errorf("difficulty per challenge of one client: %v", perIP)
+	}
+	if other != 2000 {
+		t.Errorf("another client during a busy window got %d, not the raised global difficulty", other)
+	}
+	if nextWindow != 1000 {
+		t.Errorf("difficulty did not reset in the next window: %d", nextWindow)
+	}
+}
+
+func TestLoadConfigRejectsUnknownAltchaAlgorithm(t *testing.T) {
+	t.Setenv("ALTCHA_ALGORITHM", "MD5")
+
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "ALTCHA_ALGORITHM") {
+		t.Fatalf("expected an ALTCHA_ALGORITHM error, got %v", err)
+	}
+}
+
+// withoutFormToken lets the test post signups without a form token, like FORM_TOKEN_REQUIRED=false
+func withoutFormToken(t *testing.T) {
+	previous := FORM_TIMER
+	t.Cleanup(func() { FORM_TIMER = previous })
+	FORM_TIMER = newFormTimer(defaultConfig())
+	FORM_TIMER.required = false
+}
+
+// useFormTimer replaces FORM_TIMER with one on a clock the test controls, that requires the token
+func useFormTimer(t *testing.T, now *time.Time) {
+	previous := FORM_TIMER
+	t.Cleanup(func() { FORM_TIMER = previous })
+	FORM_TIMER = newFormTimer(defaultConfig())
+	FORM_TIMER.required = true
+	FORM_TIMER.now = func() time.Time { return *now }
+}
+
+// signupWithTrap is the request body of a signup with the bot trap fields filled in
+func signupWithTrap(member PISignUp, trap BotTrap) map[string]any {
+	body := map[string]any{}
+	for _, part := range []any{member, trap} {
+		encoded, _ := json.Marshal(part)
+		json.Unmarshal(encoded, &body)
+	}
+	return body
+}
+
+func TestBotsGetAFakeSuccess(t *testing.T) {
+	now := time.Now()
+	useFormTimer(t, &now)
+	useTestStore(t)
+	e := getGinHandler(t)
+	token := e.GET("/api/form-token").Expect().Status(http.StatusOK).JSON().Object().Value("token").String().Raw()
+
+	// too fast, right after the form was shown
+	e.POST("/api/signup").WithJSON(signupWithTrap(testMember(), BotTrap{FormToken: token})).
+		Expect().
+		Status(http.StatusOK).JSON().Object().HasValue("Success", "Registration successful.")
+
+	now = now.Add(2 * time.Minute)
+	e.POST("/api/signup").WithJSON(signupWithTrap(testMember(), BotTrap{Honeypot: "https://cheap-pills.example", FormToken: token})).
+		Expect().
+		Status(http.StatusOK).JSON().Object().HasValue("Success", "Registration successful.")
+
+	if signups, _ := SIGNUP_STORE.All(); len(signups) != 0 {
+		t.Fatal("signup of a bot was stored")
+	}
+}
+
+func TestFormTokenThatIsNotOursAsksForAReload(t *testing.T) {
+	now := time.Now()
+	useFormTimer(t, &now)
+	useTestStore(t)
+	e := getGinHandler(t)
+	// issued by an instance with another key, or before a restart
+	otherKey := newFormTimer(defaultConfig())
+	otherKey.now = FORM_TIMER.now
+
+	for name, trap := range map[string]BotTrap{
+		"forged token": {FormToken: strconv.FormatInt(now.Add(-time.Hour).UnixMilli(), 10) + ".00"},
+		"other key":    {FormToken: otherKey.Issue()},
+	} {
+		e.POST("/api/signup").WithJSON(signupWithTrap(testMember(), trap)).
+			Expect().
+			Status(http.StatusBadRequest).JSON().Object().Value("Errors").Array().NotEmpty()
+
+		if signups, _ := SIGNUP_STORE.All(); len(signups) != 0 {
+			t.Fatalf("%s: signup was stored", name)
+		}
+	}
+}
+
+func TestFormTokenLetsPeopleThrough(t *testing.T) {
+	// Arrange
+	now := time.Now()
+	useFormTimer(t, &now)
+	e := getGinHandler(t)
+	token := e.GET("/api/form-token").Expect().JSON().Object().Value("token").String().Raw()
+	member := testMember()
+	member.PostalCode = "not a postal code"
+
+	// Act
+	now = now.Add(2 * time.Minute)
+	response := e.POST("/api/signup").WithJSON(signupWithTrap(member, BotTrap{FormToken: token})).Expect()
+
+	// Assert: the signup got past the bot checks to validation
+	response.Status(http.StatusBadRequest).JSON().Object().Value("Errors").Array().NotEmpty()
+}
+
+func TestSignupWithoutFormTokenIsRefused(t *testing.T) {
+	now := time.Now()
+	useFormTimer(t, &now)
+	useTestStore(t)
+
+	getGinHandler(t).POST("/api/signup").WithJSON(testMember()).
+		Expect().
+		Status(http.StatusBadRequest)
+
+	if signups, _ := SIGNUP_STORE.All(); len(signups) != 0 {
+		t.Fatal("signup without a form token was stored")
+	}
+}
+
+func TestExpiredFormTokenAsksForAReload(t *testing.T) {
+	now := time.Now()
+	useFormTimer(t, &now)
+	token := FORM_TIMER.Issue()
+	now = now.Add(25 * time.Hour)
+
+	getGinHandler(t).POST("/api/signup").WithJSON(signupWithTrap(testMember(), BotTrap{FormToken: token})).
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func TestSignupWithoutSolvedCaptchaIsRejected(t *testing.T) {
+	// Arrange
+	withoutFormToken(t)
+	useTestStore(t)
+	e := getGinHandler(t)
+	member := testMember()
+
+	for _, payload := range []string{"", "not-the-solution"} {
+		// Act
+		member.Altcha = payload
+		response := e.POST("/api/signup").WithJSON(member).Expect()
+
+		// Assert
+		response.Status(http.StatusBadRequest).JSON().Object().Value("Errors").Array().Value(0).String().Contains("captcha")
+	}
+	if signups, _ := SIGNUP_STORE.All(); len(signups) != 0 {
+		t.Fatal("signup without a solved captcha was stored")
+	}
+}
+
+func TestSolvedAltchaChallengeUnlocksTheEmailAddress(t *testing.T) {
+	// Arrange
+	now := time.Now()
+	e := getGinHandlerWithCaptcha(t, testAltcha(&now))
+	CORRESPONDANCE_EMAIL = "secretaris@example.org"
+	t.Cleanup(func() { CORRESPONDANCE_EMAIL = "" })
+
+	var challenge AltchaChallenge
+	e.GET("/api/captcha-challenge").Expect().Status(http.StatusOK).JSON().Decode(&challenge)
+	payload := solveAltcha(t, challenge)
+
+	// Act & Assert
+	e.POST("/api/email").WithJSON(gin.H{"altcha": payload}).
+		Expect().
+		Status(http.StatusOK).Body().IsEqual("secretaris@example.org")
+	e.POST("/api/email").WithJSON(gin.H{"altcha": payload}).
+		Expect().
+		Status(http.StatusBadRequest)
+	e.POST("/api/email").WithJSON(gin.H{"altcha": ""}).
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func TestUsedCaptchaAsksForANewChallengeWithoutBanning(t *testing.T) {
+	// Arrange
+	now := time.Now()
+	useConfig(t, func(config *Config) { config.BanAfterFailures = 1 })
+	e := getGinHandlerWithCaptcha(t, testAltcha(&now))
+	var challenge AltchaChallenge
+	e.GET("/api/captcha-challenge").Expect().Status(http.StatusOK).JSON().Decode(&challenge)
+	payload := solveAltcha(t, challenge)
+	e.POST("/api/email").WithJSON(gin.H{"altcha": payload}).Expect().Status(http.StatusOK)
+
+	// Act: sent again, like a signup that is corrected after it failed validation
+	response := e.POST("/api/email").WithJSON(gin.H{"altcha": payload}).Expect()
+
+	// Assert
+	response.Status(http.StatusBadRequest).JSON().Object().Value("error").Object().HasValue("code", captchaStale)
+	e.GET("/api/captcha-challenge").Expect().Status(http.StatusOK)
+	e.POST("/api/email").WithJSON(gin.H{"altcha": "not-a-payload"}).Expect().
+		Status(http.StatusBadRequest).JSON().Object().Value("error").Object().HasValue("code", captchaInvalid)
+	e.GET("/api/captcha-challenge").Expect().Status(http.StatusTooManyRequests)
+}
+
+// preflight sends the OPTIONS request a browser makes before a cross-origin POST
+func preflight(e *httpexpect.Expect, path, origin string) *httpexpect.Response {
+	return e.OPTIONS(path).
+		WithHeader("Origin", origin).
+		WithHeader("Access-Control-Request-Method", http.MethodPost).
+		WithHeader("Access-Control-Request-Headers", "content-type").
+		Expect()
+}
+
+func TestCORSPreflightFromAllowedOrigin(t *testing.T) {
+	e := getGinHandler(t)
+
+	response := preflight(e, "/api/signup", "https://svpromptusimperii.nl")
+
+	response.Status(http.StatusNoContent)
+	response.Header("Access-Control-Allow-Origin").IsEqual("https://svpromptusimperii.nl")
+	response.Header("Access-Control-Allow-Methods").Contains(http.MethodPost)
+	response.Header("Access-Control-Allow-Headers").Contains("Content-Type")
+	response.Header("Access-Control-Max-Age").IsEqual("43200")
+	response.Header("Access-Control-Allow-Credentials").IsEmpty()
+}
+
+func TestCORSRejectsOtherOrigins(t *testing.T) {
+	useConfig(t, func(config *Config) { config.CORS.Origins = []string{"https://*.svpromptusimperii.nl"} })
+	e := getGinHandler(t)
+
+	preflight(e, "/api/signup", "https://beta.svpromptusimperii.nl").
+		Status(http.StatusNoContent).Header("Access-Control-Allow-Origin").IsEqual("https://beta.svpromptusimperii.nl")
+	for _, origin := range []string{
+		"https://svpromptusimperii.nl",
+		"http://beta.svpromptusimperii.nl",
+		"https://evilsvpromptusimperii.nl",
+		"https://svpromptusimperii.nl.example.org",
+		"null",
+	} {
+		response := preflight(e, "/api/signup", origin)
+		response.Status(http.StatusForbidden)
+		response.Header("Access-Control-Allow-Origin").IsEmpty()
+	}
+}
+
+func TestCORSPolicyOfTheAdminAPIOverridesThePublicOne(t *testing.T) {
+	useConfig(t, func(config *Config) {
+		config.AdminCORS.Origins = []string{"https://admin.svpromptusimperii.nl"}
+		config.AdminCORS.Credentials = true
+	})
+	e := getGinHandler(t)
+
+	response := preflight(e, "/api/admin/signups", "https://admin.svpromptusimperii.nl")
+	response.Status(http.StatusNoContent)
+	response.Header("Access-Control-Allow-Credentials").IsEqual("true")
+	preflight(e, "/api/admin/signups", "https://svpromptusimperii.nl").Status(http.StatusForbidden)
+	preflight(e, "/api/signup", "https://admin.svpromptusimperii.nl").Status(http.StatusForbidden)
+}
+
+func TestLoadConfigReadsCORSPolicies(t *testing.T) {
+	t.Setenv("CORS_ORIGINS", "https://*.example.org")
+	t.Setenv("ADMIN_CORS_CREDENTIALS", "true")
+
+	config, err := loadConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(config.AdminCORS.Origins, []string{"https://*.example.org"}) || !config.AdminCORS.Credentials || config.CORS.Credentials {
+		t.Fatalf("admin policy does not follow the public one: %+v", config.AdminCORS)
+	}
+
+	t.Setenv("CORS_ORIGINS", "*,example.org")
+	t.Setenv("CORS_CREDENTIALS", "true")
+	_, err = loadConfig()
+	if err == nil || !strings.Contains(err.Error(), "can not be *") || !strings.Contains(err.Error(), `"example.org"`) {
+		t.Fatalf("expected errors about * with credentials and a malformed origin, got %v", err)
+	}
+}
+
+func TestClientIPIsOnlyTakenFromTrustedProxies(t *testing.T) {
+	trust, err := newProxyTrust([]string{"10.0.0.0/8", "2001:db8:ffff::1"}, defaultConfig().ClientIPHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"direct", "198.51.100.7:4711", nil, "198.51.100.7"},
+		{"untrusted peer sending headers", "198.51.100.7:4711", map[string]string{"X-Forwarded-For": "192.0.2.1"}, "198.51.100.7"},
+		{"x-forwarded-for", "10.0.0.2:4711", map[string]string{"X-Forwarded-For": "192.0.2.1"}, "192.0.2.1"},
+		{"spoofed x-forwarded-for", "10.0.0.2:4711", map[string]string{"X-Forwarded-For": "192.0.2.66, 192.0.2.1, 10.0.0.3"}, "192.0.2.1"},
+		{"other headers are ignored", "10.0.0.2:4711", map[string]string{"X-Real-IP": "192.0.2.1", "Forwarded": "for=192.0.2.1"}, "10.0.0.2"},
+		{"client sends forwarded", "10.0.0.2:4711", map[string]string{"Forwarded": "for=192.0.2.66", "X-Forwarded-For": "192.0.2.1"}, "192.0.2.1"},
+		{"only proxies", "10.0.0.2:4711", map[string]string{"X-Forwarded-For": "10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		{"unix socket is not trusted", "@", map[string]string{"X-Forwarded-For": "192.0.2.1"}, ""},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = test.remote
+		for key, value := range test.headers {
+			request.Header.Set(key, value)
+		}
+		if got := trust.resolve(request); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestClientIPFromForwardedHeader(t *testing.T) {
+	trust, err := newProxyTrust([]string{"10.0.0.0/8", "2001:db8:ffff::1"}, "forwarded")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"forwarded", "[2001:db8:ffff::1]:4711", map[string]string{"Forwarded": `for=192.0.2.66, for="[2001:db8::cafe]:4711";proto=https, for=10.0.0.3`}, "2001:db8::cafe"},
+		{"obfuscated hop", "10.0.0.2:4711", map[string]string{"Forwarded": `for=192.0.2.66, for=_hidden, for=10.0.0.3`}, "10.0.0.3"},
+		{"x-forwarded-for is ignored", "10.0.0.2:4711", map[string]string{"X-Forwarded-For": "192.0.2.66"}, "10.0.0.2"},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = test.remote
+		for key, value := range test.headers {
+			request.Header.Set(key, value)
+		}
+		if got := trust.resolve(request); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoadConfigTakesASingleClientIPHeader(t *testing.T) {
+	t.Setenv("CLIENT_IP_HEADER", "Forwarded,X-Forwarded-For")
+
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "CLIENT_IP_HEADER") {
+		t.Fatalf("expected a CLIENT_IP_HEADER error, got %v", err)
+	}
+}
+
+func TestRateLimitAndAuditUseTheClientBehindTheProxy(t *testing.T) {
+	// Arrange: the test requests come in without an address, like over our Unix socket
+	useConfig(t, func(config *Config) {
+		config.TrustedProxies = []string{"unix"}
+		config.RateLimitPerIP = Limit{Burst: 1, Per: time.Minute}
+	})
+	useTestStore(t, testMember())
+	useAdminToken(t, "letmein")
+	e := expectFor(t, initRouter(testCaptcha{}))
+
+	// Act & Assert
+	e.GET("/api/captcha-challenge").WithHeader("X-Forwarded-For", "192.0.2.1").Expect().Status(http.StatusOK)
+	e.GET("/api/captcha-challenge").WithHeader("X-Forwarded-For", "192.0.2.2").Expect().Status(http.StatusOK)
+	e.GET("/api/captcha-challenge").WithHeader("X-Forwarded-For", "192.0.2.1").Expect().Status(http.StatusTooManyRequests)
+
+	e.POST("/api/admin/gdpr/export").WithHeader("Authorization", "Bearer letmein").
+		WithHeader("Forwarded", "for=192.0.2.66").
+		WithHeader("X-Forwarded-For", "192.0.2.3").
+		WithJSON(gin.H{"email": testMember().Email}).
+		Expect().
+		Status(http.StatusOK)
+	entries, _ := AUDIT_LOG.Entries()
+	if len(entries) != 1 || entries[0].ClientIP != "192.0.2.3" {
+		t.Fatalf("audit entry does not have the address of the client: %+v", entries)
+	}
+}
+
+func TestResponsesHaveSecurityHeaders(t *testing.T) {
+	useConfig(t, func(config *Config) { config.SecurityHeaders.PermissionsPolicy = headerOff })
+	e := getGinHandler(t)
+
+	response := e.GET("/healthz").Expect()
+
+	response.Header("Strict-Transport-Security").IsEqual("max-age=31536000; includeSubDomains")
+	response.Header("Content-Security-Policy").IsEqual("default-src 'none'; frame-ancestors 'none'")
+	response.Header("X-Content-Type-Options").IsEqual("nosniff")
+	response.Header("Referrer-Policy").IsEqual("no-referrer")
+	response.Header("Permissions-Policy").IsEmpty()
+}
+
+func TestAdminSessionCookieNeedsCSRFTokenToChangeThings(t *testing.T) {
+	// Arrange
+	stored := useTestStore(t, testMember())
+	useAdminToken(t, "letmein")
+	e := getGinHandler(t)
+	login := e.POST("/api/admin/session").WithHeader("Authorization", "Bearer letmein").Expect().Status(http.StatusOK)
+	session := login.Cookie(adminSessionCookie).Value().Raw()
+	csrf := login.JSON().Object().Value("csrf_token").String().Raw()
+	login.Cookie(adminSessionCookie).HasMaxAge()
+
+	// Act & Assert
+	e.GET("/api/admin/signups").WithCookie(adminSessionCookie, session).Expect().Status(http.StatusOK)
+	e.PATCH("/api/admin/signups/"+stored[0].ID).WithCookie(adminSessionCookie, session).
+		WithJSON(gin.H{"status": "processed"}).
+		Expect().
+		Status(http.StatusForbidden)
+	e.PATCH("/api/admin/signups/"+stored[0].ID).WithCookie(adminSessionCookie, session).
+		WithHeader(csrfHeader, strings.Repeat("0", len(csrf))).
+		WithJSON(gin.H{"status": "processed"}).
+		Expect().
+		Status(http.StatusForbidden)
+	e.PATCH("/api/admin/signups/"+stored[0].ID).WithCookie(adminSessionCookie, session).
+		WithHeader(csrfHeader, csrf).
+		WithJSON(gin.H{"status": "processed"}).
+		Expect().
+		Status(http.StatusOK)
+	e.GET("/api/admin/signups").WithCookie(adminSessionCookie, session+"0").Expect().Status(http.StatusUnauthorized)
+}
+
+func TestAdminSessionExpires(t *testing.T) {
+	now := time.Now()
+	sessions := newAdminSessions("letmein", time.Hour)
+	sessions.now = func() time.Time { return now }
+	session, _ := sessions.issue()
+
+	if !sessions.valid(session) {
+		t.Fatal("new session is not valid")
+	}
+	if newAdminSessions("changed", time.Hour).valid(session) {
+		t.Fatal("session survived a change of the admin token")
+	}
+	now = now.Add(time.Hour)
+	if sessions.valid(session) {
+		t.Fatal("session is valid after it expired")
+	}
+}
+
+// testCertificate makes a certificate for 127.0.0.1 signed by parent, or a self-signed CA without one,
+// and writes it and its key to PEM files
+func testCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	certificate, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	return certificate, key, writePEM(t, name+".crt", "CERTIFICATE", der), writePEM(t, name+".key", "PRIVATE KEY", keyDER)
+}
+
+func TestCertificateIsReloadedWhenItChanges(t *testing.T) {
+	// Arrange
+	first, _, certFile, keyFile := testCertificate(t, "first", nil, nil)
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.checkEvery = 0
+
+	// Act: renew the certificate
+	_, _, renewedCert, renewedKey := testCertificate(t, "renewed", nil, nil)
+	for from, to := range map[string]string{renewedCert: certFile, renewedKey: keyFile} {
+		contents, _ := os.ReadFile(from)
+		os.WriteFile(to, contents, 0600)
+		os.Chtimes(to, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	}
+
+	// Assert
+	served, _ := reloader.GetCertificate(nil)
+	if served.Leaf.SerialNumber.Cmp(first.SerialNumber) == 0 || served.Leaf.Subject.CommonName != "renewed" {
+		t.Fatal("renewed certificate was not loaded")
+	}
+	os.WriteFile(certFile, []byte("half written"), 0600)
+	if broken, _ := reloader.GetCertificate(nil); broken != served {
+		t.Fatal("a broken certificate file replaced the working certificate")
+	}
+}
+
+func TestAdminAPIRequiresClientCertificateOverTLS(t *testing.T) {
+	// Arrange
+	authority, authorityKey, authorityFile, _ := testCertificate(t, "ca", nil, nil)
+	_, _, certFile, keyFile := testCertificate(t, "server", authority, authorityKey)
+	_, _, clientCertFile, clientKeyFile := testCertificate(t, "admin", authority, authorityKey)
+	useConfig(t, func(config *Config) {
+		config.TLSCertFile, config.TLSKeyFile = certFile, keyFile
+		config.TLSMinVersion = "1.3"
+		config.AdminClientCAFile = authorityFile
+	})
+	useAdminToken(t, "letmein")
+	useTestStore(t)
+
+	server := newHTTPServer(initRouter(testCaptcha{}), CONFIG)
+	var err error
+	server.TLSConfig, err = newTLSConfig(CONFIG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+
+	authorities := x509.NewCertPool()
+	authorities.AddCert(authority)
+	clientCertificate, _ := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	get := func(path string, tlsConfig *tls.Config) (int, error) {
+		tlsConfig.RootCAs = authorities
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		request, _ := http.NewRequest(http.MethodGet, "https://"+listener.Addr().String()+path, nil)
+		request.Header.Set("Authorization", "Bearer letmein")
+		response, err := client.Do(request)
+		if err != nil {
+			return 0, err
+		}
+		response.Body.Close()
+		return response.StatusCode, nil
+	}
+
+	// Act & Assert
+	if status, err := get("/api/admin/signups", &tls.Config{Certificates: []tls.Certificate{clientCertificate}}); status != http.StatusOK {
+		t.Fatalf("admin with client certificate got %d, %v", status, err)
+	}
+	if status, err := get("/api/admin/signups", &tls.Config{}); status != http.StatusForbidden {
+		t.Fatalf("admin without client certificate got %d, %v", status, err)
+	}
+	if status, err := get("/healthz", &tls.Config{}); status != http.StatusOK {
+		t.Fatalf("public endpoint without client certificate got %d, %v", status, err)
+	}
+	if _, err := get("/healthz", &tls.Config{MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Fatal("TLS 1.2 was accepted while the minimum is 1.3")
+	}
+}
+
+func TestPlainHTTPIsRedirectedToHTTPS(t *testing.T) {
+	for _, test := range []struct{ listen, host, want string }{
+		{":443", "svpromptusimperii.nl", "https://svpromptusimperii.nl/api/signup?a=b"},
+		{":8443", "svpromptusimperii.nl:8080", "https://svpromptusimperii.nl:8443/api/signup?a=b"},
+		{":443", "[2001:db8::1]:80", "https://[2001:db8::1]/api/signup?a=b"},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/api/signup?a=b", nil)
+		request.Host = test.host
+		recorder := httptest.NewRecorder()
+
+		redirectToHTTPS(test.listen).ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusPermanentRedirect || recorder.Header().Get("Location") != test.want {
+			t.Errorf("%s: got %d to %q, want %q", test.host, recorder.Code, recorder.Header().Get("Location"), test.want)
+		}
+	}
+}
+
+// idempotentSignups is a router with only the idempotency of the signup route in front of a handler that
+// counts how often it processed a signup, and can hold it up until release is closed
+func idempotentSignups(t *testing.T, store *IdempotencyStore, release chan struct{}) (*httpexpect.Expect, *atomic.Int32) {
+	processed := &atomic.Int32{}
+	router := gin.New()
+	router.POST("/api/signup", withIdempotency(store), func(context *gin.Context) {
+		var member PISignUp
+		json.NewDecoder(context.Request.Body).Decode(&member)
+		settle, ok := replayGuard(context, member)
+		if !ok {
+			return
+		}
+		defer settle(member.PostalCode != "")
+		if member.PostalCode == "" {
+			context.JSON(http.StatusBadRequest, gin.H{"Errors": []string{"postcode is onjuist"}})
+			return
+		}
+		<-release
+		context.JSON(http.StatusOK, gin.H{"Success": "Registration successful.", "number": processed.Add(1)})
+	})
+	return httpexpect.WithConfig(httpexpect.Config{
+		Client:   &http.Client{Transport: httpexpect.NewBinder(router)},
+		Reporter: httpexpect.NewAssertReporter(t),
+	}), processed
+}
+
+func TestRepeatedSignupGetsTheFirstResponse(t *testing.T) {
+	// Arrange
+	release := make(chan struct{})
+	close(release)
+	e, processed := idempotentSignups(t, newIdempotencyStore(time.Hour), release)
+	member := testMember()
+
+	// Act & Assert: without a key the contents identify the signup, also with a newly solved captcha
+	e.POST("/api/signup").WithJSON(member).Expect().Status(http.StatusOK)
+	member.Altcha = "solved again"
+	e.POST("/api/signup").WithJSON(member).Expect().
+		Status(http.StatusOK).Header(replayedHeader).IsEqual("true")
+
+	e.POST("/api/signup").WithHeader(idempotencyKeyHeader, "first").WithJSON(member).Expect().Status(http.StatusOK)
+	e.POST("/api/signup").WithHeader(idempotencyKeyHeader, "first").WithJSON(member).Expect().
+		Status(http.StatusOK).JSON().Object().HasValue("number", 2)
+	other := testMember()
+	other.Email = "someone.else@example.org"
+	e.POST("/api/signup").WithHeader(idempotencyKeyHeader, "first").WithJSON(other).Expect().
+		Status(http.StatusUnprocessableEntity)
+
+	if processed.Load() != 2 {
+		t.Fatalf("processed %d signups, want 2", processed.Load())
+	}
+}
+
+func TestDoubleClickWaitsForTheFirstSignup(t *testing.T) {
+	// Arrange
+	release := make(chan struct{})
+	store := newIdempotencyStore(time.Hour)
+	e, processed := idempotentSignups(t, store, release)
+	first, second := make(chan *httpexpect.Response), make(chan *httpexpect.Response)
+	go func() { first <- e.POST("/api/signup").WithJSON(testMember()).Expect() }()
+	for claimed := 0; claimed == 0; {
+		time.Sleep(time.Millisecond)
+		store.mutex.Lock()
+		claimed = len(store.responses)
+		store.mutex.Unlock()
+	}
+
+	// Act: the second click comes in while the first is still being processed
+	go func() { second <- e.POST("/api/signup").WithJSON(testMember()).Expect() }()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	// Assert
+	(<-first).Status(http.StatusOK).JSON().Object().HasValue("number", 1)
+	(<-second).Status(http.StatusOK).JSON().Object().HasValue("number", 1)
+	if processed.Load() != 1 {
+		t.Fatalf("processed %d signups, want 1", processed.Load())
+	}
+}
+
+func TestSignupIsRetriedAfterTheMailFailed(t *testing.T) {
+	// Arrange: the first attempt gets past validation, but the mail server is down
+	attempts := &atomic.Int32{}
+	router := gin.New()
+	router.POST("/api/signup", withIdempotency(newIdempotencyStore(time.Hour)), func(context *gin.Context) {
+		var member PISignUp
+		json.NewDecoder(context.Request.Body).Decode(&member)
+		settle, ok := replayGuard(context, member)
+		if !ok {
+			return
+		}
+		defer settle(true)
+		if attempts.Add(1) == 1 {
+			context.JSON(http.StatusInternalServerError, gin.H{"Errors": []string{"Er is iets fout gegaan"}})
+			return
+		}
+		context.JSON(http.StatusOK, gin.H{"Success": "Registration successful."})
+	})
+	e := httpexpect.WithConfig(httpexpect.Config{
+		Client:   &http.Client{Transport: httpexpect.NewBinder(router)},
+		Reporter: httpexpect.NewAssertReporter(t),
+	})
+
+	// Act & Assert
+	e.POST("/api/signup").WithHeader(idempotencyKeyHeader, "retry").WithJSON(testMember()).Expect().
+		Status(http.StatusInternalServerError)
+	e.POST("/api/signup").WithHeader(idempotencyKeyHeader, "retry").WithJSON(testMember()).Expect().
+		Status(http.StatusOK).Header(replayedHeader).IsEmpty()
+	e.POST("/api/signup").WithHeader(idempotencyKeyHeader, "retry").WithJSON(testMember()).Expect().
+		Status(http.StatusOK).Header(replayedHeader).IsEqual("true")
+	if attempts.Load() != 2 {
+		t.Fatalf("handled %d attempts, want 2", attempts.Load())
+	}
+}
+
+func TestSignupIsNotMailedTwiceWhenOnlyTheConfirmationFailed(t *testing.T) {
+	// Arrange: the secretary gets the signup, the confirmation to the member bounces
+	useTestStore(t)
+	previousMemberInfo, previousNotification := sendMemberInfoEmail, sendNotificationEmail
+	t.Cleanup(func() { sendMemberInfoEmail, sendNotificationEmail = previousMemberInfo, previousNotification })
+	mailed := &atomic.Int32{}
+	sendMemberInfoEmail = func(context.Context, PISignUp, []DuplicateMatch, ServerEmailCredentials, string) error {
+		mailed.Add(1)
+		return nil
+	}
+	sendNotificationEmail = func(context.Context, PISignUp, ServerEmailCredentials, string) error {
+		return errors.New("mailbox unavailable")
+	}
+	router := gin.New()
+	router.POST("/api/signup", withIdempotency(newIdempotencyStore(time.Hour)), func(context *gin.Context) {
+		var member PISignUp
+		json.NewDecoder(context.Request.Body).Decode(&member)
+		settle, ok := replayGuard(context, member)
+		if !ok {
+			return
+		}
+		processed := false
+		defer func() { settle(processed) }()
+		processed = deliverSignup(context, member)
+	})
+	e := httpexpect.WithConfig(httpexpect.Config{
+		Client:   &http.Client{Transport: httpexpect.NewBinder(router)},
+		Reporter: httpexpect.NewAssertReporter(t),
+	})
+
+	// Act & Assert
+	e.POST("/api/signup").WithHeader(idempotencyKeyHeader, "retry").WithJSON(testMember()).Expect().
+		Status(http.StatusOK)
+	e.POST("/api/signup").WithHeader(idempotencyKeyHeader, "retry").WithJSON(testMember()).Expect().
+		Status(http.StatusOK).Header(replayedHeader).IsEqual("true")
+	if mailed.Load() != 1 {
+		t.Fatalf("mailed the secretary %d times, want 1", mailed.Load())
+	}
+	if all, _ := SIGNUP_STORE.All(); len(all) != 1 {
+		t.Fatalf("stored %d signups, want 1", len(all))
+	}
+}
+
+func TestResubmittedSignupIsReplayedBeforeTheSpentCaptchaIsChecked(t *testing.T) {
+	// Arrange: the whole signup route with a real captcha, only openiban and the mail server are left out
+	withoutFormToken(t)
+	useTestStore(t)
+	previousLookup, previousMemberInfo, previousNotification := lookupIBAN, sendMemberInfoEmail, sendNotificationEmail
+	t.Cleanup(func() {
+		lookupIBAN, sendMemberInfoEmail, sendNotificationEmail = previousLookup, previousMemberInfo, previousNotification
+	})
+	lookupIBAN = validateIBANChecksum
+	mailed := &atomic.Int32{}
+	sendMemberInfoEmail = func(context.Context, PISignUp, []DuplicateMatch, ServerEmailCredentials, string) error {
+		mailed.Add(1)
+		return nil
+	}
+	sendNotificationEmail = func(context.Context, PISignUp, ServerEmailCredentials, string) error { return nil }
+	now := time.Now()
+	e := getGinHandlerWithCaptcha(t, testAltcha(&now))
+	var challenge AltchaChallenge
+	e.GET("/api/captcha-challenge").Expect().Status(http.StatusOK).JSON().Decode(&challenge)
+	member := testMember()
+	member.Altcha = solveAltcha(t, challenge)
+	first := e.POST("/api/signup").WithJSON(member).Expect().Status(http.StatusOK).Body().Raw()
+
+	// Act: the same signup again, like a retry after the response got lost, with the payload that is spent now
+	replayed := e.POST("/api/signup").WithJSON(member).Expect()
+	member.Nickname = "Jantje"
+	changed := e.POST("/api/signup").WithJSON(member).Expect()
+
+	// Assert
+	replayed.Status(http.StatusOK).Header(replayedHeader).IsEqual("true")
+	replayed.Body().IsEqual(first)
+	changed.Status(http.StatusBadRequest).JSON().Object().Value("error").Object().HasValue("code", captchaStale)
+	if mailed.Load() != 1 {
+		t.Fatalf("mailed the secretary %d times, want 1", mailed.Load())
+	}
+}
+
+func TestFailedSignupIsNotReplayedAndStoredResponsesExpire(t *testing.T) {
+	// Arrange
+	release := make(chan struct{})
+	close(release)
+	now := time.Now()
+	store := newIdempotencyStore(time.Hour)
+	store.now = func() time.Time { return now }
+	e, processed := idempotentSignups(t, store, release)
+	invalid := testMember()
+	invalid.PostalCode = ""
+
+	// Act & Assert
+	e.POST("/api/signup").WithHeader(idempotencyKeyHeader, "retry").WithJSON(invalid).Expect().Status(http.StatusBadRequest)
+	e.POST("/api/signup").WithHeader(idempotencyKeyHeader, "retry").WithJSON(testMember()).Expect().
+		Status(http.StatusOK).Header(replayedHeader).IsEmpty()
+
+	now = now.Add(time.Hour)
+	e.POST("/api/signup").WithHeader(idempotencyKeyHeader, "retry").WithJSON(testMember()).Expect().
+		Status(http.StatusOK).JSON().Object().HasValue("number", 2)
+	if processed.Load() != 2 {
+		t.Fatalf("processed %d signups, want 2", processed.Load())
+	}
+}
@@ -0,0 +1 @@
+var t,Ne=Object.defineProperty,Re=(e,n,r)=>n in e?Ne(e,n,{enumerable:!0,configurable:!0,writable:!0,value:r}):e[n]=r,L=(e,n,r)=>(Re(e,"symbol"!=typeof n?n+"":n,r),r);function W(){}function de(e){return e()}function le(){return Object.create(null)}function T(e){e.forEach(de)}function ge(e){return"function"==typeof e}function je(e,n){return e!=e?n==n:e!==n||e&&"object"==typeof e||"function"==typeof e}function Ge(e){return 0===Object.keys(e).length}function g(e,n){e.appendChild(n)}function Ae(e,n,r){let l=Se(e);if(!l.getElementById(n)){let i=v("style");i.id=n,i.textContent=r,Ve(l,i)}}function Se(e){if(!e)return document;let n=e.getRootNode?e.getRootNode():e.ownerDocument;return n&&n.host?n:e.ownerDocument}function Ve(e,n){return g(e.head||e,n),n.sheet}function A(e,n,r){e.insertBefore(n,r||null)}function R(e){e.parentNode&&e.parentNode.removeChild(e)}function v(e){return document.createElement(e)}function V(e){return document.createElementNS("http://www.w3.org/2000/svg",e)}function Me(e){return document.createTextNode(e)}function F(){return Me(" ")}function J(e,n,r,l){return e.addEventListener(n,r,l),()=>e.removeEventListener(n,r,l)}function s(e,n,r){null==r?e.removeAttribute(n):e.getAttribute(n)!==r&&e.setAttribute(n,r)}function Ue(e){return Array.from(e.childNodes)}function oe(e,n,r){e.classList.toggle(n,!!r)}function Fe(e,n,{bubbles:r=!1,cancelable:l=!1}={}){return new CustomEvent(e,{detail:n,bubbles:r,cancelable:l})}function Ye(e){let n={};return e.childNodes.forEach(e=>{n[e.slot||"default"]=!0}),n}let P;function B(e){P=e}function re(){if(!P)throw Error("Function called outside component initialization");return P}function Ze(e){re().$$.on_mount.push(e)}function Oe(e){re().$$.on_destroy.push(e)}function He(){let e=re();return(n,r,{cancelable:l=!1}={})=>{let i=e.$$.callbacks[n];if(i){let o=Fe(n,r,{cancelable:l});return i.slice().forEach(n=>{n.call(e,o)}),!o.defaultPrevented}return!0}}let Z=[],ee=[],O=[],se=[],me=Promise.resolve(),te=!1;function we(){te||(te=!0,me.then(q))}function Be(){return we(),me}function ne(e){O.push(e)}let Q=new Set,Y=0;function q(){if(0!==Y)return;let e=P;do{try{for(;Y<Z.length;){let n=Z[Y];Y++,B(n),We(n.$$)}}catch(r){throw Z.length=0,Y=0,r}for(B(null),Z.length=0,Y=0;ee.length;)ee.pop()();for(let l=0;l<O.length;l+=1){let i=O[l];Q.has(i)||(Q.add(i),i())}O.length=0}while(Z.length);for(;se.length;)se.pop()();te=!1,Q.clear(),B(e)}function We(e){if(null!==e.fragment){e.update(),T(e.before_update);let n=e.dirty;e.dirty=[-1],e.fragment&&e.fragment.p(e.ctx,n),e.after_update.forEach(ne)}}function Pe(e){let n=[],r=[];O.forEach(l=>-1===e.indexOf(l)?n.push(l):r.push(l)),r.forEach(e=>e()),O=n}let Te=new Set;function Xe(e,n){e&&e.i&&(Te.delete(e),e.i(n))}function De(e,n,r){let{fragment:l,after_update:i}=e.$$;l&&l.m(n,r),ne(()=>{let n=e.$$.on_mount.map(de).filter(ge);e.$$.on_destroy?e.$$.on_destroy.push(...n):T(n),e.$$.on_mount=[]}),i.forEach(ne)}function Ke(e,n){let r=e.$$;null!==r.fragment&&(Pe(r.after_update),T(r.on_destroy),r.fragment&&r.fragment.d(n),r.on_destroy=r.fragment=null,r.ctx=[])}function ze(e,n){-1===e.$$.dirty[0]&&(Z.push(e),we(),e.$$.dirty.fill(0)),e.$$.dirty[n/31|0]|=1<<n%31}function Je(e,n,r,l,i,o,a=null,c=[-1]){let u=P;B(e);let h=e.$$={fragment:null,ctx:[],props:o,update:W,not_equal:i,bound:le(),on_mount:[],on_destroy:[],on_disconnect:[],before_update:[],after_update:[],context:new Map(n.context||(u?u.$$.context:[])),callbacks:le(),dirty:c,skip_bound:!1,root:n.target||u.$$.root};a&&a(h.root);let f=!1;if(h.ctx=r?r(e,n.props||{},(n,r,...l)=>{let o=l.length?l[0]:r;return h.ctx&&i(h.ctx[n],h.ctx[n]=o)&&(!h.skip_bound&&h.bound[n]&&h.bound[n](o),f&&ze(e,n)),r}):[],h.update(),f=!0,T(h.before_update),h.fragment=!!l&&l(h.ctx),n.target){if(n.hydrate){let d=Ue(n.target);h.fragment&&h.fragment.l(d),d.forEach(R)}else h.fragment&&h.fragment.c();n.intro&&Xe(e.$$.fragment),De(e,n.target,n.anchor),q()}B(u)}let be;function D(e,n,r,l){var i;let o=null==(i=r[e])?void 0:i.type;if(n="Boolean"===o&&"boolean"!=typeof n?null!=n:n,!l||!r[e])return n;if("toAttribute"===l)switch(o){case"Object":case"Array":return null==n?null:JSON.stringify(n);case"Boolean":return n?"":null;case"Number":return n??null;default:return n}else switch(o){case"Object":case"Array":return n&&JSON.parse(n);case"Boolean":default:return n;case"Number":return null!=n?+n:n}}function Qe(e,n,r,l,i,o){let a=class extends be{constructor(){super(e,r,i),this.$$p_d=n}static get observedAttributes(){return Object.keys(n).map(e=>(n[e].attribute||e).toLowerCase())}};return Object.keys(n).forEach(e=>{Object.defineProperty(a.prototype,e,{get(){return this.$$c&&e in this.$$c?this.$$c[e]:this.$$d[e]},set(r){var l;r=D(e,r,n),this.$$d[e]=r,null==(l=this.$$c)||l.$set({[e]:r})}})}),l.forEach(e=>{Object.defineProperty(a.prototype,e,{get(){var n;return null==(n=this.$$c)?void 0:n[e]}})}),o&&(a=o(a)),e.element=a,a}"function"==typeof HTMLElement&&(be=class extends HTMLElement{constructor(e,n,r){super(),L(this,"$$ctor"),L(this,"$$s"),L(this,"$$c"),L(this,"$$cn",!1),L(this,"$$d",{}),L(this,"$$r",!1),L(this,"$$p_d",{}),L(this,"$$l",{}),L(this,"$$l_u",new Map),this.$$ctor=e,this.$$s=n,r&&this.attachShadow({mode:"open"})}addEventListener(e,n,r){if(this.$$l[e]=this.$$l[e]||[],this.$$l[e].push(n),this.$$c){let l=this.$$c.$on(e,n);this.$$l_u.set(n,l)}super.addEventListener(e,n,r)}removeEventListener(e,n,r){if(super.removeEventListener(e,n,r),this.$$c){let l=this.$$l_u.get(n);l&&(l(),this.$$l_u.delete(n))}}async connectedCallback(){if(this.$$cn=!0,!this.$$c){let e=function(e){return()=>{let n;return{c:function(){n=v("slot"),"default"!==e&&s(n,"name",e)},m:function(e,r){A(e,n,r)},d:function(e){e&&R(n)}}}};if(await Promise.resolve(),!this.$$cn)return;let n={},r=Ye(this);for(let l of this.$$s)l in r&&(n[l]=[e(l)]);for(let i of this.attributes){let o=this.$$g_p(i.name);o in this.$$d||(this.$$d[o]=D(o,i.value,this.$$p_d,"toProp"))}this.$$c=new this.$$ctor({target:this.shadowRoot||this,props:{...this.$$d,$$slots:n,$$scope:{ctx:[]}}});let a=()=>{for(let e in this.$$r=!0,this.$$p_d)if(this.$$d[e]=this.$$c.$$.ctx[this.$$c.$$.props[e]],this.$$p_d[e].reflect){let n=D(e,this.$$d[e],this.$$p_d,"toAttribute");null==n?this.removeAttribute(this.$$p_d[e].attribute||e):this.setAttribute(this.$$p_d[e].attribute||e,n)}this.$$r=!1};for(let c in this.$$c.$$.after_update.push(a),a(),this.$$l)for(let u of this.$$l[c]){let h=this.$$c.$on(c,u);this.$$l_u.set(u,h)}this.$$l={}}}attributeChangedCallback(e,n,r){var l;this.$$r||(e=this.$$g_p(e),this.$$d[e]=D(e,r,this.$$p_d,"toProp"),null==(l=this.$$c)||l.$set({[e]:this.$$d[e]}))}disconnectedCallback(){this.$$cn=!1,Promise.resolve().then(()=>{this.$$cn||(this.$$c.$destroy(),this.$$c=void 0)})}$$g_p(e){return Object.keys(this.$$p_d).find(n=>this.$$p_d[n].attribute===e||!this.$$p_d[n].attribute&&n.toLowerCase()===e)||e}});class et{constructor(){L(this,"$$"),L(this,"$$set")}$destroy(){Ke(this,1),this.$destroy=W}$on(e,n){if(!ge(n))return W;let r=this.$$.callbacks[e]||(this.$$.callbacks[e]=[]);return r.push(n),()=>{let e=r.indexOf(n);-1!==e&&r.splice(e,1)}}$set(e){this.$$set&&!Ge(e)&&(this.$$.skip_bound=!0,this.$$set(e),this.$$.skip_bound=!1)}}let tt="4";"u">typeof window&&(window.__svelte||(window.__svelte={v:new Set})).v.add("4");let $e="KGZ1bmN0aW9uKCl7InVzZSBzdHJpY3QiO2NvbnN0IHI9bmV3IFRleHRFbmNvZGVyO2Z1bmN0aW9uIGMoZSl7cmV0dXJuWy4uLm5ldyBVaW50OEFycmF5KGUpXS5tYXAobj0+bi50b1N0cmluZygxNikucGFkU3RhcnQoMiwiMCIpKS5qb2luKCIiKX1hc3luYyBmdW5jdGlvbiBsKGUsbixhKXtyZXR1cm4gYyhhd2FpdCBjcnlwdG8uc3VidGxlLmRpZ2VzdChhLnRvVXBwZXJDYXNlKCksci5lbmNvZGUoZStuKSkpfWFzeW5jIGZ1bmN0aW9uIGkoZSxuLGE9IlNIQS0yNTYiLG89MWU3KXtjb25zdCBzPURhdGUubm93KCk7Zm9yKGxldCB0PTA7dDw9bzt0KyspaWYoYXdhaXQgbChuLHQsYSk9PT1lKXJldHVybntudW1iZXI6dCx0b29rOkRhdGUubm93KCktc307cmV0dXJuIG51bGx9b25tZXNzYWdlPWFzeW5jIGU9Pntjb25zdHthbGc6bixjaGFsbGVuZ2U6YSxtYXg6byxzYWx0OnN9PWUuZGF0YXx8e307aWYoYSYmcyl7Y29uc3QgdD1hd2FpdCBpKGEscyxuLG8pO3NlbGYucG9zdE1lc3NhZ2UodCYmey4uLnQsd29ya2VyOiEwfSl9ZWxzZSBzZWxmLnBvc3RNZXNzYWdlKG51bGwpfX0pKCk7Cg==",ce="u">typeof window&&window.Blob&&new Blob([atob($e)],{type:"text/javascript;charset=utf-8"});function nt(){let e;try{if(!(e=ce&&(window.URL||window.webkitURL).createObjectURL(ce)))throw"";return new Worker(e)}catch{return new Worker("data:application/javascript;base64,"+$e)}finally{e&&(window.URL||window.webkitURL).revokeObjectURL(e)}}let rt=1e7,it=new TextEncoder;function lt(e){return[...new Uint8Array(e)].map(e=>e.toString(16).padStart(2,"0")).join("")}async function ot(e=1e5,n="SHA-256"){let r=Date.now().toString(16),l=await _e(r,Math.round(Math.random()*e),n);return{algorithm:n,challenge:l,salt:r,signature:""}}async function _e(e,n,r){return lt(await crypto.subtle.digest(r.toUpperCase(),it.encode(e+n)))}async function st(e,n,r="SHA-256",l=1e7){let i=Date.now();for(let o=0;o<=l;o++)if(await _e(n,o,r)===e)return{number:o,took:Date.now()-i};return null}var p=((t=p||{}).ERROR="error",t.VERIFIED="verified",t.VERIFYING="verifying",t.UNVERIFIED="unverified",t);function ct(e){Ae(e,"svelte-fqcw55",".altcha.svelte-fqcw55.svelte-fqcw55{background:var(--altcha-color-base, transparent);border:1px solid var(--altcha-color-border, #a0a0a0);border-radius:3px;color:var(--altcha-color-text, currentColor);display:flex;flex-direction:column;max-width:260px;overflow:hidden;position:relative;text-align:left}.altcha.svelte-fqcw55.svelte-fqcw55:focus-within{border-color:var(--altcha-color-border-focus, currentColor)}.altcha-main.svelte-fqcw55.svelte-fqcw55{align-items:center;display:flex;gap:0.4rem;padding:0.7rem}.altcha-label.svelte-fqcw55.svelte-fqcw55{flex-grow:1}.altcha-label.svelte-fqcw55 label.svelte-fqcw55{cursor:pointer}.altcha-logo.svelte-fqcw55.svelte-fqcw55{color:currentColor;opacity:0.3}.altcha-logo.svelte-fqcw55.svelte-fqcw55:hover{opacity:1}.altcha-error.svelte-fqcw55.svelte-fqcw55{color:var(--altcha-color-error-text, #f23939);display:flex;font-size:0.85rem;gap:0.3rem;padding:0 0.7rem 0.7rem}.altcha-footer.svelte-fqcw55.svelte-fqcw55{align-items:center;background-color:var(--altcha-color-footer-bg, transparent);display:flex;font-size:0.75rem;opacity:0.4;padding:0.2rem 0.7rem;text-align:right}.altcha-footer.svelte-fqcw55.svelte-fqcw55:hover{opacity:1}.altcha-footer.svelte-fqcw55>.svelte-fqcw55:first-child{flex-grow:1}.altcha-footer.svelte-fqcw55 a{color:currentColor}.altcha-checkbox.svelte-fqcw55.svelte-fqcw55{display:flex;align-items:center;height:24px;width:24px}.altcha-checkbox.svelte-fqcw55 input.svelte-fqcw55{width:18px;height:18px;margin:0}.altcha-hidden.svelte-fqcw55.svelte-fqcw55{display:none}.altcha-spinner.svelte-fqcw55.svelte-fqcw55{animation:svelte-fqcw55-altcha-spinner 0.75s infinite linear;transform-origin:center}@keyframes svelte-fqcw55-altcha-spinner{100%{transform:rotate(360deg)}}")}function ae(e){let n,r,l;return{c(){n=V("svg"),r=V("path"),l=V("path"),s(r,"d","M12,1A11,11,0,1,0,23,12,11,11,0,0,0,12,1Zm0,19a8,8,0,1,1,8-8A8,8,0,0,1,12,20Z"),s(r,"fill","currentColor"),s(r,"opacity",".25"),s(l,"d","M12,4a8,8,0,0,1,7.89,6.7A1.53,1.53,0,0,0,21.38,12h0a1.5,1.5,0,0,0,1.48-1.75,11,11,0,0,0-21.72,0A1.5,1.5,0,0,0,2.62,12h0a1.53,1.53,0,0,0,1.49-1.3A8,8,0,0,1,12,4Z"),s(l,"fill","currentColor"),s(l,"class","altcha-spinner svelte-fqcw55"),s(n,"width","24"),s(n,"height","24"),s(n,"viewBox","0 0 24 24"),s(n,"xmlns","http://www.w3.org/2000/svg")},m(e,i){A(e,n,i),g(n,r),g(n,l)},d(e){e&&R(n)}}}function at(e){let n,r=e[8].label+"",l;return{c(){n=v("label"),s(n,"for",l=e[2]+"_checkbox"),s(n,"class","svelte-fqcw55")},m(e,l){A(e,n,l),n.innerHTML=r},p(e,i){256&i[0]&&r!==(r=e[8].label+"")&&(n.innerHTML=r),4&i[0]&&l!==(l=e[2]+"_checkbox")&&s(n,"for",l)},d(e){e&&R(n)}}}function ft(e){let n,r=e[8].verifying+"";return{c(){n=v("span")},m(e,l){A(e,n,l),n.innerHTML=r},p(e,l){256&l[0]&&r!==(r=e[8].verifying+"")&&(n.innerHTML=r)},d(e){e&&R(n)}}}function ut(e){let n,r=e[8].verified+"",l,i;return{c(){n=v("span"),l=F(),i=v("input"),s(i,"type","hidden"),s(i,"name",e[2]),i.value=e[3]},m(e,o){A(e,n,o),n.innerHTML=r,A(e,l,o),A(e,i,o)},p(e,l){256&l[0]&&r!==(r=e[8].verified+"")&&(n.innerHTML=r),4&l[0]&&s(i,"name",e[2]),8&l[0]&&(i.value=e[3])},d(e){e&&(R(n),R(l),R(i))}}}function fe(e){let n,r,l,i,o,a=e[8].error+"";return{c(){n=v("div"),r=V("svg"),l=V("path"),i=F(),o=v("div"),s(l,"stroke-linecap","round"),s(l,"stroke-linejoin","round"),s(l,"d","M6 18L18 6M6 6l12 12"),s(r,"width","14"),s(r,"height","14"),s(r,"xmlns","http://www.w3.org/2000/svg"),s(r,"fill","none"),s(r,"viewBox","0 0 24 24"),s(r,"stroke-width","1.5"),s(r,"stroke","currentColor"),s(o,"title",e[7]),s(n,"class","altcha-error svelte-fqcw55")},m(e,c){A(e,n,c),g(n,r),g(r,l),g(n,i),g(n,o),o.innerHTML=a},p(e,n){256&n[0]&&a!==(a=e[8].error+"")&&(o.innerHTML=a),128&n[0]&&s(o,"title",e[7])},d(e){e&&R(n)}}}function ue(e){let n,r,l=e[8].footer+"";return{c(){n=v("div"),r=v("div"),s(r,"class","svelte-fqcw55"),s(n,"class","altcha-footer svelte-fqcw55")},m(e,i){A(e,n,i),g(n,r),r.innerHTML=l},p(e,n){256&n[0]&&l!==(l=e[8].footer+"")&&(r.innerHTML=l)},d(e){e&&R(n)}}}function ht(e){let n,r,l,i,o,a,c,u,h,f,d,_,$,m,b,w,y,x,k,C,E=e[4]===p.VERIFYING&&ae();function I(e,n){return e[4]===p.VERIFIED?ut:e[4]===p.VERIFYING?ft:at}let N=I(e),G=N(e),j=e[7]&&fe(e),U=e[8].footer&&!0!==e[1]&&ue(e);return{c(){n=v("div"),r=v("div"),E&&E.c(),l=F(),i=v("div"),o=v("input"),u=F(),h=v("div"),G.c(),f=F(),d=v("div"),_=v("a"),$=V("svg"),m=V("path"),b=V("path"),w=V("path"),y=F(),j&&j.c(),x=F(),U&&U.c(),s(o,"type","checkbox"),s(o,"id",a=e[2]+"_checkbox"),o.required=c="onsubmit"!==e[0],s(o,"class","svelte-fqcw55"),s(i,"class","altcha-checkbox svelte-fqcw55"),oe(i,"altcha-hidden",e[4]===p.VERIFYING),s(h,"class","altcha-label svelte-fqcw55"),s(m,"d","M2.33955 16.4279C5.88954 20.6586 12.1971 21.2105 16.4279 17.6604C18.4699 15.947 19.6548 13.5911 19.9352 11.1365L17.9886 10.4279C17.8738 12.5624 16.909 14.6459 15.1423 16.1284C11.7577 18.9684 6.71167 18.5269 3.87164 15.1423C1.03163 11.7577 1.4731 6.71166 4.8577 3.87164C8.24231 1.03162 13.2883 1.4731 16.1284 4.8577C16.9767 5.86872 17.5322 7.02798 17.804 8.2324L19.9522 9.01429C19.7622 7.07737 19.0059 5.17558 17.6604 3.57212C14.1104 -0.658624 7.80283 -1.21043 3.57212 2.33956C-0.658625 5.88958 -1.21046 12.1971 2.33955 16.4279Z"),s(m,"fill","currentColor"),s(b,"d","M3.57212 2.33956C1.65755 3.94607 0.496389 6.11731 0.12782 8.40523L2.04639 9.13961C2.26047 7.15832 3.21057 5.25375 4.8577 3.87164C8.24231 1.03162 13.2883 1.4731 16.1284 4.8577L13.8302 6.78606L19.9633 9.13364C19.7929 7.15555 19.0335 5.20847 17.6604 3.57212C14.1104 -0.658624 7.80283 -1.21043 3.57212 2.33956Z"),s(b,"fill","currentColor"),s(w,"d","M7 10H5C5 12.7614 7.23858 15 10 15C12.7614 15 15 12.7614 15 10H13C13 11.6569 11.6569 13 10 13C8.3431 13 7 11.6569 7 10Z"),s(w,"fill","currentColor"),s($,"width","22"),s($,"height","22"),s($,"viewBox","0 0 20 20"),s($,"fill","none"),s($,"xmlns","http://www.w3.org/2000/svg"),s(_,"href",ve),s(_,"target","_blank"),s(_,"class","altcha-logo svelte-fqcw55"),s(r,"class","altcha-main svelte-fqcw55"),s(n,"class","altcha svelte-fqcw55"),s(n,"data-state",e[4])},m(a,c){A(a,n,c),g(n,r),E&&E.m(r,null),g(r,l),g(r,i),g(i,o),o.checked=e[5],g(r,u),g(r,h),G.m(h,null),g(r,f),g(r,d),g(d,_),g(_,$),g($,m),g($,b),g($,w),g(n,y),j&&j.m(n,null),g(n,x),U&&U.m(n,null),e[22](n),k||(C=[J(o,"change",e[21]),J(o,"change",e[9]),J(o,"invalid",e[10])],k=!0)},p(e,u){e[4]===p.VERIFYING?E||((E=ae()).c(),E.m(r,l)):E&&(E.d(1),E=null),4&u[0]&&a!==(a=e[2]+"_checkbox")&&s(o,"id",a),1&u[0]&&c!==(c="onsubmit"!==e[0])&&(o.required=c),32&u[0]&&(o.checked=e[5]),16&u[0]&&oe(i,"altcha-hidden",e[4]===p.VERIFYING),N===(N=I(e))&&G?G.p(e,u):(G.d(1),(G=N(e))&&(G.c(),G.m(h,null))),e[7]?j?j.p(e,u):((j=fe(e)).c(),j.m(n,x)):j&&(j.d(1),j=null),e[8].footer&&!0!==e[1]?U?U.p(e,u):((U=ue(e)).c(),U.m(n,null)):U&&(U.d(1),U=null),16&u[0]&&s(n,"data-state",e[4])},i:W,o:W,d(r){r&&R(n),E&&E.d(),G.d(),j&&j.d(),U&&U.d(),e[22](null),k=!1,T(C)}}}let ve="https://altcha.org/";function he(e){return JSON.parse(e)}function dt(e,n,r){let l,i,o,{auto:a}=n,{challengeurl:c}=n,{challengejson:u}=n,{debug:h=!1}=n,{hidefooter:f=!1}=n,{name:d="altcha"}=n,{maxnumber:_}=n,{mockerror:$=!1}=n,{strings:m}=n,{test:b=!1}=n,w=He(),y=["SHA-256","SHA-384","SHA-512"],x=!1,k,C=null,E=null,I=null,N=p.UNVERIFIED;function G(...e){(h||e.some(e=>e instanceof Error))&&console[e[0]instanceof Error?"error":"log"]("ALTCHA",...e)}function j(e){C&&"onsubmit"===a&&N===p.UNVERIFIED&&(e.preventDefault(),e.stopPropagation(),K().then(()=>{null==C||C.requestSubmit()}))}function U(){X()}async function S(){if($)throw G("mocking error"),Error("Mocked error.");if(l)return G("using provided json data"),l;if(b)return G("generating test challenge"),ot();{if(!c)throw Error("Attribute challengeurl not set.");G("fetching challenge from",c);let e=await fetch(c);if(200!==e.status)throw Error(`Server responded with ${e.status}.`);return e.json()}}async function H(e){let n=null;if("Worker"in window){try{n=await M(e.challenge,e.salt,e.algorithm)}catch(r){G(r)}if((null==n?void 0:n.number)!==void 0)return{data:e,solution:n}}return{data:e,solution:await st(e.challenge,e.salt,e.algorithm,_)}}async function M(e,n,r){let l=new nt;return new Promise(i=>{l.addEventListener("message",e=>{i(e.data)}),l.postMessage({alg:r,challenge:e,max:_,salt:n})})}function X(e=p.UNVERIFIED){r(5,x=!1),r(7,E=null),r(3,I=null),r(4,N=e)}async function K(){return X(p.VERIFYING),S().then(e=>((function e(n){if(!n.algorithm)throw Error("Invalid challenge. Property algorithm is missing.");if(void 0===n.signature)throw Error("Invalid challenge. Property signature is missing.");if(!y.includes(n.algorithm.toUpperCase()))throw Error(`Unknown algorithm value. Allowed values: ${y.join(", ")}`);if(!n.challenge||n.challenge.length<40)throw Error("Challenge is too short. Min. 40 chars.");if(!n.salt||n.salt.length<10)throw Error("Salt is too short. Min. 10 chars.")})(e),G("challenge",e),H(e))).then(({data:e,solution:n})=>{if(G("solution",n),(null==n?void 0:n.number)!==void 0){var l,i;G("verified"),r(4,N=p.VERIFIED),r(5,x=!0),r(3,I=(l=e,i=n,btoa(JSON.stringify({algorithm:l.algorithm,challenge:l.challenge,number:i.number,salt:l.salt,signature:l.signature,test:!!b||void 0,took:i.took})))),G("payload",I),Be().then(()=>{w("verified",{payload:I})})}else throw Error("Unexpected result returned.")}).catch(e=>{G(e),r(4,N=p.ERROR),r(5,x=!1),r(7,E=e)})}return Oe(()=>{C&&(C.removeEventListener("submit",j),C.removeEventListener("reset",U),C=null)}),Ze(()=>{G("mounted","0.1.5"),b&&G("using test mode"),void 0!==a&&G("auto",a),(C=k.closest("form"))&&(C.addEventListener("submit",j),C.addEventListener("reset",U)),"onload"===a&&K()}),e.$$set=e=>{"auto"in e&&r(0,a=e.auto),"challengeurl"in e&&r(11,c=e.challengeurl),"challengejson"in e&&r(12,u=e.challengejson),"debug"in e&&r(13,h=e.debug),"hidefooter"in e&&r(1,f=e.hidefooter),"name"in e&&r(2,d=e.name),"maxnumber"in e&&r(14,_=e.maxnumber),"mockerror"in e&&r(15,$=e.mockerror),"strings"in e&&r(16,m=e.strings),"test"in e&&r(17,b=e.test)},e.$$.update=()=>{4096&e.$$.dirty[0]&&(l=u?he(u):void 0),65536&e.$$.dirty[0]&&r(20,i=m?he(m):{}),1048576&e.$$.dirty[0]&&r(8,o={error:"Verification failed. Try again later.",footer:`Protected by <a href="${ve}" target="_blank">ALTCHA</a>`,label:"I'm not a robot",verified:"Verified",verifying:"Verifying...",waitAlert:"Verifying... please wait.",...i}),24&e.$$.dirty[0]&&w("statechange",{payload:I,state:N})},[a,f,d,I,N,x,k,E,o,function e(){[p.UNVERIFIED,p.ERROR].includes(N)?K():r(5,x=!0)},function e(){N===p.VERIFYING&&alert(o.waitAlert)},c,u,h,_,$,m,b,X,K,i,function e(){r(5,x=this.checked)},function e(n){ee[n?"unshift":"push"](()=>{r(6,k=n)})}]}class gt extends et{constructor(e){super(),Je(this,e,dt,ht,je,{auto:0,challengeurl:11,challengejson:12,debug:13,hidefooter:1,name:2,maxnumber:14,mockerror:15,strings:16,test:17,reset:18,verify:19},ct,[-1,-1])}get auto(){return this.$$.ctx[0]}set auto(e){this.$$set({auto:e}),q()}get challengeurl(){return this.$$.ctx[11]}set challengeurl(e){this.$$set({challengeurl:e}),q()}get challengejson(){return this.$$.ctx[12]}set challengejson(e){this.$$set({challengejson:e}),q()}get debug(){return this.$$.ctx[13]}set debug(e){this.$$set({debug:e}),q()}get hidefooter(){return this.$$.ctx[1]}set hidefooter(e){this.$$set({hidefooter:e}),q()}get name(){return this.$$.ctx[2]}set name(e){this.$$set({name:e}),q()}get maxnumber(){return this.$$.ctx[14]}set maxnumber(e){this.$$set({maxnumber:e}),q()}get mockerror(){return this.$$.ctx[15]}set mockerror(e){this.$$set({mockerror:e}),q()}get strings(){return this.$$.ctx[16]}set strings(e){this.$$set({strings:e}),q()}get test(){return this.$$.ctx[17]}set test(e){this.$$set({test:e}),q()}get reset(){return this.$$.ctx[18]}get verify(){return this.$$.ctx[19]}}customElements.define("altcha-widget",Qe(gt,{auto:{},challengeurl:{},challengejson:{},debug:{type:"Boolean"},hidefooter:{type:"Boolean"},name:{},maxnumber:{},mockerror:{type:"Boolean"},strings:{},test:{type:"Boolean"}},[],["reset","verify"],!1));export{gt as Altcha};
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Without flock the lock files are only created, not locked. The mutexes still keep the server consistent,
+// but the admin commands must not run while the server does, or one of them loses the changes of the other.
+
+func lockExclusive(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}